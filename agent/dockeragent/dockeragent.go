@@ -2,6 +2,8 @@ package dockeragent
 
 import (
     "bytes"
+    "crypto/tls"
+    "crypto/x509"
     "errors"
     "fmt"
     "io/ioutil"
@@ -29,6 +31,9 @@ type DockerAgent struct {
 
 func NewDockerAgent(broker DockerBroker, sa ServiceAgent) (*DockerAgent, error) {
     urlstr := "http://"+broker.Host
+    if len(broker.CAFile) > 0 {
+        urlstr = "https://"+broker.Host
+    }
     
     if broker.Port > 0 {
         urlstr = urlstr +":"+strconv.Itoa(broker.Port)
@@ -39,6 +44,12 @@ func NewDockerAgent(broker DockerBroker, sa ServiceAgent) (*DockerAgent, error)
         return nil, err
     }
     httpClient := newHTTPClient(u)
+    if len(broker.CAFile) > 0 {
+        httpClient, err = newHTTPsClient(broker)
+        if err != nil {
+            return nil, err
+        }
+    }
     return &DockerAgent{u, httpClient,broker,sa}, nil
 }
 
@@ -50,7 +61,9 @@ func (client *DockerAgent) DoRequest(method string, path string, body []byte) ([
     }
 //    req.Header.Add("Content-Type", "application/json")
     req.Header.Add("X-Broker-Api-Version","1.1")
-    req.SetBasicAuth(client.Broker.User,client.Broker.Password)
+    if len(client.Broker.CertFile) == 0 {
+        req.SetBasicAuth(client.Broker.User,client.Broker.Password)
+    }
     resp, err := client.HTTPClient.Do(req)
     if err != nil {
         return nil, err
@@ -85,13 +98,32 @@ func newHTTPClient(u *url.URL) *http.Client {
     return &http.Client{Transport: httpTransport}
 }
 
-func (client *DockerAgent) Register(clientCertFile,clientKeyFile,caFile string) error {    
-    client.UploadCerts(clientCertFile,clientKeyFile,caFile)
+func newHTTPsClient(broker DockerBroker) (*http.Client, error) {
+    ca, err := ioutil.ReadFile(broker.CAFile)
+    if err != nil {
+        return nil, err
+    }
+    config := &tls.Config{RootCAs: x509.NewCertPool()}
+    if !config.RootCAs.AppendCertsFromPEM(ca) {
+        return nil, errors.New("No PEM certificates found in "+broker.CAFile)
+    }
+    if len(broker.CertFile) > 0 {
+        cert, err := tls.LoadX509KeyPair(broker.CertFile, broker.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        config.Certificates = []tls.Certificate{cert}
+    }
+    return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}, nil
+}
+
+func (client *DockerAgent) Register(clientCertFile,clientKeyFile,caFile,serverName string) error {    
+    client.UploadCerts(clientCertFile,clientKeyFile,caFile,serverName)
     go client.Ping(time.Duration(client.Serviceagent.KeepAlive) * time.Second)
     return nil
 } 
 
-func (client *DockerAgent) UploadCerts(clientCertFile,clientKeyFile,caFile string) {
+func (client *DockerAgent) UploadCerts(clientCertFile,clientKeyFile,caFile,serverName string) {
     var clientCert,clientKey,CA []byte
     if len(clientCertFile)>0 {
         log.Println("Uploading client cert file")
@@ -108,7 +140,7 @@ func (client *DockerAgent) UploadCerts(clientCertFile,clientKeyFile,caFile strin
     if len(clientCert) == 0 && len(clientKey) == 0 {
         return
     }
-    certs := BrokerCerts{Host:client.Serviceagent.DockerHost,ClientCert:clientCert,ClientKey:clientKey,CA:CA}
+    certs := BrokerCerts{Host:client.Serviceagent.DockerHost,ClientCert:clientCert,ClientKey:clientKey,CA:CA,ServerName:serverName}
 
     u, err := url.Parse("/certificate/"+client.Serviceagent.DockerHost)
     if err != nil {
@@ -24,6 +24,11 @@ type DockerBroker struct {
     Port     int
     User     string
     Password string
+    //the broker is reached over HTTPS when CAFile is set, it is verified against CAFile and
+    //the agent authenticates with CertFile/KeyFile instead of User/Password when they are set
+    CAFile   string
+    CertFile string
+    KeyFile  string
 }
 
 type BrokerCerts struct {
@@ -31,4 +36,5 @@ type BrokerCerts struct {
     ClientCert []byte
     ClientKey  []byte
     CA         []byte
+    ServerName string
 }
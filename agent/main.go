@@ -21,12 +21,13 @@ func main() {
     /* Usage: agent [ -config file ] */
 
     var configFile string
-    var clientCertFile,clientKeyFile,caFile string  
+    var clientCertFile,clientKeyFile,caFile,serverName string  
 
     flag.StringVar( &configFile, "config", "agent.config","Location of configuration file" )
     flag.StringVar( &clientCertFile, "clientcert", "","Client Certificate File")
     flag.StringVar( &clientKeyFile, "clientkey", "","ClientKey File")
     flag.StringVar( &caFile, "cacert", "","CA Certificate File")    
+    flag.StringVar( &serverName, "servername", "","Name in the docker host certificate, if it is not the docker host")
 
     flag.Parse()
 
@@ -46,9 +47,13 @@ func main() {
    
     brokerServers := make([]*dockeragent.DockerAgent,len(config.Brokerservers))
     for i,broker := range config.Brokerservers {
-        brokerServers[i],_ = dockeragent.NewDockerAgent(broker,config.Serviceagent)
-        log.Println("args to register ",clientCertFile,clientKeyFile,caFile)
-        brokerServers[i].Register(clientCertFile,clientKeyFile,caFile)
+        brokerServers[i],err = dockeragent.NewDockerAgent(broker,config.Serviceagent)
+        if err != nil {
+            log.Println( "Cannot connect to broker ", broker.Host, ": ", err )
+            os.Exit(1)
+        }
+        log.Println("args to register ",clientCertFile,clientKeyFile,caFile,serverName)
+        brokerServers[i].Register(clientCertFile,clientKeyFile,caFile,serverName)
     }
     sigCh := make(chan os.Signal, 1)
     signal.Notify(sigCh, os.Interrupt)
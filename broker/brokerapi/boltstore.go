@@ -0,0 +1,781 @@
+package brokerapi
+
+import (
+    "bytes"
+    "database/sql"
+    "encoding/binary"
+    "encoding/json"
+    "github.com/boltdb/bolt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Store keeping everything in a single BoltDB file, for installs that do without a database
+// server. Only one broker can have the file open at a time.
+type BoltStore struct {
+    Db *bolt.DB
+    //secrets like the credentials of bindings are encrypted with it when set
+    EncryptionKey string
+}
+
+var (
+    agentsBucket        = []byte("serviceagents")
+    instancesBucket     = []byte("serviceinstances")
+    bindingsBucket      = []byte("servicebindings")
+    volumesBucket       = []byte("servicevolumes")
+    operationsBucket    = []byte("serviceoperations")
+    auditBucket         = []byte("auditevents")
+    servicesBucket      = []byte("serviceconfigurations")
+    imagesBucket        = []byte("imageconfigurations")
+    certsBucket         = []byte("brokercertificates")
+    registriesBucket    = []byte("registrycredentials")
+    usersBucket         = []byte("brokerusers")
+)
+
+func OpenBoltStore(path, encryptionKey string) (*BoltStore,error) {
+    db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10*time.Second})
+    if err != nil {
+        return nil,err
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _,bucket := range [][]byte{agentsBucket,instancesBucket,bindingsBucket,volumesBucket,operationsBucket,
+                                       auditBucket,servicesBucket,imagesBucket,certsBucket,registriesBucket,usersBucket} {
+            if _,err := tx.CreateBucketIfNotExists(bucket); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil,err
+    }
+    return &BoltStore{Db: db, EncryptionKey: encryptionKey},nil
+}
+
+func (store *BoltStore) Close() error {
+    return store.Db.Close()
+}
+
+// generic functions
+
+// Keys of records belonging to an instance start with the instance id.
+func boltKey(parts ...string) []byte {
+    return []byte(strings.Join(parts,"\x00"))
+}
+
+func (store *BoltStore) put(bucket, key []byte, value interface{}) error {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return err
+    }
+    return store.Db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket(bucket).Put(key,data)
+    })
+}
+
+// Writes the record unless its key is taken, ErrRecordExists when it is.
+func (store *BoltStore) insert(bucket, key []byte, value interface{}) error {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return err
+    }
+    return store.Db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(bucket)
+        if b.Get(key) != nil {
+            return ErrRecordExists
+        }
+        return b.Put(key,data)
+    })
+}
+
+// Reads the record into value, sql.ErrNoRows when there is none.
+func (store *BoltStore) get(bucket, key []byte, value interface{}) error {
+    return store.Db.View(func(tx *bolt.Tx) error {
+        data := tx.Bucket(bucket).Get(key)
+        if data == nil {
+            return sql.ErrNoRows
+        }
+        return json.Unmarshal(data,value)
+    })
+}
+
+func (store *BoltStore) has(bucket, key []byte) bool {
+    found := false
+    store.Db.View(func(tx *bolt.Tx) error {
+        found = tx.Bucket(bucket).Get(key) != nil
+        return nil
+    })
+    return found
+}
+
+// Deletes the record, sql.ErrNoRows when there is none.
+func (store *BoltStore) delete(bucket, key []byte) error {
+    return store.Db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(bucket)
+        if b.Get(key) == nil {
+            return sql.ErrNoRows
+        }
+        return b.Delete(key)
+    })
+}
+
+// Calls fn with every record of the bucket whose key starts with prefix.
+func (store *BoltStore) each(bucket, prefix []byte, fn func(data []byte) error) error {
+    return store.Db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket(bucket).Cursor()
+        for k,v := c.Seek(prefix); k != nil && bytes.HasPrefix(k,prefix); k,v = c.Next() {
+            if err := fn(v); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// Reads the record at key, lets fn change it and writes it back in one transaction.
+func (store *BoltStore) modify(bucket, key []byte, value interface{}, fn func() error) error {
+    return store.Db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(bucket)
+        data := b.Get(key)
+        if data == nil {
+            return sql.ErrNoRows
+        }
+        if err := json.Unmarshal(data,value); err != nil {
+            return err
+        }
+        if err := fn(); err != nil {
+            return err
+        }
+        data, err := json.Marshal(value)
+        if err != nil {
+            return err
+        }
+        return b.Put(key,data)
+    })
+}
+
+//service agent calls
+
+func (store *BoltStore) AddServiceAgents(serviceagents []ServiceAgent) error {
+    var reterr error
+    for _,sa := range serviceagents {
+        sa.LastPing = time.Now()
+        if err := store.put(agentsBucket,boltKey(sa.DockerHost),sa); err != nil {
+            reterr = err
+        }
+    }
+    return reterr
+}
+
+func (store *BoltStore) MarkServiceAgentInactive(dockerhost string) error {
+    var sa ServiceAgent
+    return store.modify(agentsBucket,boltKey(dockerhost),&sa,func() error {
+        sa.IsActive = false
+        return nil
+    })
+}
+
+func (store *BoltStore) MarkServiceAgentActive(dockerhost string) error {
+    var sa ServiceAgent
+    return store.modify(agentsBucket,boltKey(dockerhost),&sa,func() error {
+        sa.IsActive = true
+        return nil
+    })
+}
+
+// Updates everything but the port bindings of a known agent.
+func (store *BoltStore) AddorUpdateServiceAgent(sa ServiceAgent) error {
+    var stored ServiceAgent
+    err := store.modify(agentsBucket,boltKey(sa.DockerHost),&stored,func() error {
+        portbindings := stored.Portbindings
+        stored = sa
+        stored.LastPing = time.Now()
+        stored.Portbindings = portbindings
+        return nil
+    })
+    if err == sql.ErrNoRows {
+        return store.AddServiceAgents([]ServiceAgent{sa})
+    }
+    return err
+}
+
+func (store *BoltStore) GetServiceAgent(dockerhost string) (ServiceAgent,error) {
+    var sa ServiceAgent
+    err := store.get(agentsBucket,boltKey(dockerhost),&sa)
+    return sa,err
+}
+
+func (store *BoltStore) GetLiveServiceAgents() ([]ServiceAgent,error) {
+    var serviceagents []ServiceAgent
+    err := store.each(agentsBucket,nil,func(data []byte) error {
+        var sa ServiceAgent
+        if err := json.Unmarshal(data,&sa); err != nil {
+            return err
+        }
+        if time.Since(sa.LastPing) < 3*time.Duration(sa.KeepAlive)*time.Second {
+            serviceagents = append(serviceagents,sa)
+        }
+        return nil
+    })
+    return serviceagents,err
+}
+
+func (store *BoltStore) GetPortBindings(dockerhost string) (int,int,[]int,error) {
+    sa, err := store.GetServiceAgent(dockerhost)
+    if err != nil {
+        return 0,0,nil,err
+    }
+    var pb []int
+    if len(sa.Portbindings) > 0 {
+        pb = UnmarshalIntArray(sa.Portbindings)
+    }
+    return sa.Portbind_min,sa.Portbind_max,pb,nil
+}
+
+func (store *BoltStore) WritePortBinding(ports []int, dockerhost string) error {
+    var sa ServiceAgent
+    return store.modify(agentsBucket,boltKey(dockerhost),&sa,func() error {
+        sa.Portbindings = MarshalIntArray(ports)
+        return nil
+    })
+}
+
+//service instance calls
+
+func (store *BoltStore) AddServiceInstance(service_name string, service_port, host_port int,
+            service_url, container_id, service_agent, container_name, image_name string,
+            pr ProvisioningRequest, started_at time.Time) error {
+    instance, err := newStoredInstance(service_name,service_port,host_port,
+                                       service_url,container_id,service_agent,container_name,image_name,
+                                       pr,started_at,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    return store.insert(instancesBucket,boltKey(pr.InstanceId),instance)
+}
+
+func (store *BoltStore) getInstance(instanceid string) (storedInstance,error) {
+    var instance storedInstance
+    err := store.get(instancesBucket,boltKey(instanceid),&instance)
+    return instance,err
+}
+
+func (store *BoltStore) GetServiceInstance(instanceid string) (ServiceInstance,error) {
+    stored, err := store.getInstance(instanceid)
+    if err != nil {
+        return ServiceInstance{InstanceId: instanceid},err
+    }
+    return stored.serviceInstance(store.EncryptionKey)
+}
+
+func (store *BoltStore) GetServiceAgentFromInstance(instanceid string) (string,error) {
+    instance, err := store.getInstance(instanceid)
+    return instance.ServiceAgent,err
+}
+
+func (store *BoltStore) GetContainerIdAndImageName(instanceid string) (string,string) {
+    instance, _ := store.getInstance(instanceid)
+    return instance.ContainerId,instance.ImageName
+}
+
+func (store *BoltStore) GetServicePort(instanceid string) int {
+    instance, err := store.getInstance(instanceid)
+    if err != nil {
+        return -1
+    }
+    return instance.ServicePort
+}
+
+func (store *BoltStore) GetHostPort(instanceid string) int {
+    instance, err := store.getInstance(instanceid)
+    if err != nil {
+        return -1
+    }
+    return instance.HostPort
+}
+
+func (store *BoltStore) GetServiceInstancePlan(instanceid string) string {
+    instance, _ := store.getInstance(instanceid)
+    return instance.PlanId
+}
+
+func (store *BoltStore) GetServiceUrl(instanceid string) string {
+    instance, err := store.getInstance(instanceid)
+    if err != nil {
+        return ""
+    }
+    return instance.serviceUrl(store.EncryptionKey)
+}
+
+func (store *BoltStore) UpdateServiceInstance(instanceid, planid, containerid string, parameters map[string]interface{}) error {
+    var instance storedInstance
+    return store.modify(instancesBucket,boltKey(instanceid),&instance,func() error {
+        instance.PlanId = planid
+        instance.ContainerId = containerid
+        instance.Parameters = parameters
+        return nil
+    })
+}
+
+func (store *BoltStore) DeleteServiceInstance(instanceid string) error {
+    err := store.delete(instancesBucket,boltKey(instanceid))
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    return err
+}
+
+//service volume calls
+
+func (store *BoltStore) AddServiceVolume(volume ServiceVolume) error {
+    return store.put(volumesBucket,boltKey(volume.InstanceId,volume.Path),volume)
+}
+
+func (store *BoltStore) GetServiceVolumes(instanceid string) ([]ServiceVolume,error) {
+    volumes := []ServiceVolume{}
+    err := store.each(volumesBucket,boltKey(instanceid,""),func(data []byte) error {
+        var volume ServiceVolume
+        if err := json.Unmarshal(data,&volume); err != nil {
+            return err
+        }
+        volumes = append(volumes,volume)
+        return nil
+    })
+    return volumes,err
+}
+
+func (store *BoltStore) DeleteServiceVolume(instanceid, path string) error {
+    err := store.delete(volumesBucket,boltKey(instanceid,path))
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    return err
+}
+
+//service bindings calls
+
+func (store *BoltStore) AddServiceBinding(binding ServiceBinding, started_at time.Time) error {
+    stored, err := newStoredBinding(binding,started_at,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    return store.insert(bindingsBucket,boltKey(binding.InstanceId,binding.BindingId),stored)
+}
+
+func (store *BoltStore) GetServiceBinding(instanceid, bindingid string) (ServiceBinding,error) {
+    var stored storedBinding
+    if err := store.get(bindingsBucket,boltKey(instanceid,bindingid),&stored); err != nil {
+        return ServiceBinding{InstanceId: instanceid, BindingId: bindingid},err
+    }
+    return stored.serviceBinding(store.EncryptionKey)
+}
+
+func (store *BoltStore) DeleteServiceBinding(instanceid, bindingid string) error {
+    return store.delete(bindingsBucket,boltKey(instanceid,bindingid))
+}
+
+//service operation calls
+
+func (store *BoltStore) AddOperation(op Operation) error {
+    return store.put(operationsBucket,boltKey(op.Id),op)
+}
+
+func (store *BoltStore) UpdateOperation(op Operation) error {
+    var stored Operation
+    return store.modify(operationsBucket,boltKey(op.Id),&stored,func() error {
+        stored.State = op.State
+        stored.Description = op.Description
+        stored.UpdatedAt = op.UpdatedAt
+        return nil
+    })
+}
+
+// Returns the given operation of the instance (or of one of its bindings when bindingId is set),
+// or the most recent one when operationId is empty.
+func (store *BoltStore) GetOperation(instanceid, bindingid, operationid string) (Operation,error) {
+    var found *Operation
+    err := store.each(operationsBucket,nil,func(data []byte) error {
+        var op Operation
+        if err := json.Unmarshal(data,&op); err != nil {
+            return err
+        }
+        if op.InstanceId != instanceid || op.BindingId != bindingid || (len(operationid) > 0 && op.Id != operationid) {
+            return nil
+        }
+        if found == nil || op.StartedAt.After(found.StartedAt) {
+            found = &op
+        }
+        return nil
+    })
+    if err != nil {
+        return Operation{},err
+    }
+    if found == nil {
+        return Operation{},sql.ErrNoRows
+    }
+    return *found,nil
+}
+
+//audit trail calls
+
+func (store *BoltStore) AddAuditEvent(event AuditEvent) error {
+    data, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    return store.Db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(auditBucket)
+        seq, err := b.NextSequence()
+        if err != nil {
+            return err
+        }
+        //events of an instance sort in the order they were written
+        key := make([]byte,8)
+        binary.BigEndian.PutUint64(key,seq)
+        return b.Put(append(boltKey(event.InstanceId,""),key...),data)
+    })
+}
+
+// The events of an instance and its bindings, oldest first.
+func (store *BoltStore) GetAuditEvents(instanceid string) ([]AuditEvent,error) {
+    events := []AuditEvent{}
+    err := store.each(auditBucket,boltKey(instanceid,""),func(data []byte) error {
+        var event AuditEvent
+        if err := json.Unmarshal(data,&event); err != nil {
+            return err
+        }
+        events = append(events,event)
+        return nil
+    })
+    sort.SliceStable(events,func(i, j int) bool {
+        return events[i].Time.Before(events[j].Time)
+    })
+    return events,err
+}
+
+//service configurations calls
+
+func (store *BoltStore) AddServiceConf(user, password, catalog string) error {
+    return store.Db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(servicesBucket)
+        id, err := b.NextSequence()
+        if err != nil {
+            return err
+        }
+        data, err := json.Marshal(storedService{Id: int(id), User: user, Password: password, Catalog: catalog})
+        if err != nil {
+            return err
+        }
+        return b.Put(boltKey(catalog),data)
+    })
+}
+
+func (store *BoltStore) HasServiceConf(catalog string) bool {
+    return store.has(servicesBucket,boltKey(catalog))
+}
+
+func (store *BoltStore) GetServiceId(catalog string) int {
+    var service storedService
+    if err := store.get(servicesBucket,boltKey(catalog),&service); err != nil {
+        return -1
+    }
+    return service.Id
+}
+
+func (store *BoltStore) getServices() (map[int]*ServiceDefinition,error) {
+    services := make(map[int]*ServiceDefinition)
+    err := store.each(servicesBucket,nil,func(data []byte) error {
+        var service storedService
+        if err := json.Unmarshal(data,&service); err != nil {
+            return err
+        }
+        services[service.Id] = &ServiceDefinition{User: service.User, Password: service.Password, Catalog: service.Catalog}
+        return nil
+    })
+    return services,err
+}
+
+// The services having at least one image, like the join of the SQL persister.
+func (store *BoltStore) GetServiceConf() ([]ServiceDefinition,error) {
+    services, err := store.getServices()
+    if err != nil {
+        return nil,err
+    }
+    err = store.each(imagesBucket,nil,func(data []byte) error {
+        var image storedImage
+        if err := json.Unmarshal(data,&image); err != nil {
+            return err
+        }
+        if service,ok := services[image.ServiceId]; ok {
+            imgdef, err := image.imageDefinition(store.EncryptionKey)
+            if err != nil {
+                return err
+            }
+            service.Images = append(service.Images,imgdef)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil,err
+    }
+    svcdefs := make([]ServiceDefinition,0,len(services))
+    for _,service := range services {
+        if len(service.Images) > 0 {
+            svcdefs = append(svcdefs,*service)
+        }
+    }
+    return svcdefs,nil
+}
+
+func (store *BoltStore) DeleteServiceConf(id int) error {
+    services, err := store.getServices()
+    if err != nil {
+        return err
+    }
+    if service,ok := services[id]; ok {
+        return store.delete(servicesBucket,boltKey(service.Catalog))
+    }
+    return sql.ErrNoRows
+}
+
+//image configurations calls
+
+func (store *BoltStore) AddImageConf(service_id int, name, plan, dashboardurl, credentials string, numinstances int, containername string) error {
+    return store.AddImagePlanConf(service_id,ImageDefinition{Name: name, Plan: plan, Numinstances: numinstances, Containername: containername},
+                                  dashboardurl,credentials)
+}
+
+// Adds an image plan along with the container settings of the plan, or replaces the plan when it
+// exists. The maps of the definition are expected to be marshalled by the caller.
+func (store *BoltStore) AddImagePlanConf(service_id int, imgdef ImageDefinition, dashboardurl, credentials string) error {
+    image, err := newStoredImage(service_id,imgdef,dashboardurl,credentials,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    return store.put(imagesBucket,boltImageKey(service_id,imgdef.Name,imgdef.Plan),image)
+}
+
+func boltImageKey(service_id int, name, plan string) []byte {
+    id := make([]byte,8)
+    binary.BigEndian.PutUint64(id,uint64(service_id))
+    return boltKey(string(id),name,plan)
+}
+
+func (store *BoltStore) CountImageConf() (int,error) {
+    count := 0
+    err := store.Db.View(func(tx *bolt.Tx) error {
+        count = tx.Bucket(imagesBucket).Stats().KeyN
+        return nil
+    })
+    return count,err
+}
+
+func (store *BoltStore) DeleteImageConf(service_id int, name, plan string) error {
+    return store.delete(imagesBucket,boltImageKey(service_id,name,plan))
+}
+
+//broker certs calls
+
+func (store *BoltStore) AddBrokerCertsConf(agent string, clientcertfile, clientkeyfile, cafile []byte, servername string) error {
+    certs, err := sealBrokerCerts(BrokerCerts{Host: agent,
+                                              ClientCert: clientcertfile,
+                                              ClientKey: clientkeyfile,
+                                              CA: cafile,
+                                              ServerName: servername},store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    return store.put(certsBucket,boltKey(agent),certs)
+}
+
+func (store *BoltStore) HasBrokerCerts(agent string) bool {
+    return store.has(certsBucket,boltKey(agent))
+}
+
+func (store *BoltStore) GetBrokerCerts() ([]BrokerCerts,error) {
+    var certs []BrokerCerts
+    err := store.each(certsBucket,nil,func(data []byte) error {
+        var brokercerts BrokerCerts
+        if err := json.Unmarshal(data,&brokercerts); err != nil {
+            return err
+        }
+        brokercerts, err := openBrokerCerts(brokercerts,store.EncryptionKey)
+        if err != nil {
+            return err
+        }
+        certs = append(certs,brokercerts)
+        return nil
+    })
+    return certs,err
+}
+
+func (store *BoltStore) DeleteBrokerCertsConf(agent string) error {
+    return store.delete(certsBucket,boltKey(agent))
+}
+
+//registry credentials calls
+
+func (store *BoltStore) AddRegistryAuthConf(auth RegistryAuth) error {
+    auth, err := sealRegistryAuth(auth,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    return store.put(registriesBucket,boltKey(auth.Registry),auth)
+}
+
+func (store *BoltStore) HasRegistryAuth(registry string) bool {
+    return store.has(registriesBucket,boltKey(registry))
+}
+
+func (store *BoltStore) GetRegistryAuths() ([]RegistryAuth,error) {
+    auths := []RegistryAuth{}
+    err := store.each(registriesBucket,nil,func(data []byte) error {
+        var auth RegistryAuth
+        if err := json.Unmarshal(data,&auth); err != nil {
+            return err
+        }
+        auth, err := openRegistryAuth(auth,store.EncryptionKey)
+        if err != nil {
+            return err
+        }
+        auths = append(auths,auth)
+        return nil
+    })
+    return auths,err
+}
+
+func (store *BoltStore) DeleteRegistryAuthConf(registry string) error {
+    return store.delete(registriesBucket,boltKey(registry))
+}
+
+//broker users calls
+
+func (store *BoltStore) AddUserConf(user BrokerUser) error {
+    return store.put(usersBucket,boltKey(user.Name),user)
+}
+
+func (store *BoltStore) HasUser(name string) bool {
+    return store.has(usersBucket,boltKey(name))
+}
+
+func (store *BoltStore) GetUsers() ([]BrokerUser,error) {
+    users := []BrokerUser{}
+    err := store.each(usersBucket,nil,func(data []byte) error {
+        var user BrokerUser
+        if err := json.Unmarshal(data,&user); err != nil {
+            return err
+        }
+        users = append(users,user)
+        return nil
+    })
+    return users,err
+}
+
+func (store *BoltStore) DeleteUserConf(name string) error {
+    return store.delete(usersBucket,boltKey(name))
+}
+
+//encryption key calls
+
+// Seals the secrets of every record with newKey in a single transaction, the store uses newKey
+// from then on.
+func (store *BoltStore) RotateEncryptionKey(newKey string) error {
+    oldKey := store.EncryptionKey
+    err := store.Db.Update(func(tx *bolt.Tx) error {
+        err := rewriteBucket(tx,instancesBucket,func(data []byte) (interface{},error) {
+            var instance storedInstance
+            if err := json.Unmarshal(data,&instance); err != nil {
+                return nil,err
+            }
+            if err := instance.reencrypt(oldKey,newKey); err != nil {
+                return nil,err
+            }
+            return instance,nil
+        })
+        if err != nil {
+            return err
+        }
+        err = rewriteBucket(tx,bindingsBucket,func(data []byte) (interface{},error) {
+            var binding storedBinding
+            if err := json.Unmarshal(data,&binding); err != nil {
+                return nil,err
+            }
+            if err := binding.reencrypt(oldKey,newKey); err != nil {
+                return nil,err
+            }
+            return binding,nil
+        })
+        if err != nil {
+            return err
+        }
+        err = rewriteBucket(tx,imagesBucket,func(data []byte) (interface{},error) {
+            var image storedImage
+            if err := json.Unmarshal(data,&image); err != nil {
+                return nil,err
+            }
+            if err := image.reencrypt(oldKey,newKey); err != nil {
+                return nil,err
+            }
+            return image,nil
+        })
+        if err != nil {
+            return err
+        }
+        err = rewriteBucket(tx,certsBucket,func(data []byte) (interface{},error) {
+            var certs BrokerCerts
+            if err := json.Unmarshal(data,&certs); err != nil {
+                return nil,err
+            }
+            var err error
+            certs.ClientKey, err = reencryptBytes(oldKey,newKey,certs.ClientKey)
+            return certs,err
+        })
+        if err != nil {
+            return err
+        }
+        return rewriteBucket(tx,registriesBucket,func(data []byte) (interface{},error) {
+            var auth RegistryAuth
+            if err := json.Unmarshal(data,&auth); err != nil {
+                return nil,err
+            }
+            var err error
+            auth.Password, err = reencrypt(oldKey,newKey,auth.Password)
+            return auth,err
+        })
+    })
+    if err != nil {
+        return err
+    }
+    store.EncryptionKey = newKey
+    return nil
+}
+
+// Replaces every record of the bucket with the one fn makes of it.
+func rewriteBucket(tx *bolt.Tx, bucket []byte, fn func(data []byte) (interface{},error)) error {
+    b := tx.Bucket(bucket)
+    //bolt does not allow changing records while iterating them
+    updates := make(map[string][]byte)
+    err := b.ForEach(func(k, v []byte) error {
+        value, err := fn(v)
+        if err != nil {
+            return err
+        }
+        data, err := json.Marshal(value)
+        if err != nil {
+            return err
+        }
+        updates[string(k)] = data
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for k,data := range updates {
+        if err := b.Put([]byte(k),data); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,61 @@
+package brokerapi_test
+
+import (
+    "github.com/brahmaroutu/docker-broker/broker/brokerapi"
+    "github.com/brahmaroutu/docker-broker/broker/testhelpers"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "io/ioutil"
+    "os"
+    "time"
+)
+
+var _ = Describe("BoltStore", func() {
+    var store *brokerapi.BoltStore
+    var path string
+
+    BeforeEach(func() {
+        file, err := ioutil.TempFile("", "broker_boltdb")
+        Expect(err).ShouldNot(HaveOccurred())
+        file.Close()
+        path = file.Name()
+        store, err = brokerapi.OpenBoltStore(path, testnet.EncryptionKey)
+        Expect(err).ShouldNot(HaveOccurred())
+    })
+
+    AfterEach(func() {
+        store.Close()
+        os.Remove(path)
+    })
+
+    It("should be opened for the bolt driver", func() {
+        store.Close()
+        opened, err := brokerapi.OpenStore(brokerapi.Persister{Driver: "bolt", Database: path})
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(opened).To(BeAssignableToTypeOf(&brokerapi.BoltStore{}))
+        store = opened.(*brokerapi.BoltStore)
+    })
+
+    It("should not keep secrets in plain text", func() {
+        pr := brokerapi.ProvisioningRequest{InstanceId: "myFakeInstance", PlanId: "100"}
+        Expect(store.AddServiceInstance("mysql", 3306, 49153, `{"password":"fakeUrlPassword"}`, "myFakeContainer", "localhost",
+                                        "myFakeName", "mysql", pr, time.Now())).ShouldNot(HaveOccurred())
+        binding := brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "myFakeBinding", AppId: "myFakeApp",
+                                            Credentials: brokerapi.Credentials{"password": "fakePassword"}}
+        Expect(store.AddServiceBinding(binding, time.Now())).ShouldNot(HaveOccurred())
+        Expect(store.AddImageConf(1, "mysql", "100", "", `{"password":"fakeImagePassword"}`, 1, "")).ShouldNot(HaveOccurred())
+        Expect(store.AddBrokerCertsConf("myFakeHost", []byte("cert"), []byte("fakeClientKey"), []byte("ca"), "")).ShouldNot(HaveOccurred())
+        Expect(store.AddRegistryAuthConf(brokerapi.RegistryAuth{Registry: "registry.example.com", Username: "fakeUser",
+                                                                Password: "fakeRegistryPassword"})).ShouldNot(HaveOccurred())
+        Expect(store.RotateEncryptionKey(testnet.NewEncryptionKey)).ShouldNot(HaveOccurred())
+        store.Close()
+
+        raw, err := ioutil.ReadFile(path)
+        Expect(err).ShouldNot(HaveOccurred())
+        for _,secret := range []string{"fakeUrlPassword","fakePassword","fakeImagePassword","fakeClientKey","fakeRegistryPassword"} {
+            Expect(string(raw)).ShouldNot(ContainSubstring(secret))
+        }
+    })
+})
@@ -5,7 +5,11 @@
 package brokerapi
 
 import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
     "fmt"
+    "io/ioutil"
     "log"
     "net/http"
     "os"
@@ -21,6 +25,11 @@ type Options struct {
     LogFile  string
     Trace    bool
     PidFile  string
+    //the broker serves HTTPS when CertFile is set, clients presenting a certificate
+    //signed by ClientCAFile are authenticated by it instead of Username/Password
+    CertFile     string
+    KeyFile      string
+    ClientCAFile string
 }
 
 type broker struct {
@@ -39,6 +48,16 @@ func (b *broker) Start() {
     errCh := make(chan error, 1)
     go func() {
         addr := fmt.Sprintf("%v:%v", b.opts.Host, b.opts.Port)
+        if len(b.opts.CertFile) > 0 {
+            server, err := b.newTLSServer(addr)
+            if err != nil {
+                errCh <- err
+                return
+            }
+            log.Printf("Broker started: Listening at [%v] over TLS", addr)
+            errCh <- server.ListenAndServeTLS(b.opts.CertFile, b.opts.KeyFile)
+            return
+        }
         log.Printf("Broker started: Listening at [%v]", addr)
         errCh <- http.ListenAndServe(addr, b.router)
     }()
@@ -51,3 +70,20 @@ func (b *broker) Start() {
         log.Print("Broker shutdown gracefully")
     }
 }
+
+// Client certificates are optional, Cloud Controller keeps using basic auth.
+func (b *broker) newTLSServer(addr string) (*http.Server, error) {
+    config := &tls.Config{MinVersion: tls.VersionTLS12}
+    if len(b.opts.ClientCAFile) > 0 {
+        ca, err := ioutil.ReadFile(b.opts.ClientCAFile)
+        if err != nil {
+            return nil, err
+        }
+        config.ClientCAs = x509.NewCertPool()
+        if !config.ClientCAs.AppendCertsFromPEM(ca) {
+            return nil, errors.New("No PEM certificates found in "+b.opts.ClientCAFile)
+        }
+        config.ClientAuth = tls.VerifyClientCertIfGiven
+    }
+    return &http.Server{Addr: addr, Handler: b.router, TLSConfig: config}, nil
+}
@@ -8,10 +8,15 @@ import (
     . "github.com/onsi/ginkgo"
     . "github.com/onsi/gomega"
 
+    "crypto/tls"
+    "crypto/x509"
     "fmt"
+    "log"
+    "os"
     "time"
     "bytes"
     "strconv"
+    "encoding/base64"
     "encoding/json"
     "net/http/httptest"
     "net/http"
@@ -25,7 +30,7 @@ var _ = Describe("Broker", func() {
     var serviceagent brokerapi.ServiceAgent
     var ts *httptest.Server
     var handler *testnet.TestHandler   
-    var persister brokerapi.Persister
+    var persister brokerapi.Store
     var am *dockerapi.AgentManager
     var dispatcher brokerapi.DispatcherInterface
     var dockerServices []brokerapi.Service
@@ -46,8 +51,7 @@ var _ = Describe("Broker", func() {
         config := testnet.BrokerConfiguration()
         
         serviceagent = testnet.NewServiceAgent() 
-        persister = config.Persister
-        persister.Connect()
+        persister = config.Store
 
         dockerServices = testnet.NewDockerServices()
         
@@ -61,11 +65,172 @@ var _ = Describe("Broker", func() {
     })
     
     Describe("brokertest test broker interface", func() {
-        BeforeEach(func() {        
-            testnet.SetupSQL(persister)
-        })
         AfterEach(func() {
-            testnet.CleanupSQL(persister)
+            testnet.CleanupStore()
+        })
+
+        It("should serve https and authenticate agents by their certificates", func() {
+            dir, err := ioutil.TempDir("", "brokercerts")
+            Expect(err).To(BeNil())
+            defer os.RemoveAll(dir)
+            certs := testnet.NewTestCertificates(dir, "dockerhost1")
+
+            tlsopts := opts
+            tlsopts.Port = 61236
+            tlsopts.CertFile = certs.ServerCertFile
+            tlsopts.KeyFile = certs.ServerKeyFile
+            tlsopts.ClientCAFile = certs.CAFile
+            go brokerapi.New(tlsopts,am).Start()
+            time.Sleep(1e9)
+
+            ca, err := ioutil.ReadFile(certs.CAFile)
+            Expect(err).To(BeNil())
+            config := &tls.Config{RootCAs: x509.NewCertPool()}
+            config.RootCAs.AppendCertsFromPEM(ca)
+            catalogURL := "https://localhost:61236/v2/catalog"
+
+            //no credentials at all
+            resp, err := sendHTTPs(config, catalogURL, "", "")
+            Expect(err).To(BeNil())
+            Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+            //Cloud Controller keeps using basic auth
+            resp, err = sendHTTPs(config, catalogURL, opts.Username, opts.Password)
+            Expect(err).To(BeNil())
+            Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+            cert, err := tls.LoadX509KeyPair(certs.ClientCertFile, certs.ClientKeyFile)
+            Expect(err).To(BeNil())
+            config.Certificates = []tls.Certificate{cert}
+            resp, err = sendHTTPs(config, "https://localhost:61236/certificate/dockerhost1", "", "")
+            Expect(err).To(BeNil())
+            Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+            //the certificate makes the client the agent of dockerhost1 and nothing else
+            resp, err = sendHTTPs(config, catalogURL, "", "")
+            Expect(err).To(BeNil())
+            Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+            resp, err = sendHTTPs(config, "https://localhost:61236/certificate/dockerhost2", "", "")
+            Expect(err).To(BeNil())
+            Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+        })
+
+        It("should restrict users to the calls of their role", func() {
+            user, _ := json.Marshal(brokerapi.BrokerUser{Password: "ccsecret", Role: brokerapi.RoleCloudController})
+            _,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/user/cc",user)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            user, _ = json.Marshal(brokerapi.BrokerUser{Password: "agentsecret", Role: brokerapi.RoleAgent, Host: "dockerhost1"})
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/user/agent1",user)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            user, _ = json.Marshal(brokerapi.BrokerUser{Password: "secret", Role: "root"})
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/user/root",user)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusBadRequest))
+
+            resp,respCode,err := SendHTTP("GET",BaseURL(opts)+"/users",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            var users []brokerapi.BrokerUser
+            json.Unmarshal(resp, &users)
+            Expect(users).Should(ConsistOf(brokerapi.BrokerUser{Name: "cc", Password: "********", Role: brokerapi.RoleCloudController},
+                                           brokerapi.BrokerUser{Name: "agent1", Password: "********", Role: brokerapi.RoleAgent, Host: "dockerhost1"}))
+
+            ccopts := opts
+            ccopts.Username, ccopts.Password = "cc", "ccsecret"
+            _,respCode,err = SendHTTP("GET",BaseURL(ccopts)+"/v2/catalog",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            _,respCode,err = SendHTTP("GET",BaseURL(ccopts)+"/My%20Docker%20Catalog/images",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusForbidden))
+            ccopts.Password = "wrong"
+            _,respCode,err = SendHTTP("GET",BaseURL(ccopts)+"/v2/catalog",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusUnauthorized))
+
+            agentopts := opts
+            agentopts.Username, agentopts.Password = "agent1", "agentsecret"
+            _,respCode,err = SendHTTP("GET",BaseURL(agentopts)+"/certificate/dockerhost1",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            _,respCode,err = SendHTTP("GET",BaseURL(agentopts)+"/certificate/dockerhost2",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusForbidden))
+            _,respCode,err = SendHTTP("GET",BaseURL(agentopts)+"/v2/catalog",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusForbidden))
+
+            //an agent only registers its own docker host
+            sa := testnet.NewServiceAgent()
+            sa.DockerHost = "dockerhost1"
+            b,_ := json.Marshal(sa)
+            _,respCode,err = SendHTTP("POST",BaseURL(agentopts)+"/ping",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            sa.DockerHost = "dockerhost2"
+            b,_ = json.Marshal(sa)
+            _,respCode,err = SendHTTP("POST",BaseURL(agentopts)+"/ping",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusForbidden))
+            _,err = persister.GetServiceAgent("dockerhost2")
+            Expect(err).ShouldNot(BeNil())
+
+            _,respCode,err = SendHTTP("DELETE",BaseURL(opts)+"/user/agent1",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            _,respCode,err = SendHTTP("GET",BaseURL(agentopts)+"/certificate/dockerhost1",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusUnauthorized))
+        })
+
+        It("should keep passwords as bcrypt hashes", func() {
+            user, _ := json.Marshal(brokerapi.BrokerUser{Password: "ccsecret", Role: brokerapi.RoleCloudController})
+            _,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/user/cc",user)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+
+            users, err := persister.GetUsers()
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(users).To(HaveLen(1))
+            Expect(users[0].Password).To(HavePrefix("$2a$"))
+            Expect(users[0].Password).ShouldNot(ContainSubstring("ccsecret"))
+
+            ccopts := opts
+            ccopts.Username, ccopts.Password = "cc", "wrong"
+            _,respCode,err = SendHTTP("GET",BaseURL(ccopts)+"/v2/catalog",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusUnauthorized))
+            ccopts.Password = "ccsecret"
+            _,respCode,err = SendHTTP("GET",BaseURL(ccopts)+"/v2/catalog",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+        })
+
+        It("should neither serve nor log the secrets of requests", func() {
+            var logs bytes.Buffer
+            log.SetOutput(&logs)
+            defer log.SetOutput(os.Stderr)
+
+            user, _ := json.Marshal(brokerapi.BrokerUser{Password: "topsecret", Role: brokerapi.RoleAdmin})
+            badopts := opts
+            badopts.Password = "wrongPassword"
+            _,respCode,err := SendHTTP("PUT",BaseURL(badopts)+"/user/operator",user)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusUnauthorized))
+            _,respCode,err = SendHTTP("GET",BaseURL(opts)+"/user/operator",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusGone))
+
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/user/operator",user)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+
+            Expect(logs.String()).Should(ContainSubstring("[REDACTED]"))
+            Expect(logs.String()).ShouldNot(ContainSubstring("topsecret"))
+            Expect(logs.String()).ShouldNot(ContainSubstring(opts.Password))
+            Expect(logs.String()).ShouldNot(ContainSubstring(badopts.Password))
         })
 
         It("should publish catalog", func() {
@@ -113,6 +278,193 @@ var _ = Describe("Broker", func() {
             Expect(respmap["dashboard_url"]).To(Equal("mysql://fakehost:1234"))
         })
 
+        It("should keep the context and the originating identity of a provisioning request", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            pr.Context = map[string]interface{}{"platform": "cloudfoundry", "organization_name": "myFakeOrgName"}
+            b,_ := json.Marshal(pr)
+            identity := "cloudfoundry "+base64.StdEncoding.EncodeToString([]byte(`{"user_id":"683ea748"}`))
+
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            _,respCode,err := SendHTTPIdentity("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance","2.14","cloudfoundry !!",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusBadRequest))
+
+            _,respCode,err = SendHTTPIdentity("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance","2.14",identity,b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusCreated))
+
+            expected := &brokerapi.OriginatingIdentity{Platform: "cloudfoundry", Value: map[string]interface{}{"user_id": "683ea748"}}
+            instance,err := persister.GetServiceInstance("myFakeInstance")
+            Expect(err).To(BeNil())
+            Expect(instance.Context).To(Equal(pr.Context))
+            Expect(instance.OriginatingIdentity).To(Equal(expected))
+
+            events,err := persister.GetAuditEvents("myFakeInstance")
+            Expect(err).To(BeNil())
+            Expect(events).To(HaveLen(1))
+            Expect(events[0].Operation).To(Equal(brokerapi.OperationProvision))
+            Expect(events[0].ContainerId).To(Equal("myFakeInstance"))
+            Expect(events[0].OriginatingIdentity).To(Equal(expected))
+        })
+
+        It("should ignore the context and the originating identity of older clients", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            pr.Context = map[string]interface{}{"platform": "cloudfoundry"}
+            b,_ := json.Marshal(pr)
+
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            _,respCode,err := SendHTTPIdentity("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance","2.11","cloudfoundry !!",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusCreated))
+
+            instance,err := persister.GetServiceInstance("myFakeInstance")
+            Expect(err).To(BeNil())
+            Expect(instance.Context).To(BeNil())
+            Expect(instance.OriginatingIdentity).To(BeNil())
+        })
+
+        It("should answer a repeated provisioning request from the persisted instance", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            pr,b := newProvisioningRequest()
+
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            _,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusCreated))
+
+            resp,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Expect(respmap["dashboard_url"]).To(Equal("mysql://fakehost:1234"))
+
+            pr.PlanId = "200"
+            b,_ = json.Marshal(pr)
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusConflict))
+            Expect(handler.CallCount).To(Equal(5))
+        })
+
+        It("should answer a provisioning request while it is in progress", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,b := newProvisioningRequest()
+            persister.AddOperation(brokerapi.Operation{Id: "myFakeOperation", InstanceId: "myFakeInstance", Type: brokerapi.OperationProvision,
+                                                       State: brokerapi.OperationInProgress, StartedAt: time.Now(), UpdatedAt: time.Now(),
+                                                       Request: brokerapi.OperationRequest{ServiceId: pr.ServiceId, PlanId: pr.PlanId, OrgId: pr.OrgId, SpaceId: pr.SpaceId}})
+
+            resp,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusAccepted))
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Expect(respmap["operation"]).To(Equal("myFakeOperation"))
+
+            //a request for another plan or with other parameters is not the one in progress
+            pr.PlanId = "200"
+            b,_ = json.Marshal(pr)
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusConflict))
+            pr.PlanId = "100"
+            pr.Parameters = map[string]interface{}{"database":"orders"}
+            b,_ = json.Marshal(pr)
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusConflict))
+        })
+
+        It("should reject requests it cannot decode", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            _,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance",[]byte(`{"plan_id":`))
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusBadRequest))
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/fakeBindId",[]byte(`{"app_guid":`))
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusBadRequest))
+            Expect(handler.CallCount).To(Equal(0))
+        })
+
+        It("should provision a service asynchronously", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            _,b := newProvisioningRequest()
+
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            resp,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusAccepted))
+
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Expect(respmap["operation"]).ShouldNot(BeEmpty())
+
+            Eventually(func() interface{} {
+                return lastOperation(opts, "/v2/service_instances/myFakeInstance", respmap["operation"].(string))["state"]
+            }, 5).Should(Equal(brokerapi.OperationSucceeded))
+        })
+
+        It("should deprovision synchronously for clients older than asynchronous operations", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+                "",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "ubuntu",
+                pr, time.Now())    
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            resp,respCode,err := SendHTTPVersion("DELETE",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true","2.6",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusInternalServerError))
+            Expect(string(resp)).To(ContainSubstring("No Executor specified"))
+        })
+
+        It("should refuse service broker API versions it does not support", func() {
+            resp,respCode,err := SendHTTPVersion("GET",BaseURL(opts)+"/v2/catalog","1.9",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusPreconditionFailed))
+            Expect(string(resp)).To(ContainSubstring("supported versions are 2.0 to 2.14"))
+
+            _,respCode,err = SendHTTPVersion("GET",BaseURL(opts)+"/v2/catalog","3.0",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusPreconditionFailed))
+
+            //newer minor versions are compatible
+            _,respCode,err = SendHTTPVersion("GET",BaseURL(opts)+"/v2/catalog","2.99",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+
+            //agents are not service broker API clients
+            _,respCode,err = SendHTTPVersion("GET",BaseURL(opts)+"/certificates","1.1",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+        })
+
+        It("should fail to report last operation of an unknown instance", func() {
+            _,respCode,err := SendHTTP("GET",BaseURL(opts)+"/v2/service_instances/myUnknownInstance/last_operation",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusGone))
+        })
+
         It("should fail to deprovision when the specific agent is not present", func() {
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Deprovision_StopContainerRequest, testnet.Deprovision_RemoveContainerRequest})    
             defer ts.Close()
@@ -155,6 +507,95 @@ var _ = Describe("Broker", func() {
             Expect(respmap["description"]).To(ContainSubstring("can't find agent - assume its already gone"))
         })
 
+        It("should deprovision a service asynchronously", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Deprovision_StopContainerRequest, testnet.Deprovision_RemoveContainerRequest})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+                "mysql://fakehost:1234",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "mysql",
+                pr, time.Now())    
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            resp,respCode,err := SendHTTP("DELETE",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusAccepted))
+
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Eventually(func() interface{} {
+                return lastOperation(opts, "/v2/service_instances/myFakeInstance", respmap["operation"].(string))["state"]
+            }, 5).Should(Equal(brokerapi.OperationSucceeded))
+
+            cId,_ := persister.GetContainerIdAndImageName("myFakeInstance")
+            Expect(cId).To(BeEmpty())
+        })
+
+        It("should report a failed asynchronous deprovision", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+                "",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "ubuntu",
+                pr, time.Now())    
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            resp,respCode,err := SendHTTP("DELETE",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusAccepted))
+
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Eventually(func() interface{} {
+                return lastOperation(opts, "/v2/service_instances/myFakeInstance", respmap["operation"].(string))["state"]
+            }, 5).Should(Equal(brokerapi.OperationFailed))
+            Expect(lastOperation(opts, "/v2/service_instances/myFakeInstance", "")["description"]).To(Equal("No Executor specified"))
+
+            cId,_ := persister.GetContainerIdAndImageName("myFakeInstance")
+            Expect(cId).To(Equal("myFakeInstance"))
+        })
+
+        It("should update a service", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+                "mysql://fakehost:1234",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "mysql",
+                pr, time.Now())    
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+
+            b := []byte(`{"service_id":"mysql","plan_id":"mysql_100","previous_values":{"plan_id":"100"}}`)
+            _,respCode,err := SendHTTP("PATCH",BaseURL(opts)+"/v2/service_instances/myFakeInstance",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            Expect(persister.GetServiceInstancePlan("myFakeInstance")).To(Equal("mysql_100"))
+        })
+
+        It("should refuse to update a service while an operation is in progress on it", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+                "mysql://fakehost:1234",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "mysql",
+                pr, time.Now())    
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+            persister.AddOperation(brokerapi.Operation{Id: "myFakeOperation", InstanceId: "myFakeInstance", Type: brokerapi.OperationUpdate,
+                                                       State: brokerapi.OperationInProgress, StartedAt: time.Now(), UpdatedAt: time.Now()})
+
+            b := []byte(`{"service_id":"mysql","plan_id":"mysql_100","previous_values":{"plan_id":"100"}}`)
+            _,respCode,err := SendHTTP("PATCH",BaseURL(opts)+"/v2/service_instances/myFakeInstance?accepts_incomplete=true",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusConflict))
+            Expect(persister.GetServiceInstancePlan("myFakeInstance")).To(Equal("100"))
+        })
+
         It("should fail to bind a service if agent is not available", func() {
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_InspectContainerRequest})    
             defer ts.Close()
@@ -195,6 +636,33 @@ var _ = Describe("Broker", func() {
         })
 
 
+        It("should answer a repeated binding request from the persisted binding", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            br,b := newBindingRequest()
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+                "mysql://fakehost:1234",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "mysql",
+                pr, time.Now())    
+            persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "fakeBindingId", AppId: br.AppId,
+                                        Credentials: brokerapi.Credentials{"uri": "mysql://fakehost:1234"}}, time.Now())
+
+            resp,respCode,err := SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/fakeBindingId",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Expect(respmap["credentials"]).To(Equal(map[string]interface{}{"uri": "mysql://fakehost:1234"}))
+
+            br.AppId = "myOtherApp"
+            b,_ = json.Marshal(br)
+            _,respCode,err = SendHTTP("PUT",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/fakeBindingId",b)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusConflict))
+        })
+
         It("should bind a service", func() {
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_InspectContainerRequest})    
             defer ts.Close()
@@ -226,6 +694,40 @@ var _ = Describe("Broker", func() {
             Expect(creds["username"]).To(Equal("fakeUser"))
             Expect(creds["password"]).To(Equal("fakePassword"))
             Expect(creds["database"]).To(Equal("fakeDB"))
+
+            resp,respCode,err = SendHTTP("GET",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/fakeBindingId",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            var binding map[string] interface{}
+            json.Unmarshal(resp, &binding)
+            Expect(binding["credentials"]).To(Equal(respmap["credentials"]))
+        })
+
+        It("should return a provisioned service instance", func() {
+            pr,_ := newProvisioningRequest()
+            pr.Parameters = map[string]interface{}{"charset": "utf8"}
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+                "http://fakehost:1234/dashboard",  "myFakeInstance", serviceagent.DockerHost, "fakecontainename", "mysql",
+                pr, time.Now())    
+
+            resp,respCode,err := SendHTTP("GET",BaseURL(opts)+"/v2/service_instances/myFakeInstance",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusOK))
+            var instance brokerapi.ServiceInstance
+            json.Unmarshal(resp, &instance)
+            Expect(instance).To(Equal(brokerapi.ServiceInstance{ServiceId: "mysql", PlanId: "100",
+                DashboardUrl: "http://fakehost:1234/dashboard", Parameters: map[string]interface{}{"charset": "utf8"}}))
+
+            _,respCode,err = SendHTTPVersion("GET",BaseURL(opts)+"/v2/service_instances/myFakeInstance","2.13",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusPreconditionFailed))
+
+            _,respCode,err = SendHTTP("GET",BaseURL(opts)+"/v2/service_instances/myUnknownInstance",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusGone))
+            _,respCode,err = SendHTTP("GET",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/myUnknownBinding",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusGone))
         })
 
         It("should fail to unbind a service if agent is not available", func() {
@@ -281,7 +783,7 @@ var _ = Describe("Broker", func() {
                 "mysql://fakehost:1234",  "myFakeInstance", serviceagent.DockerHost,"fakecontainename", "mysql", 
                 pr, time.Now())    
 
-            persister.AddServiceBinding(br.InstanceId, br.BindingId, br.AppId, time.Now())
+            persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: br.InstanceId, BindingId: br.BindingId, AppId: br.AppId}, time.Now())
 
             _,respCode,err := SendHTTP("DELETE",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/fakeBindId",b)
 
@@ -291,6 +793,30 @@ var _ = Describe("Broker", func() {
         })
 
 
+        It("should unbind a service asynchronously", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr,_ := newProvisioningRequest()
+            br,_ := newBindingRequest()
+        
+            persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})    
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+                "mysql://fakehost:1234",  "myFakeInstance", serviceagent.DockerHost,"fakecontainename", "mysql", 
+                pr, time.Now())    
+            persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: br.InstanceId, BindingId: br.BindingId, AppId: br.AppId}, time.Now())
+
+            resp,respCode,err := SendHTTP("DELETE",BaseURL(opts)+"/v2/service_instances/myFakeInstance/service_bindings/fakeBindId?accepts_incomplete=true",nil)
+            Expect(err).To(BeNil())
+            Expect(respCode).Should(Equal(http.StatusAccepted))
+
+            var respmap map[string] interface{}
+            json.Unmarshal(resp, &respmap)
+            Eventually(func() interface{} {
+                return lastOperation(opts, "/v2/service_instances/myFakeInstance/service_bindings/fakeBindId", respmap["operation"].(string))["state"]
+            }, 5).Should(Equal(brokerapi.OperationSucceeded))
+        })
+
         It("should handle ping from service agent", func() {
             sa := testnet.NewServiceAgent()
             var b []byte
@@ -312,6 +838,14 @@ func BaseURL(opts brokerapi.Options) string {
 }
 
 func SendHTTP(method,urlstr string, body []byte) ([]byte, int, error) {
+    return SendHTTPVersion(method,urlstr,"2.14",body)
+}
+
+func SendHTTPVersion(method,urlstr,version string, body []byte) ([]byte, int, error) {
+    return SendHTTPIdentity(method,urlstr,version,"",body)
+}
+
+func SendHTTPIdentity(method,urlstr,version,identity string, body []byte) ([]byte, int, error) {
     u, err := url.Parse(urlstr)
     if err != nil {
         return nil, -1, err
@@ -324,7 +858,10 @@ func SendHTTP(method,urlstr string, body []byte) ([]byte, int, error) {
         return nil, -1, err
     }
     req.Header.Add("Content-Type", "application/json")
-    req.Header.Add("X-Broker-Api-Version","2.2")
+    req.Header.Add("X-Broker-Api-Version",version)
+    if len(identity) > 0 {
+        req.Header.Add("X-Broker-API-Originating-Identity",identity)
+    }
     resp, err := client.Do(req)
     if err != nil {
         return nil, http.StatusInternalServerError, err
@@ -337,6 +874,33 @@ func SendHTTP(method,urlstr string, body []byte) ([]byte, int, error) {
     return data, resp.StatusCode, err
 }
 
+func sendHTTPs(config *tls.Config, urlstr, username, password string) (*http.Response, error) {
+    client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+    req, err := http.NewRequest("GET", urlstr, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Add("X-Broker-Api-Version","2.14")
+    if len(username) > 0 {
+        req.SetBasicAuth(username, password)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+    return resp, nil
+}
+
+func lastOperation(opts brokerapi.Options, path, operation string) map[string] interface{} {
+    resp,respCode,err := SendHTTP("GET",BaseURL(opts)+path+"/last_operation?operation="+operation,nil)
+    Expect(err).To(BeNil())
+    Expect(respCode).Should(Equal(http.StatusOK))
+    var opmap map[string] interface{}
+    json.Unmarshal(resp, &opmap)
+    return opmap
+}
+
 func newHTTPClient(u *url.URL) *http.Client {
     httpTransport := &http.Transport{}
     if u.Scheme == "unix" {
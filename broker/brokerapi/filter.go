@@ -0,0 +1,40 @@
+package brokerapi
+
+import (
+    "strings"
+)
+
+// Condition of a query against the persister, the values are handed to the driver as bind
+// parameters and never become part of the SQL text. The zero value matches every row.
+type Filter struct {
+    conds []string
+    args []interface{}
+}
+
+// Matches the rows whose column equals value.
+func Where(column string, value interface{}) Filter {
+    return Filter{}.And(column,value)
+}
+
+// Matches the rows satisfying the SQL expression, its ? placeholders are bound to args.
+// Only to be used with expressions composed by the broker itself.
+func Expression(expr string, args ...interface{}) Filter {
+    return Filter{conds:[]string{expr},args:args}
+}
+
+func (filter Filter) And(column string, value interface{}) Filter {
+    return Filter{conds:append(append([]string{},filter.conds...),column+"=?"),
+                  args:append(append([]interface{}{},filter.args...),value)}
+}
+
+func (filter Filter) IsEmpty() bool {
+    return len(filter.conds) == 0
+}
+
+// Returns the where clause with ? placeholders (empty for the zero value) and its arguments.
+func (filter Filter) clause() (string,[]interface{}) {
+    if filter.IsEmpty() {
+        return "",nil
+    }
+    return " where "+strings.Join(filter.conds," and "),filter.args
+}
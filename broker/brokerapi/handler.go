@@ -6,6 +6,7 @@ package brokerapi
 
 import (
     "encoding/json"
+    "fmt"
     "github.com/gorilla/mux"
     "log"
     "net/http"
@@ -41,24 +42,70 @@ func (h *handler) provision(req *http.Request) responseEntity {
     log.Printf("Handler: Provisioning: %v", preq)
 
     if err := json.NewDecoder(req.Body).Decode(&preq); err != nil {
-        handleDecodingError(err)
+        return handleDecodingError(err)
     }
 
-    log.Printf("Handler: Provisioning request decoded: %v", preq)
+    preq.AcceptsIncomplete = acceptsIncomplete(req)
+    preq.Context = requestContext(req, preq.Context)
+    identity, err := originatingIdentity(req)
+    if err != nil {
+        return handleDecodingError(err)
+    }
+    preq.OriginatingIdentity = identity
+    //platforms other than Cloud Foundry only name the organization and space in the context
+    if org, ok := preq.Context["organization_guid"].(string); ok && len(preq.OrgId) == 0 {
+        preq.OrgId = org
+    }
+    if space, ok := preq.Context["space_guid"].(string); ok && len(preq.SpaceId) == 0 {
+        preq.SpaceId = space
+    }
+    log.Printf("Handler: Provisioning request decoded: %v plan %v", preq.ServiceId, preq.PlanId)
 
     var url string
-    var err error
 
-    br, err := h.manager.GetServiceAgent("")
+    //a repeated request is answered from what was persisted for the instance
+    request := OperationRequest{ServiceId: preq.ServiceId, PlanId: preq.PlanId, OrgId: preq.OrgId, SpaceId: preq.SpaceId,
+                                Parameters: preq.Parameters}
+    if op, err := h.manager.LastOperation(preq.InstanceId, "", ""); err == nil &&
+       op.Type == OperationProvision && op.State == OperationInProgress {
+        if !op.Request.Matches(request) {
+            log.Printf("Handler: Provisioning of %v is in progress with other attributes", preq.InstanceId)
+            return responseEntity{http.StatusConflict, BrokerError{"Service instance "+preq.InstanceId+" is being provisioned with different attributes"}}
+        }
+        log.Printf("Handler: Provisioning of %v is in progress", preq.InstanceId)
+        return responseEntity{http.StatusAccepted, struct {
+            Operation string `json:"operation"`
+        }{op.Id}}
+    }
+    instance, err := h.manager.ExistingServiceInstance(preq)
+    if err != nil {
+        return handleServiceError(err)
+    }
+    if instance != nil {
+        log.Printf("Handler: Already provisioned: %v", preq.InstanceId)
+        return responseEntity{http.StatusOK, struct {
+            DashboardUrl string `json:"dashboard_url"`
+        }{instance.DashboardUrl}}
+    }
+
+    br, err := h.manager.GetProvisioningAgent(preq)
     if (err != nil) {
         return handleServiceError(err)
     }
+    if preq.AcceptsIncomplete {
+        return h.startOperation(preq.InstanceId, "", OperationProvision, request, func(op Operation) error {
+            //lets the agent report progress, e.g. of pulling the image
+            preq.OperationId = op.Id
+            _, err := br.Provision(preq)
+            return err
+        })
+    }
     url, err = br.Provision(preq)
     if err != nil {
         return handleServiceError(err)
     }
 
-    log.Printf("Handler: Provisioned: %v", url)
+    log.Printf("Handler: Provisioned: %v", preq.InstanceId)
 
     return responseEntity{http.StatusCreated, struct {
         DashboardUrl string `json:"dashboard_url"`
@@ -67,15 +114,26 @@ func (h *handler) provision(req *http.Request) responseEntity {
 
 func (h *handler) deprovision(req *http.Request) responseEntity {
     vars := mux.Vars(req)
-    preq := ProvisioningRequest{InstanceId: vars[instanceId]}
+    preq := ProvisioningRequest{InstanceId: vars[instanceId], AcceptsIncomplete: acceptsIncomplete(req)}
 
     log.Printf("Handler: Deprovisioning: %v", preq)
 
+    identity, err := originatingIdentity(req)
+    if err != nil {
+        return handleDecodingError(err)
+    }
+    preq.OriginatingIdentity = identity
+
     br, err := h.manager.GetServiceAgent(preq.InstanceId)
     if (err != nil) {
         return handleServiceError(err)
     }
 
+    if preq.AcceptsIncomplete {
+        return h.startOperation(preq.InstanceId, "", OperationDeprovision, OperationRequest{}, func(Operation) error {
+            return br.Deprovision(preq)
+        })
+    }
     if err := br.Deprovision(preq); err != nil {
        return handleServiceError(err)
     }
@@ -84,6 +142,52 @@ func (h *handler) deprovision(req *http.Request) responseEntity {
     return responseEntity{http.StatusOK, empty}
 }
 
+func (h *handler) update(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    ureq := UpdateRequest{InstanceId: vars[instanceId]}
+
+    log.Printf("Handler: Updating: %v", ureq)
+
+    if err := json.NewDecoder(req.Body).Decode(&ureq); err != nil {
+        return handleDecodingError(err)
+    }
+    ureq.AcceptsIncomplete = acceptsIncomplete(req)
+    ureq.Context = requestContext(req, ureq.Context)
+    identity, err := originatingIdentity(req)
+    if err != nil {
+        return handleDecodingError(err)
+    }
+    ureq.OriginatingIdentity = identity
+
+    log.Printf("Handler: Update request decoded: %v plan %v", ureq.ServiceId, ureq.PlanId)
+
+    if op, err := h.manager.LastOperation(ureq.InstanceId, "", ""); err == nil &&
+       (op.Type == OperationProvision || op.Type == OperationUpdate) && op.State == OperationInProgress {
+        log.Printf("Handler: %v of %v is in progress", op.Type, ureq.InstanceId)
+        return responseEntity{http.StatusConflict, BrokerError{"Service instance "+ureq.InstanceId+" has an operation in progress"}}
+    }
+
+    br, err := h.manager.GetServiceAgent(ureq.InstanceId)
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+
+    if ureq.AcceptsIncomplete {
+        return h.startOperation(ureq.InstanceId, "", OperationUpdate,
+                                OperationRequest{ServiceId: ureq.ServiceId, PlanId: ureq.PlanId, Parameters: ureq.Parameters}, func(op Operation) error {
+            //lets the agent report progress, e.g. of pulling the image of the new plan
+            ureq.OperationId = op.Id
+            return br.Update(ureq)
+        })
+    }
+    if err := br.Update(ureq); err != nil {
+        return handleServiceError(err)
+    }
+    log.Printf("Handler: Updated: %v", ureq.InstanceId)
+
+    return responseEntity{http.StatusOK, empty}
+}
+
 func (h *handler) bind(req *http.Request) responseEntity {
     vars := mux.Vars(req)
     breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId]}
@@ -91,10 +195,28 @@ func (h *handler) bind(req *http.Request) responseEntity {
     log.Printf("Handler: Binding: %v", breq)
 
     if err := json.NewDecoder(req.Body).Decode(&breq); err != nil {
-        handleDecodingError(err)
+        return handleDecodingError(err)
     }
 
-    log.Printf("Handler: Binding request decoded: %v", breq)
+    breq.Context = requestContext(req, breq.Context)
+    identity, err := originatingIdentity(req)
+    if err != nil {
+        return handleDecodingError(err)
+    }
+    breq.OriginatingIdentity = identity
+    log.Printf("Handler: Binding request decoded: %v for app %v", breq.BindingId, breq.AppId)
+
+    binding, err := h.manager.ExistingServiceBinding(breq)
+    if err != nil {
+        return handleServiceError(err)
+    }
+    if binding != nil {
+        log.Printf("Handler: Already bound: %v", breq.BindingId)
+        return responseEntity{http.StatusOK, struct {
+            Credentials    interface{} `json:"credentials"`
+            SyslogDrainUrl string      `json:"syslog_drain_url,omitempty"`
+        }{binding.Credentials, binding.SyslogDrainUrl}}
+    }
 
     br, err := h.manager.GetServiceAgent(breq.InstanceId)
     if (err != nil) {
@@ -109,24 +231,35 @@ func (h *handler) bind(req *http.Request) responseEntity {
         return handleServiceError(err)
     }
     
-    log.Printf("Handler: Bound: %v", cred)
+    log.Printf("Handler: Bound: %v", breq.BindingId)
     return responseEntity{http.StatusCreated, struct {
         Credentials    interface{} `json:"credentials"`
-        SyslogDrainUrl string      `json:"syslog_drain_url "`
+        SyslogDrainUrl string      `json:"syslog_drain_url,omitempty"`
     }{cred, url}}
 }
 
 func (h *handler) unbind(req *http.Request) responseEntity {
     vars := mux.Vars(req)
-    breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId]}
+    breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId], AcceptsIncomplete: acceptsIncomplete(req)}
 
     log.Printf("Handler: Unbinding: %v", breq)
 
+    identity, err := originatingIdentity(req)
+    if err != nil {
+        return handleDecodingError(err)
+    }
+    breq.OriginatingIdentity = identity
+
     br, err := h.manager.GetServiceAgent(breq.InstanceId)
     if (err != nil) {
         return handleServiceError(err)
     }
 
+    if breq.AcceptsIncomplete {
+        return h.startOperation(breq.InstanceId, breq.BindingId, OperationUnbind, OperationRequest{}, func(Operation) error {
+            return br.Unbind(breq)
+        })
+    }
     if err := br.Unbind(breq); err != nil {
         return handleServiceError(err)
     }
@@ -136,13 +269,94 @@ func (h *handler) unbind(req *http.Request) responseEntity {
     return responseEntity{http.StatusOK, empty}
 }
 
+func (h *handler) getinstance(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    log.Printf("Handler: Get Instance: %v", vars[instanceId])
+
+    if !supportsVersion(req, fetchInstanceApiVersion) {
+        return handleUnsupportedVersion("Fetching a service instance", fetchInstanceApiVersion)
+    }
+    instance, err := h.manager.GetServiceInstance(vars[instanceId])
+    if err != nil {
+        return handleServiceError(err)
+    }
+    return responseEntity{http.StatusOK, instance}
+}
+
+func (h *handler) getbinding(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    log.Printf("Handler: Get Binding: %v %v", vars[instanceId], vars[bindingId])
+
+    if !supportsVersion(req, fetchInstanceApiVersion) {
+        return handleUnsupportedVersion("Fetching a service binding", fetchInstanceApiVersion)
+    }
+    binding, err := h.manager.GetServiceBinding(vars[instanceId], vars[bindingId])
+    if err != nil {
+        return handleServiceError(err)
+    }
+    if binding.Credentials == nil {
+        binding.Credentials = Credentials{}
+    }
+    return responseEntity{http.StatusOK, binding}
+}
+
+func (h *handler) lastOperation(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    iid := vars[instanceId]
+    bid := vars[bindingId]
+    opid := req.URL.Query().Get("operation")
+
+    log.Printf("Handler: Last operation: %v %v %v", iid, bid, opid)
+
+    op, err := h.manager.LastOperation(iid, bid, opid)
+    if err != nil {
+        return handleServiceError(err)
+    }
+
+    return responseEntity{http.StatusOK, struct {
+        State       string `json:"state"`
+        Description string `json:"description,omitempty"`
+    }{op.State, op.Description}}
+}
+
+// Records a new operation and runs fn in the background, the outcome is
+// persisted so that the Cloud Controller can poll any broker for it.
+func (h *handler) startOperation(iid, bid, optype string, request OperationRequest, fn func(Operation) error) responseEntity {
+    op, err := h.manager.StartOperation(iid, bid, optype, request)
+    if err != nil {
+        return handleServiceError(err)
+    }
+    log.Printf("Handler: Started %v operation %v for %v", optype, op.Id, iid)
+
+    go func() {
+        if err := h.manager.FinishOperation(op, runOperation(op, fn)); err != nil {
+            log.Printf("Handler: Failed to record outcome of operation %v: %v", op.Id, err)
+        }
+    }()
+
+    return responseEntity{http.StatusAccepted, struct {
+        Operation string `json:"operation"`
+    }{op.Id}}
+}
+
+// Runs fn outside of any request, so a panic fails the operation instead of the broker.
+func runOperation(op Operation, fn func(Operation) error) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            log.Printf("Handler: Operation %v panicked: %v", op.Id, r)
+            err = fmt.Errorf("%v", r)
+        }
+    }()
+    return fn(op)
+}
+
 func (h *handler)  ping(req *http.Request) responseEntity {
     var sa ServiceAgent
     var err error
 
     log.Printf("Handler: Ping: %v", req.Body)
     if err = json.NewDecoder(req.Body).Decode(&sa); err != nil {
-        handleDecodingError(err)
+        return handleDecodingError(err)
     }
 
     err = h.manager.Ping(sa)
@@ -167,14 +381,14 @@ func (h *handler)  addimage(req *http.Request) responseEntity {
     log.Printf("Handler: Add Image: ")
 
     if err = json.NewDecoder(req.Body).Decode(&img); err != nil {
-        handleDecodingError(err)
+        return handleDecodingError(err)
     }
     log.Println(imagename,img.Name)
     err = h.manager.AddImage(catalog,img)
     if (err != nil) {
         return handleServiceError(err)
     }
-    log.Printf("Handler: Add Image: %v", img)
+    log.Printf("Handler: Add Image: %v plan %v", img.Name, img.Plan)
 
     return responseEntity{http.StatusOK, empty}
 }
@@ -188,7 +402,14 @@ func (h *handler)  addcerts(req *http.Request) responseEntity {
     log.Printf("Handler: Add Certs: ",certname)
 
     if err = json.NewDecoder(req.Body).Decode(&certs); err != nil {
-        handleDecodingError(err)
+        return handleDecodingError(err)
+    }
+    //the host of the url is the one the caller is authorized for
+    if len(certs.Host) == 0 {
+        certs.Host = certname
+    }
+    if certs.Host != certname {
+        return responseEntity{http.StatusBadRequest, BrokerError{"Certificates for "+certs.Host+" cannot be added as "+certname}}
     }
     err = h.manager.AddCerts(certs)
     if (err != nil) {
@@ -203,13 +424,14 @@ func (h *handler)  getimage(req *http.Request) responseEntity {
     vars := mux.Vars(req)
     catalog := vars[catalog]
     imagename := vars[imagename]
-    log.Printf("Handler: Get Image: ",catalog,imagename)
+    plan := req.URL.Query().Get("plan")
+    log.Printf("Handler: Get Image: ",catalog,imagename,plan)
 
-    img, err := h.manager.GetImage(catalog,imagename)
+    img, err := h.manager.GetImage(catalog,imagename,plan)
     if (err != nil) {
         return handleServiceError(err)
     }
-    log.Printf("Handler: Get Image: %v", img)
+    log.Printf("Handler: Get Image: %v definitions", len(img))
 
     return responseEntity{http.StatusOK, img}
 }
@@ -235,9 +457,10 @@ func (h *handler)  delimage(req *http.Request) responseEntity {
     vars := mux.Vars(req)
     catalog := vars[catalog]
     imagename := vars[imagename]
-    log.Printf("Handler: Delete Image: ",catalog,imagename)
+    plan := req.URL.Query().Get("plan")
+    log.Printf("Handler: Delete Image: ",catalog,imagename,plan)
 
-    err := h.manager.DeleteImage(catalog,imagename)
+    err := h.manager.DeleteImage(catalog,imagename,plan)
     if (err != nil) {
         return handleServiceError(err)
     }
@@ -261,6 +484,112 @@ func (h *handler)  delcerts(req *http.Request) responseEntity {
     return responseEntity{http.StatusOK, nil}
 }
 
+func (h *handler)  addregistry(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    var auth RegistryAuth
+
+    log.Printf("Handler: Add Registry: %v", vars[registry])
+
+    if err := json.NewDecoder(req.Body).Decode(&auth); err != nil {
+        return handleDecodingError(err)
+    }
+    auth.Registry = vars[registry]
+    err := h.manager.AddRegistryAuth(auth)
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+    log.Printf("Handler: Added Registry: %v", auth.Registry)
+
+    return responseEntity{http.StatusOK, empty}
+}
+
+func (h *handler)  getregistries(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    log.Printf("Handler: Get Registries: %v", vars[registry])
+
+    auths, err := h.manager.GetRegistryAuths(vars[registry])
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+    return responseEntity{http.StatusOK, auths}
+}
+
+func (h *handler)  delregistry(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    log.Printf("Handler: Delete Registry: %v", vars[registry])
+
+    err := h.manager.DeleteRegistryAuth(vars[registry])
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+    return responseEntity{http.StatusOK, nil}
+}
+
+func (h *handler)  adduser(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    var user BrokerUser
+
+    log.Printf("Handler: Add User: %v", vars[brokeruser])
+
+    if err := json.NewDecoder(req.Body).Decode(&user); err != nil {
+        return handleDecodingError(err)
+    }
+    user.Name = vars[brokeruser]
+    err := h.manager.AddUser(user)
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+    log.Printf("Handler: Added User: %v as %v", user.Name, user.Role)
+
+    return responseEntity{http.StatusOK, empty}
+}
+
+func (h *handler)  getusers(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    log.Printf("Handler: Get Users: %v", vars[brokeruser])
+
+    users, err := h.manager.GetUsers(vars[brokeruser])
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+    return responseEntity{http.StatusOK, users}
+}
+
+func (h *handler)  deluser(req *http.Request) responseEntity {
+    vars := mux.Vars(req)
+    log.Printf("Handler: Delete User: %v", vars[brokeruser])
+
+    err := h.manager.DeleteUser(vars[brokeruser])
+    if (err != nil) {
+        return handleServiceError(err)
+    }
+    return responseEntity{http.StatusOK, nil}
+}
+
+// Clients older than asynchronous operations get synchronous ones whatever they ask for.
+func acceptsIncomplete(req *http.Request) bool {
+    return req.URL.Query().Get("accepts_incomplete") == "true" && supportsVersion(req, asyncApiVersion)
+}
+
+// Clients older than the context object are not expected to send one, it is ignored if they do.
+func requestContext(req *http.Request, context map[string]interface{}) map[string]interface{} {
+    if !supportsVersion(req, contextApiVersion) {
+        return nil
+    }
+    return context
+}
+
+func originatingIdentity(req *http.Request) (*OriginatingIdentity, error) {
+    if !supportsVersion(req, identityApiVersion) {
+        return nil, nil
+    }
+    return extractOriginatingIdentity(req)
+}
+
+func handleUnsupportedVersion(feature string, version brokerApiVersion) responseEntity {
+    return responseEntity{http.StatusPreconditionFailed, BrokerError{fmt.Sprintf("%v requires broker API version %v", feature, version)}}
+}
+
 func handleDecodingError(err error) responseEntity {
     log.Printf("Handler: Decoding error: %v", err)
     return responseEntity{http.StatusBadRequest, BrokerError{err.Error()}}
@@ -276,6 +605,8 @@ func handleServiceError(err error) responseEntity {
             return responseEntity{http.StatusConflict, BrokerError{err.Error()}}
         case ErrCodeGone:
             return responseEntity{http.StatusGone, BrokerError{err.Error()}}
+        case ErrCodeBadRequest:
+            return responseEntity{http.StatusBadRequest, BrokerError{err.Error()}}
         }
     }
     return responseEntity{http.StatusInternalServerError, BrokerError{err.Error()}}
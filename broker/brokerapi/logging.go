@@ -0,0 +1,96 @@
+package brokerapi
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httputil"
+    "strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Headers carrying credentials.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "X-Registry-Auth"}
+
+// JSON fields holding credentials or certificates, e.g. of image definitions, certificates,
+// registry credentials and users. Fields containing one of redactedFieldParts are redacted too.
+var redactedFields = map[string]bool{"credentials": true, "dashboardurl": true, "clientcert": true,
+                                     "clientkey": true, "ca": true}
+var redactedFieldParts = []string{"password", "secret", "token"}
+
+// Dumps req like httputil.DumpRequest but with credentials, passwords and certificates
+// redacted. The body of req can still be read afterwards.
+func dumpRequest(req *http.Request) (string, error) {
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+        return "", err
+    }
+    req.Body.Close()
+    req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+    clone := *req
+    clone.Header = http.Header{}
+    for key, values := range req.Header {
+        clone.Header[key] = values
+    }
+    for _, key := range redactedHeaders {
+        if _, ok := clone.Header[key]; ok {
+            clone.Header.Set(key, redacted)
+        }
+    }
+    dump, err := httputil.DumpRequest(&clone, false)
+    if err != nil {
+        return "", err
+    }
+    return string(dump) + redactBody(body), nil
+}
+
+// Only JSON bodies are logged, other bodies are left out.
+func redactBody(body []byte) string {
+    if len(body) == 0 {
+        return ""
+    }
+    var value interface{}
+    if err := json.Unmarshal(body, &value); err != nil {
+        return fmt.Sprintf("[%d bytes]", len(body))
+    }
+    data, err := json.Marshal(redactValue(value))
+    if err != nil {
+        return fmt.Sprintf("[%d bytes]", len(body))
+    }
+    return string(data)
+}
+
+func redactValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case map[string]interface{}:
+        for key, field := range v {
+            if redactedField(key) {
+                v[key] = redacted
+            } else {
+                v[key] = redactValue(field)
+            }
+        }
+    case []interface{}:
+        for i, element := range v {
+            v[i] = redactValue(element)
+        }
+    }
+    return value
+}
+
+func redactedField(name string) bool {
+    name = strings.ToLower(name)
+    if redactedFields[name] {
+        return true
+    }
+    for _, part := range redactedFieldParts {
+        if strings.Contains(name, part) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,677 @@
+package brokerapi
+
+import (
+    "database/sql"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Store keeping everything in memory, for tests and brokers developed on a single node. All
+// records are lost when the broker stops.
+type MemoryStore struct {
+    EncryptionKey string
+    mutex       sync.Mutex
+    agents      map[string]ServiceAgent
+    instances   map[string]storedInstance
+    //keyed by instance and binding id, like the volumes by instance id and path
+    bindings    map[[2]string]storedBinding
+    volumes     map[[2]string]ServiceVolume
+    operations  map[string]Operation
+    auditevents []AuditEvent
+    services    map[string]storedService
+    lastService int
+    images      map[string]storedImage
+    certs       map[string]BrokerCerts
+    registries  map[string]RegistryAuth
+    users       map[string]BrokerUser
+}
+
+func NewMemoryStore(encryptionKey string) *MemoryStore {
+    store := &MemoryStore{EncryptionKey: encryptionKey}
+    store.reset()
+    return store
+}
+
+func (store *MemoryStore) reset() {
+    store.agents = make(map[string]ServiceAgent)
+    store.instances = make(map[string]storedInstance)
+    store.bindings = make(map[[2]string]storedBinding)
+    store.volumes = make(map[[2]string]ServiceVolume)
+    store.operations = make(map[string]Operation)
+    store.auditevents = nil
+    store.services = make(map[string]storedService)
+    store.lastService = 0
+    store.images = make(map[string]storedImage)
+    store.certs = make(map[string]BrokerCerts)
+    store.registries = make(map[string]RegistryAuth)
+    store.users = make(map[string]BrokerUser)
+}
+
+func (store *MemoryStore) Close() error {
+    return nil
+}
+
+// Forgets all records, for tests that share one store between their specs.
+func (store *MemoryStore) Clear() {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.reset()
+}
+
+//service agent calls
+
+func (store *MemoryStore) AddServiceAgents(serviceagents []ServiceAgent) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    for _,sa := range serviceagents {
+        sa.LastPing = time.Now()
+        store.agents[sa.DockerHost] = sa
+    }
+    return nil
+}
+
+func (store *MemoryStore) markServiceAgent(dockerhost string, active bool) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    sa, ok := store.agents[dockerhost]
+    if !ok {
+        return sql.ErrNoRows
+    }
+    sa.IsActive = active
+    store.agents[dockerhost] = sa
+    return nil
+}
+
+func (store *MemoryStore) MarkServiceAgentInactive(dockerhost string) error {
+    return store.markServiceAgent(dockerhost,false)
+}
+
+func (store *MemoryStore) MarkServiceAgentActive(dockerhost string) error {
+    return store.markServiceAgent(dockerhost,true)
+}
+
+// Updates everything but the port bindings of a known agent.
+func (store *MemoryStore) AddorUpdateServiceAgent(sa ServiceAgent) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    if stored, ok := store.agents[sa.DockerHost]; ok {
+        sa.Portbindings = stored.Portbindings
+    } else {
+        sa.Portbindings = nil
+    }
+    sa.LastPing = time.Now()
+    store.agents[sa.DockerHost] = sa
+    return nil
+}
+
+func (store *MemoryStore) GetServiceAgent(dockerhost string) (ServiceAgent,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    sa, ok := store.agents[dockerhost]
+    if !ok {
+        return sa,sql.ErrNoRows
+    }
+    return sa,nil
+}
+
+func (store *MemoryStore) GetLiveServiceAgents() ([]ServiceAgent,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    var serviceagents []ServiceAgent
+    for _,sa := range store.agents {
+        if time.Since(sa.LastPing) < 3*time.Duration(sa.KeepAlive)*time.Second {
+            serviceagents = append(serviceagents,sa)
+        }
+    }
+    return serviceagents,nil
+}
+
+func (store *MemoryStore) GetPortBindings(dockerhost string) (int,int,[]int,error) {
+    sa, err := store.GetServiceAgent(dockerhost)
+    if err != nil {
+        return 0,0,nil,err
+    }
+    var pb []int
+    if len(sa.Portbindings) > 0 {
+        pb = UnmarshalIntArray(sa.Portbindings)
+    }
+    return sa.Portbind_min,sa.Portbind_max,pb,nil
+}
+
+func (store *MemoryStore) WritePortBinding(ports []int, dockerhost string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    sa, ok := store.agents[dockerhost]
+    if !ok {
+        return sql.ErrNoRows
+    }
+    sa.Portbindings = MarshalIntArray(ports)
+    store.agents[dockerhost] = sa
+    return nil
+}
+
+//service instance calls
+
+func (store *MemoryStore) AddServiceInstance(service_name string, service_port, host_port int,
+            service_url, container_id, service_agent, container_name, image_name string,
+            pr ProvisioningRequest, started_at time.Time) error {
+    instance, err := newStoredInstance(service_name,service_port,host_port,
+                                       service_url,container_id,service_agent,container_name,image_name,
+                                       pr,started_at,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    if _, ok := store.instances[pr.InstanceId]; ok {
+        return ErrRecordExists
+    }
+    store.instances[pr.InstanceId] = instance
+    return nil
+}
+
+func (store *MemoryStore) getInstance(instanceid string) (storedInstance,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    instance, ok := store.instances[instanceid]
+    if !ok {
+        return instance,sql.ErrNoRows
+    }
+    return instance,nil
+}
+
+func (store *MemoryStore) GetServiceInstance(instanceid string) (ServiceInstance,error) {
+    stored, err := store.getInstance(instanceid)
+    if err != nil {
+        return ServiceInstance{InstanceId: instanceid},err
+    }
+    return stored.serviceInstance(store.EncryptionKey)
+}
+
+func (store *MemoryStore) GetServiceAgentFromInstance(instanceid string) (string,error) {
+    instance, err := store.getInstance(instanceid)
+    return instance.ServiceAgent,err
+}
+
+func (store *MemoryStore) GetContainerIdAndImageName(instanceid string) (string,string) {
+    instance, _ := store.getInstance(instanceid)
+    return instance.ContainerId,instance.ImageName
+}
+
+func (store *MemoryStore) GetServicePort(instanceid string) int {
+    instance, err := store.getInstance(instanceid)
+    if err != nil {
+        return -1
+    }
+    return instance.ServicePort
+}
+
+func (store *MemoryStore) GetHostPort(instanceid string) int {
+    instance, err := store.getInstance(instanceid)
+    if err != nil {
+        return -1
+    }
+    return instance.HostPort
+}
+
+func (store *MemoryStore) GetServiceInstancePlan(instanceid string) string {
+    instance, _ := store.getInstance(instanceid)
+    return instance.PlanId
+}
+
+func (store *MemoryStore) GetServiceUrl(instanceid string) string {
+    instance, err := store.getInstance(instanceid)
+    if err != nil {
+        return ""
+    }
+    return instance.serviceUrl(store.EncryptionKey)
+}
+
+func (store *MemoryStore) UpdateServiceInstance(instanceid, planid, containerid string, parameters map[string]interface{}) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    instance, ok := store.instances[instanceid]
+    if !ok {
+        return sql.ErrNoRows
+    }
+    instance.PlanId = planid
+    instance.ContainerId = containerid
+    instance.Parameters = parameters
+    store.instances[instanceid] = instance
+    return nil
+}
+
+func (store *MemoryStore) DeleteServiceInstance(instanceid string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    delete(store.instances,instanceid)
+    return nil
+}
+
+//service volume calls
+
+func (store *MemoryStore) AddServiceVolume(volume ServiceVolume) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.volumes[[2]string{volume.InstanceId,volume.Path}] = volume
+    return nil
+}
+
+func (store *MemoryStore) GetServiceVolumes(instanceid string) ([]ServiceVolume,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    volumes := []ServiceVolume{}
+    for _,volume := range store.volumes {
+        if volume.InstanceId == instanceid {
+            volumes = append(volumes,volume)
+        }
+    }
+    return volumes,nil
+}
+
+func (store *MemoryStore) DeleteServiceVolume(instanceid, path string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    delete(store.volumes,[2]string{instanceid,path})
+    return nil
+}
+
+//service bindings calls
+
+// Secrets are sealed like in the other stores even though they never leave the process, so a
+// wrong encryption key shows up in development already.
+func (store *MemoryStore) AddServiceBinding(binding ServiceBinding, started_at time.Time) error {
+    stored, err := newStoredBinding(binding,started_at,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    key := [2]string{binding.InstanceId,binding.BindingId}
+    if _, ok := store.bindings[key]; ok {
+        return ErrRecordExists
+    }
+    store.bindings[key] = stored
+    return nil
+}
+
+func (store *MemoryStore) GetServiceBinding(instanceid, bindingid string) (ServiceBinding,error) {
+    store.mutex.Lock()
+    stored, ok := store.bindings[[2]string{instanceid,bindingid}]
+    store.mutex.Unlock()
+    if !ok {
+        return ServiceBinding{InstanceId: instanceid, BindingId: bindingid},sql.ErrNoRows
+    }
+    return stored.serviceBinding(store.EncryptionKey)
+}
+
+func (store *MemoryStore) DeleteServiceBinding(instanceid, bindingid string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    key := [2]string{instanceid,bindingid}
+    if _, ok := store.bindings[key]; !ok {
+        return sql.ErrNoRows
+    }
+    delete(store.bindings,key)
+    return nil
+}
+
+//service operation calls
+
+func (store *MemoryStore) AddOperation(op Operation) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.operations[op.Id] = op
+    return nil
+}
+
+func (store *MemoryStore) UpdateOperation(op Operation) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    stored, ok := store.operations[op.Id]
+    if !ok {
+        return sql.ErrNoRows
+    }
+    stored.State = op.State
+    stored.Description = op.Description
+    stored.UpdatedAt = op.UpdatedAt
+    store.operations[op.Id] = stored
+    return nil
+}
+
+// Returns the given operation of the instance (or of one of its bindings when bindingId is set),
+// or the most recent one when operationId is empty.
+func (store *MemoryStore) GetOperation(instanceid, bindingid, operationid string) (Operation,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    var found *Operation
+    for _,op := range store.operations {
+        if op.InstanceId != instanceid || op.BindingId != bindingid || (len(operationid) > 0 && op.Id != operationid) {
+            continue
+        }
+        if found == nil || op.StartedAt.After(found.StartedAt) {
+            current := op
+            found = &current
+        }
+    }
+    if found == nil {
+        return Operation{},sql.ErrNoRows
+    }
+    return *found,nil
+}
+
+//audit trail calls
+
+func (store *MemoryStore) AddAuditEvent(event AuditEvent) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.auditevents = append(store.auditevents,event)
+    return nil
+}
+
+// The events of an instance and its bindings, oldest first.
+func (store *MemoryStore) GetAuditEvents(instanceid string) ([]AuditEvent,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    events := []AuditEvent{}
+    for _,event := range store.auditevents {
+        if event.InstanceId == instanceid {
+            events = append(events,event)
+        }
+    }
+    sort.SliceStable(events,func(i, j int) bool {
+        return events[i].Time.Before(events[j].Time)
+    })
+    return events,nil
+}
+
+//service configurations calls
+
+func (store *MemoryStore) AddServiceConf(user, password, catalog string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.lastService++
+    store.services[catalog] = storedService{Id: store.lastService, User: user, Password: password, Catalog: catalog}
+    return nil
+}
+
+func (store *MemoryStore) HasServiceConf(catalog string) bool {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    _, ok := store.services[catalog]
+    return ok
+}
+
+func (store *MemoryStore) GetServiceId(catalog string) int {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    service, ok := store.services[catalog]
+    if !ok {
+        return -1
+    }
+    return service.Id
+}
+
+// The services having at least one image, like the join of the SQL persister.
+// Services and their plans come in the order of their keys, like from the bolt store.
+func (store *MemoryStore) GetServiceConf() ([]ServiceDefinition,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    services := make([]storedService,0,len(store.services))
+    for _,service := range store.services {
+        services = append(services,service)
+    }
+    sort.Slice(services,func(i, k int) bool { return services[i].Id < services[k].Id })
+    keys := make([]string,0,len(store.images))
+    for key := range store.images {
+        keys = append(keys,key)
+    }
+    sort.Strings(keys)
+    svcdefs := []ServiceDefinition{}
+    for _,service := range services {
+        svcdef := ServiceDefinition{User: service.User, Password: service.Password, Catalog: service.Catalog}
+        for _,key := range keys {
+            image := store.images[key]
+            if image.ServiceId == service.Id {
+                imgdef, err := image.imageDefinition(store.EncryptionKey)
+                if err != nil {
+                    return nil,err
+                }
+                svcdef.Images = append(svcdef.Images,imgdef)
+            }
+        }
+        if len(svcdef.Images) > 0 {
+            svcdefs = append(svcdefs,svcdef)
+        }
+    }
+    return svcdefs,nil
+}
+
+func (store *MemoryStore) DeleteServiceConf(id int) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    for catalog,service := range store.services {
+        if service.Id == id {
+            delete(store.services,catalog)
+            return nil
+        }
+    }
+    return sql.ErrNoRows
+}
+
+//image configurations calls
+
+func (store *MemoryStore) AddImageConf(service_id int, name, plan, dashboardurl, credentials string, numinstances int, containername string) error {
+    return store.AddImagePlanConf(service_id,ImageDefinition{Name: name, Plan: plan, Numinstances: numinstances, Containername: containername},
+                                  dashboardurl,credentials)
+}
+
+// Adds an image plan along with the container settings of the plan, or replaces the plan when it
+// exists. The maps of the definition are expected to be marshalled by the caller.
+func (store *MemoryStore) AddImagePlanConf(service_id int, imgdef ImageDefinition, dashboardurl, credentials string) error {
+    image, err := newStoredImage(service_id,imgdef,dashboardurl,credentials,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.images[string(boltImageKey(service_id,imgdef.Name,imgdef.Plan))] = image
+    return nil
+}
+
+func (store *MemoryStore) CountImageConf() (int,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    return len(store.images),nil
+}
+
+func (store *MemoryStore) DeleteImageConf(service_id int, name, plan string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    key := string(boltImageKey(service_id,name,plan))
+    if _, ok := store.images[key]; !ok {
+        return sql.ErrNoRows
+    }
+    delete(store.images,key)
+    return nil
+}
+
+//broker certs calls
+
+func (store *MemoryStore) AddBrokerCertsConf(agent string, clientcertfile, clientkeyfile, cafile []byte, servername string) error {
+    certs, err := sealBrokerCerts(BrokerCerts{Host: agent,
+                                              ClientCert: clientcertfile,
+                                              ClientKey: clientkeyfile,
+                                              CA: cafile,
+                                              ServerName: servername},store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.certs[agent] = certs
+    return nil
+}
+
+func (store *MemoryStore) HasBrokerCerts(agent string) bool {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    _, ok := store.certs[agent]
+    return ok
+}
+
+func (store *MemoryStore) GetBrokerCerts() ([]BrokerCerts,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    var certs []BrokerCerts
+    for _,brokercerts := range store.certs {
+        brokercerts, err := openBrokerCerts(brokercerts,store.EncryptionKey)
+        if err != nil {
+            return nil,err
+        }
+        certs = append(certs,brokercerts)
+    }
+    return certs,nil
+}
+
+func (store *MemoryStore) DeleteBrokerCertsConf(agent string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    if _, ok := store.certs[agent]; !ok {
+        return sql.ErrNoRows
+    }
+    delete(store.certs,agent)
+    return nil
+}
+
+//registry credentials calls
+
+func (store *MemoryStore) AddRegistryAuthConf(auth RegistryAuth) error {
+    auth, err := sealRegistryAuth(auth,store.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.registries[auth.Registry] = auth
+    return nil
+}
+
+func (store *MemoryStore) HasRegistryAuth(registry string) bool {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    _, ok := store.registries[registry]
+    return ok
+}
+
+func (store *MemoryStore) GetRegistryAuths() ([]RegistryAuth,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    auths := []RegistryAuth{}
+    for _,auth := range store.registries {
+        auth, err := openRegistryAuth(auth,store.EncryptionKey)
+        if err != nil {
+            return nil,err
+        }
+        auths = append(auths,auth)
+    }
+    return auths,nil
+}
+
+func (store *MemoryStore) DeleteRegistryAuthConf(registry string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    if _, ok := store.registries[registry]; !ok {
+        return sql.ErrNoRows
+    }
+    delete(store.registries,registry)
+    return nil
+}
+
+//broker users calls
+
+func (store *MemoryStore) AddUserConf(user BrokerUser) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.users[user.Name] = user
+    return nil
+}
+
+func (store *MemoryStore) HasUser(name string) bool {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    _, ok := store.users[name]
+    return ok
+}
+
+func (store *MemoryStore) GetUsers() ([]BrokerUser,error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    users := []BrokerUser{}
+    for _,user := range store.users {
+        users = append(users,user)
+    }
+    return users,nil
+}
+
+func (store *MemoryStore) DeleteUserConf(name string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    if _, ok := store.users[name]; !ok {
+        return sql.ErrNoRows
+    }
+    delete(store.users,name)
+    return nil
+}
+
+//encryption key calls
+
+// Seals the secrets of every record with newKey, the store uses newKey from then on. Nothing is
+// changed when a secret can not be opened with the current key.
+func (store *MemoryStore) RotateEncryptionKey(newKey string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    oldKey := store.EncryptionKey
+    instances := make(map[string]storedInstance)
+    for id,instance := range store.instances {
+        if err := instance.reencrypt(oldKey,newKey); err != nil {
+            return err
+        }
+        instances[id] = instance
+    }
+    bindings := make(map[[2]string]storedBinding)
+    for key,binding := range store.bindings {
+        if err := binding.reencrypt(oldKey,newKey); err != nil {
+            return err
+        }
+        bindings[key] = binding
+    }
+    images := make(map[string]storedImage)
+    for key,image := range store.images {
+        if err := image.reencrypt(oldKey,newKey); err != nil {
+            return err
+        }
+        images[key] = image
+    }
+    certs := make(map[string]BrokerCerts)
+    for agent,brokercerts := range store.certs {
+        var err error
+        if brokercerts.ClientKey, err = reencryptBytes(oldKey,newKey,brokercerts.ClientKey); err != nil {
+            return err
+        }
+        certs[agent] = brokercerts
+    }
+    registries := make(map[string]RegistryAuth)
+    for registry,auth := range store.registries {
+        var err error
+        if auth.Password, err = reencrypt(oldKey,newKey,auth.Password); err != nil {
+            return err
+        }
+        registries[registry] = auth
+    }
+    store.instances, store.bindings, store.images, store.certs = instances, bindings, images, certs
+    store.registries = registries
+    store.EncryptionKey = newKey
+    return nil
+}
@@ -0,0 +1,343 @@
+package brokerapi
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "strconv"
+    "time"
+)
+
+// A step of the schema, applied in order of version and recorded in schemaversions. Released
+// migrations must never change, new columns and tables always go into a new migration.
+type migration struct {
+    version int
+    description string
+    statements func(persister *Persister) []string
+}
+
+var migrations = []migration {
+    {1, "initial schema", initialSchema},
+    {2, "asynchronous operations", operationsSchema},
+    {3, "container settings of plans", planSettingsSchema},
+    {4, "volumes of instances", volumesSchema},
+    {5, "private registry credentials", registriesSchema},
+    {6, "server names of docker hosts", serverNamesSchema},
+    {7, "users of the broker API", usersSchema},
+    {8, "parameters of instances and bindings", parametersSchema},
+    {9, "audit trail", auditSchema},
+    {10, "syslog drains", syslogDrainSchema},
+    {11, "room for encrypted secrets", encryptedSecretsSchema},
+    {12, "requests of operations", operationRequestsSchema},
+    {13, "room for descriptions of operations", operationDescriptionsSchema},
+}
+
+// Version of the schema this broker works with.
+func LatestSchemaVersion() int {
+    return migrations[len(migrations)-1].version
+}
+
+// Version of the schema found in the DB, 0 when it has none.
+func (persister *Persister) SchemaVersion() (int,error) {
+    var version sql.NullInt64
+    err := persister.Db.QueryRow("select max(version) from schemaversions").Scan(&version)
+    return int(version.Int64),err
+}
+
+// Brings the schema of the DB up to LatestSchemaVersion. A DB with a newer schema is refused,
+// it belongs to a newer broker.
+func (persister *Persister) Migrate() error {
+    _,err := persister.Db.Exec(`CREATE TABLE IF NOT EXISTS schemaversions (
+        version            INT NOT NULL,
+        description        VARCHAR(255),
+        applied_at         TIMESTAMP,
+        primary key        (version))`)
+    if err != nil {
+        return err
+    }
+    version,err := persister.SchemaVersion()
+    if err != nil {
+        return err
+    }
+    if version == 0 && persister.hasTable("serviceagents") {
+        //created by the setup scripts of brokers without migrations, which is the initial schema
+        log.Println("Adopting existing schema as version 1")
+        if err = persister.recordMigration(migrations[0]); err != nil {
+            return err
+        }
+        version = 1
+    }
+    if version > LatestSchemaVersion() {
+        return errors.New("Schema version "+strconv.Itoa(version)+" of the database is newer than version "+
+                          strconv.Itoa(LatestSchemaVersion())+" supported by this broker")
+    }
+    for _,m := range migrations {
+        if m.version <= version {
+            continue
+        }
+        log.Println("Migrating schema to version",m.version,"-",m.description)
+        if err = persister.applyMigration(m); err != nil {
+            return errors.New("Migration to schema version "+strconv.Itoa(m.version)+" failed: "+err.Error())
+        }
+    }
+    return nil
+}
+
+func (persister *Persister) applyMigration(m migration) error {
+    tx,err := persister.Db.Begin()
+    if err != nil {
+        return err
+    }
+    //MySQL commits DDL implicitly, there a failed migration has to be repaired by hand
+    for _,statement := range m.statements(persister) {
+        if _,err = tx.Exec(statement); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    _,err = tx.Exec("insert into schemaversions (version,description,applied_at) values "+persister.parameterize("(?,?,?)"),
+                    m.version,m.description,time.Now())
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func (persister *Persister) recordMigration(m migration) error {
+    return persister.InsertTable("schemaversions",map[string] interface{} {"version":m.version,
+                                                                          "description":m.description,
+                                                                          "applied_at":time.Now()})
+}
+
+func (persister *Persister) hasTable(tablename string) bool {
+    rows,err := persister.Db.Query("select count(*) from "+tablename)
+    if err != nil {
+        return false
+    }
+    rows.Close()
+    return true
+}
+
+// A statement adding each of the columns, not every DB can add several at once.
+func addColumns(table string, columns ...string) []string {
+    statements := make([]string,0,len(columns))
+    for _,column := range columns {
+        statements = append(statements,"ALTER TABLE "+table+" ADD COLUMN "+column)
+    }
+    return statements
+}
+
+// Statements changing the columns to TEXT. SQLite does not enforce the length of a VARCHAR, it
+// can not change the type of a column either and needs none.
+func (persister *Persister) widenColumns(table string, columns ...string) []string {
+    var statements []string
+    for _,column := range columns {
+        switch persister.getDBType() {
+        case MYSQL :
+            statements = append(statements,"ALTER TABLE "+table+" MODIFY "+column+" TEXT")
+        case POSTGRES :
+            statements = append(statements,"ALTER TABLE "+table+" ALTER COLUMN "+column+" TYPE TEXT")
+        }
+    }
+    return statements
+}
+
+// Picks the flavour of a column type or clause for the driver of the persister.
+func (persister *Persister) dialect(mysql, sqlite, postgres string) string {
+    switch persister.getDBType() {
+    case SQLITE :
+        return sqlite
+    case POSTGRES :
+        return postgres
+    }
+    return mysql
+}
+
+// The schema of the setup scripts of brokers without migrations.
+func initialSchema(persister *Persister) []string {
+    blob := persister.dialect("BLOB","BLOB","BYTEA")
+    statements := []string {
+`CREATE TABLE serviceagents (
+        docker_host        VARCHAR(32) NOT NULL,
+        docker_port        INT,
+        service_host       VARCHAR(32) NOT NULL,
+        last_ping          TIMESTAMP,
+        ping_interval_secs INT,
+        is_active          BOOLEAN DEFAULT false,
+        perf_factor        DECIMAL(5,2),
+        exec_command       VARCHAR(32),
+        exec_args          VARCHAR(64),
+        portbinding_min    INT default 49000,
+        portbinding_max    INT default 49900,
+        portbindings       `+blob+`,
+        primary key        (docker_host))`,
+
+`CREATE TABLE serviceinstances (
+        service_name       VARCHAR(32) NOT NULL,
+        service_port       INT,
+        mapped_host_port   INT,
+        service_url        VARCHAR(64),
+        container_id       VARCHAR(128),
+        container_name     VARCHAR(128),
+        image_name         VARCHAR(128),
+        cf_instance_id     VARCHAR(36) NOT NULL,
+        cf_plan_id         VARCHAR(36),
+        cf_org_id          VARCHAR(36),
+        cf_space_id        VARCHAR(36),
+        started_at         TIMESTAMP,
+        service_agent      VARCHAR(15),
+        primary key        (cf_instance_id))`,
+
+`CREATE TABLE servicebindings (
+        cf_instance_id     VARCHAR(36) NOT NULL,
+        cf_app_id          VARCHAR(36) NOT NULL,
+        cf_binding_id      VARCHAR(36) NOT NULL,
+        started_at         TIMESTAMP,
+        primary key        (cf_instance_id,cf_binding_id))`,
+    }
+    switch persister.getDBType() {
+    case SQLITE :
+        statements = append(statements,`CREATE TABLE serviceconfigurations (
+        id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+        username           VARCHAR(36) NOT NULL,
+        password           VARCHAR(36) NOT NULL,
+        catalog            VARCHAR(36) NOT NULL)`)
+    case POSTGRES :
+        statements = append(statements,"CREATE SEQUENCE service_id_seq",
+`CREATE TABLE serviceconfigurations (
+        id                 SMALLINT NOT NULL PRIMARY KEY DEFAULT nextval('service_id_seq'),
+        username           VARCHAR(36) NOT NULL,
+        password           VARCHAR(36) NOT NULL,
+        catalog            VARCHAR(36) NOT NULL)`,
+        "ALTER SEQUENCE service_id_seq OWNED BY serviceconfigurations.id")
+    default :
+        statements = append(statements,`CREATE TABLE serviceconfigurations (
+        id                 INT NOT NULL AUTO_INCREMENT,
+        username           VARCHAR(36) NOT NULL,
+        password           VARCHAR(36) NOT NULL,
+        catalog            VARCHAR(36) NOT NULL,
+        primary key        (id))`)
+    }
+    return append(statements,
+`CREATE TABLE imageconfigurations (
+        service_id         INT NOT NULL,
+        name               VARCHAR(36) NOT NULL,
+        plan               VARCHAR(36) NOT NULL,
+        dashboardurl       VARCHAR(255),
+        credentials        VARCHAR(255),
+        numinstances       INT,
+        containername      VARCHAR(36),
+        primary key        (service_id,name,plan),
+        foreign key (service_id) references serviceconfigurations(id))`,
+
+`CREATE TABLE brokercertificates (
+        serviceagent       VARCHAR(32),
+        cafile             `+blob+`,
+        clientcertfile     `+blob+`,
+        clientkeyfile      `+blob+`)`)
+}
+
+func operationsSchema(persister *Persister) []string {
+    return []string {
+`CREATE TABLE serviceoperations (
+        operation_id       VARCHAR(36) NOT NULL,
+        cf_instance_id     VARCHAR(36) NOT NULL,
+        cf_binding_id      VARCHAR(36) NOT NULL DEFAULT '',
+        operation_type     VARCHAR(16) NOT NULL,
+        state              VARCHAR(16) NOT NULL,
+        description        VARCHAR(255),
+        started_at         TIMESTAMP,
+        updated_at         TIMESTAMP,
+        primary key        (operation_id))`,
+    }
+}
+
+func planSettingsSchema(persister *Persister) []string {
+    return addColumns("imageconfigurations",
+                      "description VARCHAR(255)",
+                      "memory BIGINT",
+                      "memoryswap BIGINT",
+                      "cpushares INT",
+                      "cpuset VARCHAR(64)",
+                      "env VARCHAR(1024)",
+                      "tag VARCHAR(128)",
+                      "digest VARCHAR(80)")
+}
+
+func volumesSchema(persister *Persister) []string {
+    return append(addColumns("imageconfigurations","volumes VARCHAR(1024)","retainvolumes BOOLEAN DEFAULT false"),
+`CREATE TABLE servicevolumes (
+        cf_instance_id     VARCHAR(36) NOT NULL,
+        container_path     VARCHAR(255) NOT NULL,
+        source             VARCHAR(255) NOT NULL,
+        host_path          BOOLEAN DEFAULT false,
+        primary key        (cf_instance_id,container_path))`)
+}
+
+func registriesSchema(persister *Persister) []string {
+    return []string {
+`CREATE TABLE registrycredentials (
+        registry           VARCHAR(255) NOT NULL,
+        username           VARCHAR(255),
+        password           VARCHAR(255),
+        email              VARCHAR(255),
+        primary key        (registry))`,
+    }
+}
+
+func serverNamesSchema(persister *Persister) []string {
+    return addColumns("brokercertificates","servername VARCHAR(255)")
+}
+
+func usersSchema(persister *Persister) []string {
+    return []string {
+`CREATE TABLE brokerusers (
+        name               VARCHAR(64) NOT NULL,
+        password           VARCHAR(128),
+        role               VARCHAR(32),
+        host               VARCHAR(255),
+        primary key        (name))`,
+    }
+}
+
+func parametersSchema(persister *Persister) []string {
+    return append(addColumns("serviceinstances","parameters VARCHAR(1024)"),
+                  addColumns("servicebindings","credentials VARCHAR(2048)","parameters VARCHAR(1024)")...)
+}
+
+func auditSchema(persister *Persister) []string {
+    statements := append(addColumns("serviceinstances","context VARCHAR(1024)","originating_identity VARCHAR(1024)"),
+                         addColumns("servicebindings","context VARCHAR(1024)","originating_identity VARCHAR(1024)")...)
+    return append(statements,
+`CREATE TABLE auditevents (
+        event_time         TIMESTAMP,
+        operation          VARCHAR(16) NOT NULL,
+        cf_instance_id     VARCHAR(36) NOT NULL,
+        cf_binding_id      VARCHAR(36) NOT NULL DEFAULT '',
+        container_id       VARCHAR(128),
+        context            VARCHAR(1024),
+        originating_identity VARCHAR(1024))`)
+}
+
+func syslogDrainSchema(persister *Persister) []string {
+    return append(addColumns("servicebindings","syslog_drain_url VARCHAR(255)"),
+                  addColumns("imageconfigurations","requires VARCHAR(255)","syslogdrainurl VARCHAR(255)")...)
+}
+
+// An envelope takes more than 84 characters before the sealed value, see encrypt.
+func encryptedSecretsSchema(persister *Persister) []string {
+    statements := persister.widenColumns("serviceinstances","service_url")
+    statements = append(statements,persister.widenColumns("servicebindings","credentials")...)
+    statements = append(statements,persister.widenColumns("imageconfigurations","credentials")...)
+    return append(statements,persister.widenColumns("registrycredentials","password")...)
+}
+
+func operationRequestsSchema(persister *Persister) []string {
+    return addColumns("serviceoperations","request TEXT")
+}
+
+// Descriptions hold the errors of failed operations and the progress of image pulls.
+func operationDescriptionsSchema(persister *Persister) []string {
+    return persister.widenColumns("serviceoperations","description")
+}
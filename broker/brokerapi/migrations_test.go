@@ -0,0 +1,59 @@
+package brokerapi
+
+import (
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "regexp"
+    "strings"
+)
+
+var (
+    createTable = regexp.MustCompile(`CREATE TABLE (\w+) \(`)
+    tableColumn = regexp.MustCompile(`(?m)^\s+(\w+)\s+(\w+(\(\d+(,\d+)?\))?)`)
+    alterColumn = regexp.MustCompile(`ALTER TABLE (\w+) (?:ADD COLUMN|MODIFY|ALTER COLUMN) (\w+) (?:TYPE )?(\w+(\(\d+\))?)`)
+)
+
+// The type every column ends up with once all migrations ran, keyed by table.column.
+func declaredTypes(persister *Persister) map[string]string {
+    types := make(map[string]string)
+    for _,m := range migrations {
+        for _,statement := range m.statements(persister) {
+            if match := createTable.FindStringSubmatch(statement); match != nil {
+                for _,column := range tableColumn.FindAllStringSubmatch(statement,-1) {
+                    types[match[1]+"."+column[1]] = column[2]
+                }
+            } else if match := alterColumn.FindStringSubmatch(statement); match != nil {
+                types[match[1]+"."+match[2]] = match[3]
+            }
+        }
+    }
+    return types
+}
+
+var _ = Describe("Migrations", func() {
+    It("should make room for envelopes in the columns holding secrets", func() {
+        sealed, err := encrypt("ZmFrZUVuY3J5cHRpb25LZXkuLi4uLi4uLi4uLi4uLi4=",strings.Repeat("x",255))
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(len(sealed)).To(BeNumerically(">",255))
+
+        for _,driver := range []string{"mysql","postgres"} {
+            persister := &Persister{Driver: driver}
+            types := declaredTypes(persister)
+            for _,column := range []string{"serviceinstances.service_url","servicebindings.credentials",
+                                           "imageconfigurations.credentials","registrycredentials.password"} {
+                Expect(types).To(HaveKeyWithValue(column,"TEXT"),driver+" "+column)
+            }
+            Expect(types["brokercertificates.clientkeyfile"]).To(Equal(persister.dialect("BLOB","BLOB","BYTEA")))
+        }
+    })
+
+    It("should make room for long descriptions and requests of operations", func() {
+        for _,driver := range []string{"mysql","postgres"} {
+            types := declaredTypes(&Persister{Driver: driver})
+            Expect(types).To(HaveKeyWithValue("serviceoperations.description","TEXT"),driver)
+            //requests carry the parameters and the context the client sent
+            Expect(types).To(HaveKeyWithValue("serviceoperations.request","TEXT"),driver)
+        }
+    })
+})
@@ -0,0 +1,26 @@
+package brokerapi
+
+import (
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "errors"
+)
+
+var _ = Describe("Operation", func() {
+    It("should report the error of the operation", func() {
+        err := runOperation(Operation{Id: "myFakeOperation"}, func(Operation) error {
+            return errors.New("no database")
+        })
+        Expect(err).To(MatchError("no database"))
+    })
+
+    It("should fail the operation when it panics", func() {
+        err := runOperation(Operation{Id: "myFakeOperation"}, func(Operation) error {
+            var response map[string]interface{}
+            response["port"] = 3306
+            return nil
+        })
+        Expect(err).To(MatchError("assignment to entry in nil map"))
+    })
+})
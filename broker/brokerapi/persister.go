@@ -21,6 +21,10 @@ type Persister struct {
     User string
     Password string
     Database string
+    //master key the secrets like the credentials of bindings are encrypted with when set
+    EncryptionKey string
+    //file holding the master key instead, see loadEncryptionKey
+    EncryptionKeyFile string
     Db  *sql.DB;
 }
 
@@ -28,6 +32,10 @@ const (
     MYSQL = 1
     SQLITE = 2
     POSTGRES = 3
+    //embedded store, see BoltStore
+    BOLT = 4
+    //nothing survives a restart, see MemoryStore
+    MEMORY = 5
 )
 
 func (persister *Persister) getDBType() int {
@@ -38,6 +46,10 @@ func (persister *Persister) getDBType() int {
         return SQLITE
     case "postgres","POSTGRES" :
         return POSTGRES     
+    case "bolt","BOLT" :
+        return BOLT
+    case "memory","MEMORY" :
+        return MEMORY
     }
     return -1    
 }
@@ -63,9 +75,26 @@ func (persister *Persister) Connect() (error) {
     return err        
 }
 
+func (persister *Persister) Close() error {
+    return persister.Db.Close()
+}
+
 // generic functions
 
 func (persister *Persister) InsertTable(tablename string, colmap map[string] interface{}) error {
+    query, insertVals := persister.insertStatement(tablename,colmap)
+    stmt,err := persister.Db.Prepare(query)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    _, err = stmt.Exec(insertVals...)
+    return err
+}
+
+// The insert of the columns that are not nil along with their values.
+func (persister *Persister) insertStatement(tablename string, colmap map[string] interface{}) (string,[]interface{}) {
     var insertCols string = "("
     var insertParams string = "("
     var insertVals []interface{}
@@ -82,17 +111,10 @@ func (persister *Persister) InsertTable(tablename string, colmap map[string] int
     }
     insertCols = strings.TrimSuffix(insertCols,",")+")"
     insertParams = persister.parameterize(strings.TrimSuffix(insertParams,",")+")")
-    stmt,err := persister.Db.Prepare("insert into "+tablename+insertCols+" values "+insertParams)
-    if err != nil {
-        return err
-    }
-    defer stmt.Close()
-
-    _, err = stmt.Exec(insertVals...)
-    return err
+    return "insert into "+tablename+insertCols+" values "+insertParams,insertVals
 }
 
-func (persister *Persister) UpdateTable(tablename string, colmap map[string] interface{}, cond string) error {
+func (persister *Persister) UpdateTable(tablename string, colmap map[string] interface{}, filter Filter) error {
     var updateCols string = " set "
     var updateVals []interface{}
     for colname := range colmap {
@@ -100,13 +122,15 @@ func (persister *Persister) UpdateTable(tablename string, colmap map[string] int
             log.Println("colname ",colname," has nil value")
             continue
         } 
-        updateCols = updateCols + colname + persister.parameterize("=?") + ","
+        updateCols = updateCols + colname + "=?,"
         value := new(interface{})
         *value = colmap[colname]
         updateVals = append(updateVals,value)
     }
     updateCols = strings.TrimSuffix(updateCols,",")
-    stmt,err := persister.Db.Prepare("update "+tablename+updateCols+" where "+cond)
+    cond,args := filter.clause()
+    updateVals = append(updateVals,args...)
+    stmt,err := persister.Db.Prepare(persister.parameterize("update "+tablename+updateCols+cond))
     if err != nil {
         return err
     }
@@ -116,18 +140,15 @@ func (persister *Persister) UpdateTable(tablename string, colmap map[string] int
     return err
 }
 
-func (persister *Persister) GetCount(tablename, cond string) (int32,error) {
+func (persister *Persister) GetCount(tablename string, filter Filter) (int32,error) {
     var count int32
-    query := "SELECT count(*) FROM "+tablename
-    if len(cond) > 0 {
-        query = query+" where "+cond
-    }
-    err := persister.Db.QueryRow(query).Scan(&count)
+    cond,args := filter.clause()
+    err := persister.Db.QueryRow(persister.parameterize("SELECT count(*) FROM "+tablename+cond),args...).Scan(&count)
     return count,err
 }
 
-func (persister *Persister) HasEntry(tablename, cond string) (bool) {
-    count,err := persister.GetCount(tablename,cond)
+func (persister *Persister) HasEntry(tablename string, filter Filter) (bool) {
+    count,err := persister.GetCount(tablename,filter)
     if err != nil {
         log.Println(err)
         return false
@@ -140,14 +161,9 @@ func (persister *Persister) HasEntry(tablename, cond string) (bool) {
 
 //service agent calls
 
-func (persister *Persister) GetServiceAgentList(cond string) ([]ServiceAgent,error) {
-    var rows *sql.Rows
-    var err error
-    if (cond == "") {
-        rows, err = persister.Db.Query("SELECT service_host,docker_host,docker_port,is_active,perf_factor,ping_interval_secs,last_ping,exec_command,exec_args,portbinding_min,portbinding_max,portbindings FROM serviceagents")
-    } else {
-        rows, err = persister.Db.Query("SELECT service_host,docker_host,docker_port,is_active,perf_factor,ping_interval_secs,last_ping,exec_command,exec_args,portbinding_min,portbinding_max,portbindings FROM serviceagents where "+cond)
-    }
+func (persister *Persister) GetServiceAgentList(filter Filter) ([]ServiceAgent,error) {
+    cond,args := filter.clause()
+    rows, err := persister.Db.Query(persister.parameterize("SELECT service_host,docker_host,docker_port,is_active,perf_factor,ping_interval_secs,last_ping,exec_command,exec_args,portbinding_min,portbinding_max,portbindings FROM serviceagents"+cond),args...)
     if err != nil {
         return nil,err
     }
@@ -175,11 +191,26 @@ func (persister *Persister) GetServiceAgentList(cond string) ([]ServiceAgent,err
     return serviceagents,nil
 }
 
-func (persister *Persister) GetPortBindings(cond string) (int,int,[]int,error) {
+func (persister *Persister) GetServiceAgent(dockerhost string) (ServiceAgent,error) {
+    serviceagents, err := persister.GetServiceAgentList(Where("docker_host",dockerhost))
+    if err != nil {
+        return ServiceAgent{},err
+    }
+    if len(serviceagents) == 0 {
+        return ServiceAgent{},sql.ErrNoRows
+    }
+    return serviceagents[0],nil
+}
+
+func (persister *Persister) GetLiveServiceAgents() ([]ServiceAgent,error) {
+    return persister.GetServiceAgentList(Expression(persister.TimeElapsed("last_ping")+" < 3*ping_interval_secs"))
+}
+
+func (persister *Persister) GetPortBindings(dockerhost string) (int,int,[]int,error) {
     var pb_min,pb_max int
     var pb_bytes []byte
     var pb []int
-    rows, err := persister.Db.Query("select portbinding_min,portbinding_max,portbindings from serviceagents where "+cond)
+    rows, err := persister.Db.Query("select portbinding_min,portbinding_max,portbindings from serviceagents where docker_host"+persister.parameterize("=?"),dockerhost)
     if err != nil {
         return pb_min,pb_max,pb,err
     }
@@ -196,10 +227,10 @@ func (persister *Persister) GetPortBindings(cond string) (int,int,[]int,error) {
     return pb_min,pb_max,pb,sql.ErrNoRows
 }
 
-func (persister *Persister) WritePortBinding (ports []int, cond string) error {
-    if persister.HasEntry("serviceagents",cond) {
+func (persister *Persister) WritePortBinding (ports []int, dockerhost string) error {
+    if persister.HasEntry("serviceagents",Where("docker_host",dockerhost)) {
         return persister.UpdateTable("serviceagents",map[string] interface{} {    
-                                     "portbindings":MarshalIntArray(ports)},cond)
+                                     "portbindings":MarshalIntArray(ports)},Where("docker_host",dockerhost))
     } else {
         return sql.ErrNoRows
     }
@@ -227,15 +258,15 @@ func (persister *Persister) AddServiceAgents(serviceagents []ServiceAgent) error
 }
 
 func (persister *Persister) MarkServiceAgentInactive(Host string) error {
-    return persister.UpdateTable("serviceagents",map[string] interface{} {"is_active":false},"docker_host='"+Host+"'")
+    return persister.UpdateTable("serviceagents",map[string] interface{} {"is_active":false},Where("docker_host",Host))
 }
 
 func (persister *Persister) MarkServiceAgentActive(Host string) error {
-    return persister.UpdateTable("serviceagents",map[string] interface{} {"is_active":true},"docker_host='"+Host+"'")
+    return persister.UpdateTable("serviceagents",map[string] interface{} {"is_active":true},Where("docker_host",Host))
 }
 
 func (persister *Persister) AddorUpdateServiceAgent(sa ServiceAgent) error {
-    if persister.HasEntry("serviceagents","docker_host='"+sa.DockerHost+"'") {
+    if persister.HasEntry("serviceagents",Where("docker_host",sa.DockerHost)) {
         persister.UpdateTable("serviceagents",map[string] interface{} {"last_ping":time.Now(),
                                                                        "service_host":sa.ServiceHost,
                                                                        "docker_port":sa.DockerPort,
@@ -245,7 +276,7 @@ func (persister *Persister) AddorUpdateServiceAgent(sa ServiceAgent) error {
                                                                        "exec_args":sa.ExecArgs,  
                                                                        "portbinding_min":sa.Portbind_min,    
                                                                        "portbinding_max":sa.Portbind_max,    
-                                                                       "perf_factor":sa.PerfFactor},"docker_host='"+sa.DockerHost+"'")
+                                                                       "perf_factor":sa.PerfFactor},Where("docker_host",sa.DockerHost))
         return nil
     } else {
         return persister.AddServiceAgents([]ServiceAgent{sa})
@@ -254,9 +285,9 @@ func (persister *Persister) AddorUpdateServiceAgent(sa ServiceAgent) error {
 
 //service instance calls
 
-func (persister *Persister) GetServiceAgentFromInstance(cond string) (string,error) {
+func (persister *Persister) GetServiceAgentFromInstance(instanceid string) (string,error) {
     var serviceagent string
-    rows, err := persister.Db.Query("select service_agent from serviceinstances s where "+cond)
+    rows, err := persister.Db.Query("select service_agent from serviceinstances where cf_instance_id"+persister.parameterize("=?"),instanceid)
     if err != nil {
         return serviceagent,err
     }
@@ -270,9 +301,9 @@ func (persister *Persister) GetServiceAgentFromInstance(cond string) (string,err
     return serviceagent,sql.ErrNoRows
 }
 
-func (persister *Persister) GetServiceUrl(cond string) string {
+func (persister *Persister) GetServiceUrl(instanceid string) string {
     var serviceurl string
-    rows, err := persister.Db.Query("select service_url from serviceinstances  where "+cond)
+    rows, err := persister.Db.Query("select service_url from serviceinstances where cf_instance_id"+persister.parameterize("=?"),instanceid)
     if err != nil {
         return serviceurl
     }
@@ -283,7 +314,11 @@ func (persister *Persister) GetServiceUrl(cond string) string {
         if err != nil {
             log.Println("error reading row ",err)
         }
-        return serviceurl
+        plain, err := decrypt(persister.EncryptionKey,serviceurl)
+        if err != nil {
+            log.Println("error decrypting service url ",err)
+        }
+        return plain
     }
     return serviceurl
 }
@@ -291,10 +326,27 @@ func (persister *Persister) GetServiceUrl(cond string) string {
 func (persister *Persister) AddServiceInstance(service_name string, service_port, host_port int, 
             service_url, container_id, service_agent,container_name,image_name string, 
             pr ProvisioningRequest, started_at time.Time) error {
+       parameters, err := marshalParameters(pr.Parameters)
+       if err != nil {
+           return err
+       }
+       context, err := marshalParameters(pr.Context)
+       if err != nil {
+           return err
+       }
+       identity, err := marshalIdentity(pr.OriginatingIdentity)
+       if err != nil {
+           return err
+       }
+       //holds the response of the provision executable, passwords included
+       sealed, err := encrypt(persister.EncryptionKey,service_url)
+       if err != nil {
+           return err
+       }
        return persister.InsertTable("serviceinstances",map[string] interface{} {"service_name":service_name,
                                                                         "service_port":service_port,
                                                                        "mapped_host_port":host_port,
-                                                                        "service_url":service_url,
+                                                                        "service_url":sealed,
                                                                         "container_id":container_id,  
                                                                         "service_agent":service_agent,
                                                                         "container_name":container_name,  
@@ -303,11 +355,45 @@ func (persister *Persister) AddServiceInstance(service_name string, service_port
                                                                         "cf_plan_id":pr.PlanId,    
                                                                         "cf_org_id":pr.OrgId,    
                                                                         "cf_space_id":pr.SpaceId,    
+                                                                        "parameters":parameters,    
+                                                                        "context":context,    
+                                                                        "originating_identity":identity,    
                                                                         "started_at":started_at})
     
 
 }
 
+// The instance as it was provisioned, or last updated, sql.ErrNoRows when there is none.
+func (persister *Persister) GetServiceInstance(instanceid string) (ServiceInstance,error) {
+    instance := ServiceInstance{InstanceId: instanceid}
+    var planid,orgid,spaceid,serviceurl,parameters,context,identity sql.NullString
+    err := persister.Db.QueryRow("select service_name,cf_plan_id,cf_org_id,cf_space_id,service_url,parameters,context,originating_identity from serviceinstances where cf_instance_id"+persister.parameterize("=?"),instanceid).Scan(&instance.ServiceId,&planid,&orgid,&spaceid,&serviceurl,&parameters,&context,&identity)
+    if err != nil {
+        return instance,err
+    }
+    instance.PlanId = planid.String
+    instance.OrgId = orgid.String
+    instance.SpaceId = spaceid.String
+    url, err := decrypt(persister.EncryptionKey,serviceurl.String)
+    if err != nil {
+        return instance,err
+    }
+    //without a dashboard the response of the provision executable is kept instead
+    if !strings.HasPrefix(url, "{") {
+        instance.DashboardUrl = url
+    }
+    if len(parameters.String) > 0 {
+        json.Unmarshal([]byte(parameters.String),&instance.Parameters)
+    }
+    if len(context.String) > 0 {
+        json.Unmarshal([]byte(context.String),&instance.Context)
+    }
+    if len(identity.String) > 0 {
+        json.Unmarshal([]byte(identity.String),&instance.OriginatingIdentity)
+    }
+    return instance,nil
+}
+
 func (persister *Persister) DeleteServiceInstance(instanceId string) error {
     stmt, err := persister.Db.Prepare("delete from serviceinstances where cf_instance_id"+persister.parameterize("=?"))
     if err != nil {
@@ -361,15 +447,98 @@ func (persister *Persister) GetServicePort(instanceid string) int {
     return service_port
 }
 
+// The port of the docker host the service port is published on, -1 when there is no instance.
+func (persister *Persister) GetHostPort(instanceid string) int {
+    var host_port sql.NullInt64
+    err := persister.Db.QueryRow("select mapped_host_port from serviceinstances where cf_instance_id"+persister.parameterize("=?"),instanceid).Scan(&host_port)
+    if err != nil {
+        log.Println("Failed to get values",err) 
+        return -1
+    }
+    
+    return int(host_port.Int64)
+}
+
+func (persister *Persister) GetServiceInstancePlan(instanceid string) string {
+    var planid sql.NullString
+    err := persister.Db.QueryRow("select cf_plan_id from serviceinstances where cf_instance_id"+persister.parameterize("=?"),instanceid).Scan(&planid)
+    if err != nil {
+        log.Println("Failed to get values",err) 
+    }
+    return planid.String
+}
+
+func (persister *Persister) UpdateServiceInstance(instanceid, planid, containerid string, parameters map[string]interface{}) error {
+    params, err := marshalParameters(parameters)
+    if err != nil {
+        return err
+    }
+    return persister.UpdateTable("serviceinstances",map[string] interface{} {"cf_plan_id":planid,
+                                                                        "container_id":containerid,
+                                                                        "parameters":params},Where("cf_instance_id",instanceid))
+}
+
 //service bindings calls
 
-func (persister *Persister) AddServiceBinding(instanceId,bindingId,appId string, started_at time.Time) error {
-       return persister.InsertTable("servicebindings",map[string] interface{} {"cf_instance_id":instanceId,    
-                                                                        "cf_binding_id":bindingId,    
-                                                                        "cf_app_id":appId,    
+func (persister *Persister) AddServiceBinding(binding ServiceBinding, started_at time.Time) error {
+       credentials, err := json.Marshal(binding.Credentials)
+       if err != nil {
+           return err
+       }
+       sealed, err := encrypt(persister.EncryptionKey,string(credentials))
+       if err != nil {
+           return err
+       }
+       parameters, err := marshalParameters(binding.Parameters)
+       if err != nil {
+           return err
+       }
+       context, err := marshalParameters(binding.Context)
+       if err != nil {
+           return err
+       }
+       identity, err := marshalIdentity(binding.OriginatingIdentity)
+       if err != nil {
+           return err
+       }
+       return persister.InsertTable("servicebindings",map[string] interface{} {"cf_instance_id":binding.InstanceId,    
+                                                                        "cf_binding_id":binding.BindingId,    
+                                                                        "cf_app_id":binding.AppId,    
+                                                                        "credentials":sealed,    
+                                                                        "syslog_drain_url":binding.SyslogDrainUrl,    
+                                                                        "parameters":parameters,    
+                                                                        "context":context,    
+                                                                        "originating_identity":identity,    
                                                                         "started_at":started_at})
 } 
 
+func (persister *Persister) GetServiceBinding(instanceId,bindingId string) (ServiceBinding,error) {
+    binding := ServiceBinding{InstanceId: instanceId, BindingId: bindingId}
+    var credentials,drainurl,parameters,context,identity sql.NullString
+    err := persister.Db.QueryRow("select cf_app_id,credentials,syslog_drain_url,parameters,context,originating_identity from servicebindings where "+persister.parameterize("cf_instance_id=? and cf_binding_id=?"),instanceId,bindingId).Scan(&binding.AppId,&credentials,&drainurl,&parameters,&context,&identity)
+    if err != nil {
+        return binding,err
+    }
+    if len(credentials.String) > 0 {
+        plain, err := decrypt(persister.EncryptionKey,credentials.String)
+        if err != nil {
+            return binding,err
+        }
+        json.Unmarshal([]byte(plain),&binding.Credentials)
+    }
+    binding.SyslogDrainUrl = drainurl.String
+    if len(parameters.String) > 0 {
+        json.Unmarshal([]byte(parameters.String),&binding.Parameters)
+    }
+    if len(context.String) > 0 {
+        json.Unmarshal([]byte(context.String),&binding.Context)
+    }
+    if len(identity.String) > 0 {
+        json.Unmarshal([]byte(identity.String),&binding.OriginatingIdentity)
+    }
+    return binding,nil
+}
+
 func (persister *Persister) DeleteServiceBinding(instanceId,bindingId string) error {
     stmt, err := persister.Db.Prepare("delete from servicebindings where "+persister.parameterize("cf_instance_id=? and cf_binding_id=?"))
     if err != nil {
@@ -378,6 +547,7 @@ func (persister *Persister) DeleteServiceBinding(instanceId,bindingId string) er
     defer stmt.Close()
     result, err := stmt.Exec(&instanceId,&bindingId)
     if err != nil {
+        return err
     }
     if i,_ := result.RowsAffected(); i == 0 {
         return sql.ErrNoRows
@@ -387,6 +557,146 @@ func (persister *Persister) DeleteServiceBinding(instanceId,bindingId string) er
 }
 
 
+//service volume calls
+
+func (persister *Persister) AddServiceVolume(volume ServiceVolume) error {
+    return persister.InsertTable("servicevolumes",map[string] interface{} {"cf_instance_id":volume.InstanceId,
+                                                                        "container_path":volume.Path,
+                                                                        "source":volume.Source,
+                                                                        "host_path":volume.HostPath})
+}
+
+func (persister *Persister) GetServiceVolumes(instanceId string) ([]ServiceVolume,error) {
+    rows, err := persister.Db.Query("select cf_instance_id,container_path,source,host_path from servicevolumes where "+
+                                    persister.parameterize("cf_instance_id=?"),instanceId)
+    if err != nil {
+        return nil,err
+    }
+    defer rows.Close()
+
+    volumes := []ServiceVolume{}
+    for rows.Next() {
+        var volume ServiceVolume
+        if err = rows.Scan(&volume.InstanceId,&volume.Path,&volume.Source,&volume.HostPath); err != nil {
+            return nil,err
+        }
+        volumes = append(volumes,volume)
+    }
+    return volumes,rows.Err()
+}
+
+func (persister *Persister) DeleteServiceVolume(instanceId,path string) error {
+    stmt, err := persister.Db.Prepare("delete from servicevolumes where "+persister.parameterize("cf_instance_id=? and container_path=?"))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    _, err = stmt.Exec(&instanceId,&path)
+    return err
+}
+
+//service operation calls
+
+func (persister *Persister) AddOperation(op Operation) error {
+    request, err := json.Marshal(op.Request)
+    if err != nil {
+        return err
+    }
+    return persister.InsertTable("serviceoperations",map[string] interface{} {"operation_id":op.Id,
+                                                                        "cf_instance_id":op.InstanceId,
+                                                                        "cf_binding_id":op.BindingId,
+                                                                        "operation_type":op.Type,
+                                                                        "state":op.State,
+                                                                        "description":op.Description,
+                                                                        "started_at":op.StartedAt,
+                                                                        "updated_at":op.UpdatedAt,
+                                                                        "request":string(request)})
+}
+
+func (persister *Persister) UpdateOperation(op Operation) error {
+    return persister.UpdateTable("serviceoperations",map[string] interface{} {"state":op.State,
+                                                                        "description":op.Description,
+                                                                        "updated_at":op.UpdatedAt},Where("operation_id",op.Id))
+}
+
+// Returns the given operation of the instance (or of one of its bindings when bindingId is set),
+// or the most recent one when operationId is empty.
+func (persister *Persister) GetOperation(instanceId, bindingId, operationId string) (Operation,error) {
+    query := "select operation_id,cf_instance_id,cf_binding_id,operation_type,state,description,started_at,updated_at,request from serviceoperations where cf_instance_id=? and cf_binding_id=?"
+    args := []interface{}{instanceId,bindingId}
+    if len(operationId) > 0 {
+        query = query+" and operation_id=?"
+        args = append(args,operationId)
+    }
+    query = query+" order by started_at desc"
+
+    var op Operation
+    var description,request sql.NullString
+    var startedat,updatedat interface{}
+    err := persister.Db.QueryRow(persister.parameterize(query),args...).Scan(&op.Id,&op.InstanceId,&op.BindingId,&op.Type,&op.State,&description,&startedat,&updatedat,&request)
+    if err != nil {
+        return op,err
+    }
+    op.Description = description.String
+    if len(request.String) > 0 {
+        json.Unmarshal([]byte(request.String),&op.Request)
+    }
+    op.StartedAt = scanTime(startedat)
+    op.UpdatedAt = scanTime(updatedat)
+    return op,nil
+}
+
+
+//audit trail calls
+
+func (persister *Persister) AddAuditEvent(event AuditEvent) error {
+    context, err := marshalParameters(event.Context)
+    if err != nil {
+        return err
+    }
+    identity, err := marshalIdentity(event.OriginatingIdentity)
+    if err != nil {
+        return err
+    }
+    return persister.InsertTable("auditevents",map[string] interface{} {"event_time":event.Time,
+                                                                        "operation":event.Operation,
+                                                                        "cf_instance_id":event.InstanceId,
+                                                                        "cf_binding_id":event.BindingId,
+                                                                        "container_id":event.ContainerId,
+                                                                        "context":context,
+                                                                        "originating_identity":identity})
+}
+
+// The events of an instance and its bindings, oldest first.
+func (persister *Persister) GetAuditEvents(instanceId string) ([]AuditEvent,error) {
+    rows, err := persister.Db.Query("select event_time,operation,cf_binding_id,container_id,context,originating_identity from auditevents where "+persister.parameterize("cf_instance_id=?")+" order by event_time",instanceId)
+    if err != nil {
+        return nil,err
+    }
+    defer rows.Close()
+
+    events := []AuditEvent{}
+    for rows.Next() {
+        event := AuditEvent{InstanceId: instanceId}
+        var eventtime interface{}
+        var containerid,context,identity sql.NullString
+        if err = rows.Scan(&eventtime,&event.Operation,&event.BindingId,&containerid,&context,&identity); err != nil {
+            return nil,err
+        }
+        event.Time = scanTime(eventtime)
+        event.ContainerId = containerid.String
+        if len(context.String) > 0 {
+            json.Unmarshal([]byte(context.String),&event.Context)
+        }
+        if len(identity.String) > 0 {
+            json.Unmarshal([]byte(identity.String),&event.OriginatingIdentity)
+        }
+        events = append(events,event)
+    }
+    return events,rows.Err()
+}
+
+
 //service configurations calls
 
 func (persister *Persister) AddServiceConf(user,password,catalog string) error {
@@ -395,6 +705,10 @@ func (persister *Persister) AddServiceConf(user,password,catalog string) error {
                                                                         "catalog":catalog})
 } 
 
+func (persister *Persister) HasServiceConf(catalog string) bool {
+    return persister.HasEntry("serviceconfigurations",Where("catalog",catalog))
+}
+
 func (persister *Persister) GetServiceId(catalog string) int {
     var id int  
     err := persister.Db.QueryRow("select id from serviceconfigurations where catalog"+persister.parameterize("=?"),catalog).Scan(&id)
@@ -409,7 +723,7 @@ func (persister *Persister) GetServiceId(catalog string) int {
 func (persister *Persister) GetServiceConf() ([]ServiceDefinition,error) {
     var rows *sql.Rows
     var err error
-    rows, err = persister.Db.Query("select id,username,password,catalog, name,plan,numinstances,containername, dashboardurl,credentials from serviceconfigurations sc,imageconfigurations ic where ic.service_id=sc.id order by sc.id")
+    rows, err = persister.Db.Query("select id,username,password,catalog, name,plan,numinstances,containername, dashboardurl,credentials, description,memory,memoryswap,cpushares,cpuset,env,volumes,retainvolumes,tag,digest,requires,syslogdrainurl from serviceconfigurations sc,imageconfigurations ic where ic.service_id=sc.id order by sc.id, ic.name, ic.plan")
     if err != nil {
         return nil,err
     }
@@ -422,15 +736,40 @@ func (persister *Persister) GetServiceConf() ([]ServiceDefinition,error) {
         imgdef := ImageDefinition{}
         //interestingly scan does not work if we scan like numinstances after the maps(deprovision), I had to move those field to the top
         var dburl,creds string
-        err = rows.Scan(&rowid,&svcdef.User,&svcdef.Password,&svcdef.Catalog, &imgdef.Name,&imgdef.Plan,&imgdef.Numinstances,&imgdef.Containername, &dburl,&creds)
+        var description,cpuset,env,volumes,tag,digest,requires,syslogdrainurl sql.NullString
+        var memory,memoryswap,cpushares sql.NullInt64
+        var retainvolumes sql.NullBool
+        err = rows.Scan(&rowid,&svcdef.User,&svcdef.Password,&svcdef.Catalog, &imgdef.Name,&imgdef.Plan,&imgdef.Numinstances,&imgdef.Containername, &dburl,&creds, &description,&memory,&memoryswap,&cpushares,&cpuset,&env,&volumes,&retainvolumes,&tag,&digest,&requires,&syslogdrainurl)
         if err != nil {
             log.Println("error reading row ",err)
         }
+        imgdef.Description = description.String
+        imgdef.Memory = int(memory.Int64)
+        imgdef.MemorySwap = int(memoryswap.Int64)
+        imgdef.CpuShares = int(cpushares.Int64)
+        imgdef.Cpuset = cpuset.String
+        if len(env.String) > 0 {
+            json.Unmarshal([]byte(env.String),&imgdef.Env)
+        }
+        if len(volumes.String) > 0 {
+            json.Unmarshal([]byte(volumes.String),&imgdef.Volumes)
+        }
+        imgdef.RetainVolumes = retainvolumes.Bool
+        imgdef.Tag = tag.String
+        imgdef.Digest = digest.String
+        if len(requires.String) > 0 {
+            json.Unmarshal([]byte(requires.String),&imgdef.Requires)
+        }
+        imgdef.SyslogDrainUrl = syslogdrainurl.String
         if len(dburl) > 0 {
             json.Unmarshal([]byte(dburl),&imgdef.DashBoardUrl)        
         }
         if len(creds) > 0 {
-            json.Unmarshal([]byte(creds),&imgdef.Credentials)        
+            plain, err := decrypt(persister.EncryptionKey,creds)
+            if err != nil {
+                return nil,err
+            }
+            json.Unmarshal([]byte(plain),&imgdef.Credentials)        
         }
         if currsvcdef,ok := svcdefs[rowid]; ok {
             currsvcdef.Images = append(currsvcdef.Images,imgdef)
@@ -475,15 +814,73 @@ func (persister *Persister) AddBasicImageConf(service_id int, name,plan string)
 } 
 
 func (persister *Persister) AddImageConf(service_id int, name,plan,dashboardurl, credentials string, numinstances int,containername string) error {
-    return persister.InsertTable("imageconfigurations",map[string] interface{} {"service_id":service_id,    
-                                                                        "name":name,    
-                                                                        "plan":plan,    
+    return persister.AddImagePlanConf(service_id,ImageDefinition{Name: name, Plan: plan, Numinstances: numinstances, Containername: containername},
+                                      dashboardurl,credentials)
+} 
+
+// Adds an image plan along with the container settings of the plan, or replaces the plan when it
+// exists. The maps of the definition are expected to be marshalled by the caller.
+func (persister *Persister) AddImagePlanConf(service_id int, imgdef ImageDefinition, dashboardurl, credentials string) error {
+    var env,volumes,requires []byte
+    var err error
+    if len(imgdef.Requires) > 0 {
+        if requires,err = json.Marshal(imgdef.Requires); err != nil {
+            return err
+        }
+    }
+    if len(imgdef.Env) > 0 {
+        if env,err = json.Marshal(imgdef.Env); err != nil {
+            return err
+        }
+    }
+    if len(imgdef.Volumes) > 0 {
+        if volumes,err = json.Marshal(imgdef.Volumes); err != nil {
+            return err
+        }
+    }
+    if credentials,err = encrypt(persister.EncryptionKey,credentials); err != nil {
+        return err
+    }
+    query, values := persister.insertStatement("imageconfigurations",map[string] interface{} {"service_id":service_id,    
+                                                                        "name":imgdef.Name,    
+                                                                        "plan":imgdef.Plan,    
+                                                                        "description":imgdef.Description,    
                                                                         "dashboardurl":dashboardurl,    
                                                                         "credentials":credentials,    
-                                                                        "containername":containername,    
-                                                                        "numinstances":numinstances})
+                                                                        "containername":imgdef.Containername,    
+                                                                        "numinstances":imgdef.Numinstances,    
+                                                                        "memory":imgdef.Memory,    
+                                                                        "memoryswap":imgdef.MemorySwap,    
+                                                                        "cpushares":imgdef.CpuShares,    
+                                                                        "cpuset":imgdef.Cpuset,    
+                                                                        "env":string(env),    
+                                                                        "volumes":string(volumes),    
+                                                                        "retainvolumes":imgdef.RetainVolumes,    
+                                                                        "tag":imgdef.Tag,    
+                                                                        "digest":imgdef.Digest,    
+                                                                        "requires":string(requires),    
+                                                                        "syslogdrainurl":imgdef.SyslogDrainUrl})
+    tx, err := persister.Db.Begin()
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("delete from imageconfigurations where "+persister.parameterize("service_id=? and name=? and plan=?"),
+                     service_id,imgdef.Name,imgdef.Plan)
+    if err == nil {
+        _, err = tx.Exec(query,values...)
+    }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
 } 
 
+func (persister *Persister) CountImageConf() (int,error) {
+    count, err := persister.GetCount("imageconfigurations",Filter{})
+    return int(count),err
+}
+
 func (persister *Persister) DeleteImageConf(service_id int,name,plan string) error {
     stmt, err := persister.Db.Prepare("delete from imageconfigurations where "+persister.parameterize("service_id=? and name=? and plan=?"))
     if err != nil {
@@ -501,18 +898,27 @@ func (persister *Persister) DeleteImageConf(service_id int,name,plan string) err
 
 //broker certs calls
 
-func (persister *Persister) AddBrokerCertsConf(agent string,clientcertfile,clientkeyfile,cafile []byte) error {
+func (persister *Persister) AddBrokerCertsConf(agent string,clientcertfile,clientkeyfile,cafile []byte,servername string) error {
+    clientkeyfile, err := encryptBytes(persister.EncryptionKey,clientkeyfile)
+    if err != nil {
+        return err
+    }
     return persister.InsertTable("brokercertificates",map[string] interface{} {"serviceagent":agent,    
                                                                         "clientcertfile":clientcertfile,    
                                                                         "clientkeyfile":clientkeyfile,    
-                                                                        "cafile":cafile})
+                                                                        "cafile":cafile,
+                                                                        "servername":servername})
 } 
 
+func (persister *Persister) HasBrokerCerts(agent string) bool {
+    return persister.HasEntry("brokercertificates",Where("serviceagent",agent))
+}
+
 func (persister *Persister) GetBrokerCerts() ([]BrokerCerts, error) {
    var rows *sql.Rows
     var err error
     var certs []BrokerCerts
-    rows, err = persister.Db.Query("select serviceagent,clientcertfile,clientkeyfile,cafile from brokercertificates")
+    rows, err = persister.Db.Query("select serviceagent,clientcertfile,clientkeyfile,cafile,servername from brokercertificates")
     if err != nil {
         return certs,err
     }
@@ -520,10 +926,15 @@ func (persister *Persister) GetBrokerCerts() ([]BrokerCerts, error) {
     
     for rows.Next() {
         brokercerts := BrokerCerts{}
-        rows.Scan(&brokercerts.Host,&brokercerts.ClientCert,&brokercerts.ClientKey,&brokercerts.CA)        
+        var servername sql.NullString
+        err = rows.Scan(&brokercerts.Host,&brokercerts.ClientCert,&brokercerts.ClientKey,&brokercerts.CA,&servername)        
         if err != nil {
             log.Println("error reading row ",err)
         }
+        if brokercerts.ClientKey,err = decryptBytes(persister.EncryptionKey,brokercerts.ClientKey); err != nil {
+            return nil,err
+        }
+        brokercerts.ServerName = servername.String
         certs = append(certs,brokercerts)
         
     }
@@ -548,6 +959,219 @@ func (persister *Persister) DeleteBrokerCertsConf(agent string) error {
 
 
 
+//registry credentials calls
+
+func (persister *Persister) AddRegistryAuthConf(auth RegistryAuth) error {
+    auth, err := sealRegistryAuth(auth,persister.EncryptionKey)
+    if err != nil {
+        return err
+    }
+    return persister.InsertTable("registrycredentials",map[string] interface{} {"registry":auth.Registry,    
+                                                                        "username":auth.Username,    
+                                                                        "password":auth.Password,    
+                                                                        "email":auth.Email})
+} 
+
+func (persister *Persister) HasRegistryAuth(registry string) bool {
+    return persister.HasEntry("registrycredentials",Where("registry",registry))
+}
+
+func (persister *Persister) GetRegistryAuths() ([]RegistryAuth, error) {
+    rows, err := persister.Db.Query("select registry,username,password,email from registrycredentials")
+    if err != nil {
+        return nil,err
+    }
+    defer rows.Close()
+    
+    auths := []RegistryAuth{}
+    for rows.Next() {
+        var auth RegistryAuth
+        var username,password,email sql.NullString
+        if err = rows.Scan(&auth.Registry,&username,&password,&email); err != nil {
+            return nil,err
+        }
+        auth.Username = username.String
+        auth.Password = password.String
+        auth.Email = email.String
+        if auth,err = openRegistryAuth(auth,persister.EncryptionKey); err != nil {
+            return nil,err
+        }
+        auths = append(auths,auth)
+    }
+    return auths,rows.Err()
+}
+
+func (persister *Persister) DeleteRegistryAuthConf(registry string) error {
+    stmt, err := persister.Db.Prepare("delete from registrycredentials where "+persister.parameterize("registry=?"))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    result, err := stmt.Exec(&registry)
+    if err != nil {
+        return err
+    }
+    if i,_ := result.RowsAffected(); i == 0 {
+        return sql.ErrNoRows
+    }
+    return err
+}
+
+//broker users calls
+
+func (persister *Persister) AddUserConf(user BrokerUser) error {
+    return persister.InsertTable("brokerusers",map[string] interface{} {"name":user.Name,    
+                                                                        "password":user.Password,    
+                                                                        "role":user.Role,    
+                                                                        "host":user.Host})
+} 
+
+func (persister *Persister) HasUser(name string) bool {
+    return persister.HasEntry("brokerusers",Where("name",name))
+}
+
+func (persister *Persister) GetUsers() ([]BrokerUser, error) {
+    rows, err := persister.Db.Query("select name,password,role,host from brokerusers")
+    if err != nil {
+        return nil,err
+    }
+    defer rows.Close()
+    
+    users := []BrokerUser{}
+    for rows.Next() {
+        var user BrokerUser
+        var password,role,host sql.NullString
+        if err = rows.Scan(&user.Name,&password,&role,&host); err != nil {
+            return nil,err
+        }
+        user.Password = password.String
+        user.Role = role.String
+        user.Host = host.String
+        users = append(users,user)
+    }
+    return users,rows.Err()
+}
+
+func (persister *Persister) DeleteUserConf(name string) error {
+    stmt, err := persister.Db.Prepare("delete from brokerusers where "+persister.parameterize("name=?"))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    result, err := stmt.Exec(&name)
+    if err != nil {
+        return err
+    }
+    if i,_ := result.RowsAffected(); i == 0 {
+        return sql.ErrNoRows
+    }
+    return err
+}
+
+//encryption key calls
+
+// Columns holding secrets, with the columns identifying their rows.
+type encryptedColumn struct {
+    table  string
+    keys   []string
+    column string
+    blob   bool
+}
+
+var encryptedColumns = []encryptedColumn{
+    {"serviceinstances",[]string{"cf_instance_id"},"service_url",false},
+    {"servicebindings",[]string{"cf_instance_id","cf_binding_id"},"credentials",false},
+    {"imageconfigurations",[]string{"service_id","name","plan"},"credentials",false},
+    {"brokercertificates",[]string{"serviceagent"},"clientkeyfile",true},
+    {"registrycredentials",[]string{"registry"},"password",false},
+}
+
+// Seals the secrets of every row with newKey in a single transaction, the persister uses
+// newKey from then on. Nothing is changed when a secret can not be opened with the current key.
+func (persister *Persister) RotateEncryptionKey(newKey string) error {
+    tx, err := persister.Db.Begin()
+    if err != nil {
+        return err
+    }
+    for _,column := range encryptedColumns {
+        if err = persister.rotateColumn(tx,column,newKey); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    if err = tx.Commit(); err != nil {
+        return err
+    }
+    persister.EncryptionKey = newKey
+    return nil
+}
+
+func (persister *Persister) rotateColumn(tx *sql.Tx, column encryptedColumn, newKey string) error {
+    rows, err := tx.Query("select "+strings.Join(column.keys,",")+","+column.column+" from "+column.table)
+    if err != nil {
+        return err
+    }
+    //all rows are read before updating them, sqlite can not do both at once
+    var updates [][]interface{}
+    for rows.Next() {
+        keys := make([]sql.NullString,len(column.keys))
+        var value []byte
+        dest := make([]interface{},0,len(keys)+1)
+        for i := range keys {
+            dest = append(dest,&keys[i])
+        }
+        if err = rows.Scan(append(dest,&value)...); err != nil {
+            rows.Close()
+            return err
+        }
+        if len(value) == 0 {
+            continue
+        }
+        sealed, err := reencryptBytes(persister.EncryptionKey,newKey,value)
+        if err != nil {
+            rows.Close()
+            return err
+        }
+        args := []interface{}{string(sealed)}
+        if column.blob {
+            args[0] = sealed
+        }
+        for _,key := range keys {
+            args = append(args,key.String)
+        }
+        updates = append(updates,args)
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+        return err
+    }
+    stmt := "update "+column.table+" set "+column.column+"=? where "+strings.Join(column.keys,"=? and ")+"=?"
+    for _,args := range updates {
+        if _,err = tx.Exec(persister.parameterize(stmt),args...); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Parameters are kept as JSON, none are kept as an empty string.
+func marshalParameters(parameters map[string]interface{}) (string,error) {
+    if len(parameters) == 0 {
+        return "",nil
+    }
+    data, err := json.Marshal(parameters)
+    return string(data),err
+}
+
+func marshalIdentity(identity *OriginatingIdentity) (string,error) {
+    if identity == nil {
+        return "",nil
+    }
+    data, err := json.Marshal(identity)
+    return string(data),err
+}
+
 func (persister *Persister) TimeElapsed(eventtime string) string {
     switch persister.getDBType() {
     case MYSQL :
@@ -578,6 +1202,28 @@ func (persister *Persister) parameterize(sqlstr string) string {
     return retval
 }
 
+// Drivers hand back timestamps as time.Time, string or raw bytes depending on the DB and DSN.
+func scanTime(value interface{}) time.Time {
+    var timestr string
+    switch value := value.(type) {
+    case time.Time:
+        return value
+    case string:
+        timestr = value
+    case []byte:
+        timestr = string(value)
+    default:
+        return time.Time{}
+    }
+    for _,layout := range []string{"2006-01-02 15:04:05.999999999-07:00","2006-01-02 15:04:05.999999999",time.RFC3339Nano} {
+        if t,err := time.Parse(layout,timestr); err == nil {
+            return t
+        }
+    }
+    log.Println("unable to parse time value ",timestr)
+    return time.Time{}
+}
+
 func MarshalIntArray(inta []int) []byte {
     buffer := new(bytes.Buffer)
     e := gob.NewEncoder(buffer)
@@ -1,11 +1,191 @@
 package brokerapi_test
 
 import (
+    "github.com/brahmaroutu/docker-broker/broker/brokerapi"
+    "github.com/brahmaroutu/docker-broker/broker/testhelpers"
 
     . "github.com/onsi/ginkgo"
-//    . "github.com/onsi/gomega"
+    . "github.com/onsi/gomega"
+
+    "io/ioutil"
+    "strings"
+    "time"
 )
 
 var _ = Describe("Persister", func() {
+    var persister brokerapi.Persister
+    var serviceagent brokerapi.ServiceAgent
+
+    BeforeEach(func() {
+        persister = testnet.NewSQLPersister()
+        Expect(persister.Connect()).ShouldNot(HaveOccurred())
+        Expect(persister.Migrate()).ShouldNot(HaveOccurred())
+        serviceagent = testnet.NewServiceAgent()
+        serviceagent.DockerHost = "it's a host"
+        serviceagent.Portbind_min = 49000
+        serviceagent.Portbind_max = 49100
+        Expect(persister.AddServiceAgents([]brokerapi.ServiceAgent{serviceagent})).ShouldNot(HaveOccurred())
+    })
+
+    AfterEach(func() {
+        testnet.RemoveSQLPersister(persister)
+    })
+
+    It("should migrate the schema to the latest version", func() {
+        Expect(persister.Migrate()).ShouldNot(HaveOccurred())
+        version, err := persister.SchemaVersion()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(version).To(Equal(brokerapi.LatestSchemaVersion()))
+    })
+
+    It("should refuse a schema newer than the broker", func() {
+        newer := brokerapi.LatestSchemaVersion()+1
+        err := persister.InsertTable("schemaversions",map[string] interface{} {"version":newer,"description":"from the future"})
+        Expect(err).ShouldNot(HaveOccurred())
+        defer persister.Db.Exec("delete from schemaversions where version=?",newer)
+
+        err = persister.Migrate()
+        Expect(err).Should(HaveOccurred())
+        Expect(err.Error()).To(ContainSubstring("newer than version"))
+    })
+
+    It("should bind the values of filters as parameters", func() {
+        Expect(persister.HasEntry("serviceagents",brokerapi.Where("docker_host",serviceagent.DockerHost))).To(BeTrue())
+        Expect(persister.HasEntry("serviceagents",brokerapi.Where("docker_host","x' or '1'='1"))).To(BeFalse())
+
+        count, err := persister.GetCount("serviceagents",brokerapi.Filter{})
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(count).To(Equal(int32(1)))
+        count, err = persister.GetCount("serviceagents",brokerapi.Where("docker_host",serviceagent.DockerHost).And("docker_port",4321))
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(count).To(Equal(int32(0)))
+    })
+
+    It("should update the rows matching a filter", func() {
+        Expect(persister.MarkServiceAgentInactive(serviceagent.DockerHost)).ShouldNot(HaveOccurred())
+        serviceagents, err := persister.GetServiceAgentList(brokerapi.Where("docker_host",serviceagent.DockerHost))
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(serviceagents).To(HaveLen(1))
+        Expect(serviceagents[0].IsActive).To(BeFalse())
+
+        Expect(persister.WritePortBinding([]int{49001,49002},serviceagent.DockerHost)).ShouldNot(HaveOccurred())
+        pb_min, pb_max, pb, err := persister.GetPortBindings(serviceagent.DockerHost)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(pb_min).To(Equal(49000))
+        Expect(pb_max).To(Equal(49100))
+        Expect(pb).To(Equal([]int{49001,49002}))
+
+        Expect(persister.WritePortBinding([]int{49003},"x' or '1'='1")).Should(HaveOccurred())
+    })
+
+    It("should keep secrets encrypted at rest", func() {
+        pr := brokerapi.ProvisioningRequest{InstanceId: "myFakeInstance", PlanId: "100"}
+        Expect(persister.AddServiceInstance("mysql", 3306, 49153, `{"password":"fakePassword"}`, "myFakeContainer", serviceagent.DockerHost,
+                                            "myFakeName", "mysql", pr, time.Now())).ShouldNot(HaveOccurred())
+        Expect(persister.AddImageConf(1, "mysql", "100", "", `{"password":"fakePassword"}`, 1, "")).ShouldNot(HaveOccurred())
+        Expect(persister.AddBrokerCertsConf(serviceagent.DockerHost, []byte("cert"), []byte("fakeKey"), []byte("ca"), "")).ShouldNot(HaveOccurred())
+        Expect(persister.AddRegistryAuthConf(brokerapi.RegistryAuth{Registry: "registry.example.com", Password: "fakePassword"})).ShouldNot(HaveOccurred())
+
+        var serviceurl,credentials,password string
+        var clientkey []byte
+        Expect(persister.Db.QueryRow("select service_url from serviceinstances").Scan(&serviceurl)).ShouldNot(HaveOccurred())
+        Expect(persister.Db.QueryRow("select credentials from imageconfigurations").Scan(&credentials)).ShouldNot(HaveOccurred())
+        Expect(persister.Db.QueryRow("select clientkeyfile from brokercertificates").Scan(&clientkey)).ShouldNot(HaveOccurred())
+        Expect(persister.Db.QueryRow("select password from registrycredentials").Scan(&password)).ShouldNot(HaveOccurred())
+        Expect(serviceurl).To(HavePrefix("env:"))
+        Expect(credentials).To(HavePrefix("env:"))
+        Expect(string(clientkey)).To(HavePrefix("env:"))
+        Expect(password).To(HavePrefix("env:"))
+        Expect(persister.GetServiceUrl("myFakeInstance")).To(Equal(`{"password":"fakePassword"}`))
+    })
+
+    It("should encrypt rows written without a key when rotating the key", func() {
+        plain := persister
+        plain.EncryptionKey = ""
+        binding := brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "myFakeBinding",
+                                            Credentials: brokerapi.Credentials{"password": "fakePassword"}}
+        Expect(plain.AddServiceBinding(binding, time.Now())).ShouldNot(HaveOccurred())
+
+        Expect(persister.RotateEncryptionKey(testnet.NewEncryptionKey)).ShouldNot(HaveOccurred())
+        var credentials string
+        Expect(persister.Db.QueryRow("select credentials from servicebindings").Scan(&credentials)).ShouldNot(HaveOccurred())
+        Expect(credentials).To(HavePrefix("env:"))
+        stored, err := persister.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.Credentials).To(Equal(binding.Credentials))
+
+        _, err = plain.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).Should(HaveOccurred())
+        old := persister
+        old.EncryptionKey = testnet.EncryptionKey
+        _, err = old.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).Should(HaveOccurred())
+        Expect(err.Error()).To(ContainSubstring("does not match"))
+    })
+})
+
+var _ = Describe("Persister created by the setup scripts of earlier brokers", func() {
+    var persister brokerapi.Persister
+
+    BeforeEach(func() {
+        persister = testnet.NewSQLPersister()
+        Expect(persister.Connect()).ShouldNot(HaveOccurred())
+
+        baseline, err := ioutil.ReadFile("../testhelpers/baseline_sqlite.sql")
+        Expect(err).ShouldNot(HaveOccurred())
+        for _,statement := range strings.Split(string(baseline),";") {
+            if len(strings.TrimSpace(statement)) > 0 {
+                _, err = persister.Db.Exec(statement)
+                Expect(err).ShouldNot(HaveOccurred())
+            }
+        }
+    })
+
+    AfterEach(func() {
+        testnet.RemoveSQLPersister(persister)
+    })
+
+    It("should be migrated to the latest schema", func() {
+        Expect(persister.Migrate()).ShouldNot(HaveOccurred())
+        version, err := persister.SchemaVersion()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(version).To(Equal(brokerapi.LatestSchemaVersion()))
+
+        pr := brokerapi.ProvisioningRequest{InstanceId: "myFakeInstance", PlanId: "100", Parameters: map[string]interface{}{"database": "orders"},
+                                            Context: map[string]interface{}{"platform": "cloudfoundry"}}
+        Expect(persister.AddServiceInstance("mysql", 3306, 49153, "mysql://fakehost:49153", "myFakeContainer", "localhost",
+                                            "myFakeName", "mysql", pr, time.Now())).ShouldNot(HaveOccurred())
+        instance, err := persister.GetServiceInstance("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(instance.Parameters).To(Equal(pr.Parameters))
+        Expect(instance.Context).To(Equal(pr.Context))
+
+        binding := brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "myFakeBinding", AppId: "myFakeApp",
+                                            Credentials: brokerapi.Credentials{"password": "fakePassword"}, SyslogDrainUrl: "syslog://fakehost:514"}
+        Expect(persister.AddServiceBinding(binding, time.Now())).ShouldNot(HaveOccurred())
+        stored, err := persister.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.Credentials).To(Equal(binding.Credentials))
+        Expect(stored.SyslogDrainUrl).To(Equal(binding.SyslogDrainUrl))
+
+        Expect(persister.AddServiceConf("admin", "admin", "My Docker Catalog")).ShouldNot(HaveOccurred())
+        imgdef := brokerapi.ImageDefinition{Name: "mysql", Plan: "100", Memory: 512, Env: []string{"MYSQL_CHARSET=utf8"},
+                                            Volumes: []string{"/var/lib/mysql"}, Tag: "5.7", Requires: []string{"syslog_drain"}}
+        Expect(persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), imgdef, "", "")).ShouldNot(HaveOccurred())
+        services, err := persister.GetServiceConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(services[0].Images[0].Volumes).To(Equal(imgdef.Volumes))
+        Expect(services[0].Images[0].Requires).To(Equal(imgdef.Requires))
 
+        Expect(persister.AddServiceVolume(brokerapi.ServiceVolume{InstanceId: "myFakeInstance", Path: "/var/lib/mysql", Source: "myFakeVolume"})).ShouldNot(HaveOccurred())
+        Expect(persister.AddOperation(brokerapi.Operation{Id: "op1", InstanceId: "myFakeInstance", Type: brokerapi.OperationProvision,
+                                      State: brokerapi.OperationSucceeded, StartedAt: time.Now()})).ShouldNot(HaveOccurred())
+        Expect(persister.AddAuditEvent(brokerapi.AuditEvent{InstanceId: "myFakeInstance", Operation: "provision", Time: time.Now()})).ShouldNot(HaveOccurred())
+        Expect(persister.AddRegistryAuthConf(brokerapi.RegistryAuth{Registry: "registry.example.com", Username: "fakeUser"})).ShouldNot(HaveOccurred())
+        Expect(persister.AddUserConf(brokerapi.BrokerUser{Name: "fakeUser", Password: "fakePassword"})).ShouldNot(HaveOccurred())
+        Expect(persister.AddBrokerCertsConf("myFakeHost", []byte("cert"), []byte("key"), []byte("ca"), "myFakeServer")).ShouldNot(HaveOccurred())
+        certs, err := persister.GetBrokerCerts()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(certs[0].ServerName).To(Equal("myFakeServer"))
+    })
 })
@@ -1,14 +1,17 @@
 package brokerapi
 
 import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/subtle"
     "encoding/base64"
     "encoding/json"
     "errors"
     "fmt"
     "github.com/gorilla/mux"
+    "io/ioutil"
     "log"
     "net/http"
-    "net/http/httputil"
     "strconv"
     "strings"
 )
@@ -20,22 +23,57 @@ const (
     catalog    = "cat"
     imagename  = "img"
     certname   = "cert"
+    registry   = "reg"
+    brokeruser = "user"
 )
 
 var (
     catalogUrlPattern      = fmt.Sprintf("/%v/catalog", apiVersion)
     provisioningUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}", apiVersion, instanceId)
+    lastOperationUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}/last_operation", apiVersion, instanceId)
     bindingUrlPattern      = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}", apiVersion, instanceId, bindingId)
+    bindingLastOperationUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}/last_operation", apiVersion, instanceId, bindingId)
     pingUrlPattern         = fmt.Sprintf("/ping")
     imageUrlPattern        = fmt.Sprintf("/{%v}/image/{%v}",catalog,imagename)
     certUrlPattern         = fmt.Sprintf("/certificate/{%v}",certname)
     imageAllUrlPattern     = fmt.Sprintf("/{%v}/images",catalog)
     certAllUrlPattern      = fmt.Sprintf("/certificates")
+    registryUrlPattern     = fmt.Sprintf("/registry/{%v}",registry)
+    registryAllUrlPattern  = fmt.Sprintf("/registries")
+    userUrlPattern         = fmt.Sprintf("/user/{%v}",brokeruser)
+    userAllUrlPattern      = fmt.Sprintf("/users")
 )
 
+// The service broker API versions supported by this broker, and the versions introducing the
+// features that are only used when the client negotiated them.
+var (
+    minApiVersion = brokerApiVersion{2, 0}
+    maxApiVersion = brokerApiVersion{2, 14}
+
+    asyncApiVersion         = brokerApiVersion{2, 7}
+    contextApiVersion       = brokerApiVersion{2, 12}
+    identityApiVersion      = brokerApiVersion{2, 13}
+    fetchInstanceApiVersion = brokerApiVersion{2, 14}
+)
+
+type brokerApiVersion struct {
+    major int
+    minor int
+}
+
+func (v brokerApiVersion) atLeast(other brokerApiVersion) bool {
+    return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+func (v brokerApiVersion) String() string {
+    return fmt.Sprintf("%v.%v", v.major, v.minor)
+}
+
 type router struct {
-    opts Options
-    mux  *mux.Router // TODO: Replace with own simpler regexp-based mux???
+    opts    Options
+    mux     *mux.Router // TODO: Replace with own simpler regexp-based mux???
+    manager AgentManagerInterface
+    handler http.Handler
 }
 
 func newRouter(o Options, h *handler) *router {
@@ -43,8 +81,13 @@ func newRouter(o Options, h *handler) *router {
     mux.Handle(catalogUrlPattern, responseHandler(h.catalog)).Methods("GET")
     mux.Handle(provisioningUrlPattern, responseHandler(h.provision)).Methods("PUT")
     mux.Handle(provisioningUrlPattern, responseHandler(h.deprovision)).Methods("DELETE")
+    mux.Handle(provisioningUrlPattern, responseHandler(h.update)).Methods("PATCH")
+    mux.Handle(provisioningUrlPattern, responseHandler(h.getinstance)).Methods("GET")
+    mux.Handle(lastOperationUrlPattern, responseHandler(h.lastOperation)).Methods("GET")
     mux.Handle(bindingUrlPattern, responseHandler(h.bind)).Methods("PUT")
     mux.Handle(bindingUrlPattern, responseHandler(h.unbind)).Methods("DELETE")
+    mux.Handle(bindingUrlPattern, responseHandler(h.getbinding)).Methods("GET")
+    mux.Handle(bindingLastOperationUrlPattern, responseHandler(h.lastOperation)).Methods("GET")
     mux.Handle(pingUrlPattern, responseHandler(h.ping)).Methods("POST")
     mux.Handle(imageUrlPattern, responseHandler(h.addimage)).Methods("PUT")
     mux.Handle(imageUrlPattern, responseHandler(h.getimage)).Methods("GET")
@@ -54,38 +97,155 @@ func newRouter(o Options, h *handler) *router {
     mux.Handle(certUrlPattern, responseHandler(h.delcerts)).Methods("DELETE")
     mux.Handle(imageAllUrlPattern, responseHandler(h.getimage)).Methods("GET")
     mux.Handle(certAllUrlPattern, responseHandler(h.getcerts)).Methods("GET")
-    return &router{o, mux}
+    mux.Handle(registryUrlPattern, responseHandler(h.addregistry)).Methods("PUT")
+    mux.Handle(registryUrlPattern, responseHandler(h.getregistries)).Methods("GET")
+    mux.Handle(registryUrlPattern, responseHandler(h.delregistry)).Methods("DELETE")
+    mux.Handle(registryAllUrlPattern, responseHandler(h.getregistries)).Methods("GET")
+    mux.Handle(userUrlPattern, responseHandler(h.adduser)).Methods("PUT")
+    mux.Handle(userUrlPattern, responseHandler(h.getusers)).Methods("GET")
+    mux.Handle(userUrlPattern, responseHandler(h.deluser)).Methods("DELETE")
+    mux.Handle(userAllUrlPattern, responseHandler(h.getusers)).Methods("GET")
+    r := &router{opts: o, mux: mux, manager: h.manager}
+    r.handler = logRequests(checkVersion(r.authenticate(mux)))
+    return r
 }
 
 // Log & verify request and then pass it to Gorilla to be dispatched approprietly.
 func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-    if dump, err := httputil.DumpRequest(req, true); err != nil {
-        log.Printf("Cannot log incoming request: %v", err)
-    } else {
-        if len(string(dump))<200 {
-            log.Print(string(dump))
+    r.handler.ServeHTTP(w, req)
+}
+
+// Logs every request with its credentials, passwords and certificates redacted.
+func logRequests(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if dump, err := dumpRequest(req); err != nil {
+            log.Printf("Cannot log incoming request: %v", err)
+        } else {
+            log.Print(dump)
         }
-    }
+        next.ServeHTTP(w, req)
+    })
+}
 
+// Calls of the service broker API require a version of the major version this broker supports,
+// minor versions are backward compatible so newer ones are accepted as well.
+func checkVersion(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        major, minor, err := extractVersion(req)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        version := brokerApiVersion{major, minor}
+        log.Printf("Router: Version check: [%v]", version)
+        if strings.HasPrefix(req.URL.Path, "/"+apiVersion+"/") &&
+            (major != minApiVersion.major || !version.atLeast(minApiVersion)) {
+            responseHandler(func(*http.Request) responseEntity {
+                return responseEntity{http.StatusPreconditionFailed, BrokerError{fmt.Sprintf(
+                    "Broker API version %v is not supported, supported versions are %v to %v", version, minApiVersion, maxApiVersion)}}
+            }).ServeHTTP(w, req)
+            return
+        }
+        next.ServeHTTP(w, req)
+    })
+}
+
+// The version both sides understand, the requested one capped at the newest this broker knows.
+func negotiatedVersion(req *http.Request) brokerApiVersion {
     major, minor, err := extractVersion(req)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
+        return brokerApiVersion{}
+    }
+    if version := (brokerApiVersion{major, minor}); !version.atLeast(maxApiVersion) {
+        return version
+    }
+    return maxApiVersion
+}
+
+func supportsVersion(req *http.Request, feature brokerApiVersion) bool {
+    return negotiatedVersion(req).atLeast(feature)
+}
+
+// Requests only reach next once the caller is authenticated and authorized for them.
+func (r *router) authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        user, err := r.authenticateUser(req)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusUnauthorized)
+            return
+        }
+        if !authorized(user, req) {
+            log.Printf("Router: %v [%v] may not %v %v", user.Role, user.Name, req.Method, req.URL.Path)
+            http.Error(w, "Access denied for :"+user.Name, http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, req)
+    })
+}
+
+// Agents presenting a verified certificate act for the docker host named by it, the user
+// of the options is the administrator, all other users are looked up by the manager.
+func (r *router) authenticateUser(req *http.Request) (BrokerUser, error) {
+    if identity, ok := extractCertificateIdentity(req); ok {
+        log.Printf("Router: Authentication: certificate of [%v]", identity)
+        return BrokerUser{Name: identity, Role: RoleAgent, Host: identity}, nil
     }
-    log.Printf("Router: Version check: [%v.%v]", major, minor)
-    //TODO: Verify compatibility
 
     username, password, err := extractCredentials(req)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusUnauthorized)
-        return
+        return BrokerUser{}, err
+    }
+    log.Printf("Router: Authentication: [%v]", username)
+    if secureCompare(username, r.opts.Username) & secureCompare(password, r.opts.Password) == 1 {
+        return BrokerUser{Name: username, Role: RoleAdmin}, nil
+    }
+    user, err := r.manager.AuthenticateUser(username, password)
+    if err != nil {
+        log.Printf("Router: Authentication failed for [%v]", username)
+        return BrokerUser{}, errors.New("Invalid Credentials for :"+username)
+    }
+    return user, nil
+}
+
+// Compares in time independent of the contents and lengths, 1 when a and b are equal.
+func secureCompare(a, b string) int {
+    ha := sha256.Sum256([]byte(a))
+    hb := sha256.Sum256([]byte(b))
+    return subtle.ConstantTimeCompare(ha[:], hb[:])
+}
+
+// Admins may call everything, Cloud Controller the service broker API and agents only
+// what they need to register their docker host.
+func authorized(user BrokerUser, req *http.Request) bool {
+    switch user.Role {
+    case RoleAdmin:
+        return true
+    case RoleCloudController:
+        return strings.HasPrefix(req.URL.Path, "/"+apiVersion+"/")
+    case RoleAgent:
+        if len(user.Host) == 0 {
+            return false
+        }
+        if req.URL.Path == pingUrlPattern {
+            return pingsHost(req, user.Host)
+        }
+        return req.URL.Path == "/certificate/"+user.Host
+    }
+    return false
+}
+
+// Whether the ping registers the docker host given, the body is left for the handler to read.
+func pingsHost(req *http.Request, host string) bool {
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+        return false
     }
-    log.Printf("Router: Authentication: [%v/%v]", username, password)
-    if (username != r.opts.Username) || (password != r.opts.Password) {
-        log.Println("trying to login ",username," against ",r.opts.Username)
-        http.Error(w, "Invalid Credentials for :"+username, http.StatusUnauthorized)
+    req.Body = ioutil.NopCloser(bytes.NewReader(body))
+    var sa ServiceAgent
+    if err := json.Unmarshal(body, &sa); err != nil {
+        return false
     }
-    r.mux.ServeHTTP(w, req)
+    return sa.DockerHost == host
 }
 
 type responseEntity struct {
@@ -123,6 +283,35 @@ func extractVersion(req *http.Request) (int, int, error) {
     return major, minor, nil
 }
 
+// The common name of a client certificate the TLS handshake verified against the client CA.
+func extractCertificateIdentity(req *http.Request) (string, bool) {
+    if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+        return "", false
+    }
+    return req.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// Nil when the header is missing, an error when it is not the platform followed by base64 encoded JSON.
+func extractOriginatingIdentity(req *http.Request) (*OriginatingIdentity, error) {
+    identities, _ := req.Header["X-Broker-Api-Originating-Identity"]
+    if len(identities) == 0 {
+        return nil, nil
+    }
+    tokens := strings.Fields(identities[0])
+    if len(identities) != 1 || len(tokens) != 2 {
+        return nil, errors.New("Invalid 'X-Broker-API-Originating-Identity' header")
+    }
+    raw, err := base64.StdEncoding.DecodeString(tokens[1])
+    if err != nil {
+        return nil, errors.New("Unable to decode 'X-Broker-API-Originating-Identity' header")
+    }
+    identity := &OriginatingIdentity{Platform: tokens[0]}
+    if err = json.Unmarshal(raw, &identity.Value); err != nil {
+        return nil, errors.New("Unable to decode 'X-Broker-API-Originating-Identity' header")
+    }
+    return identity, nil
+}
+
 func extractCredentials(req *http.Request) (string, string, error) {
     auths, _ := req.Header["Authorization"]
     if len(auths) != 1 {
@@ -0,0 +1,217 @@
+package brokerapi
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "strings"
+)
+
+// Marks envelopes: a random data key sealed with the master key of the broker, followed by the
+// value sealed with the data key. Rotating the master key only needs to seal the data keys again.
+// Anything else is plain text written before a key was configured.
+const envelopePrefix = "env:"
+
+// Environment variable the master key can be passed in, it takes precedence over the
+// encryptionkeyfile and encryptionkey of the persister.
+const EncryptionKeyEnv = "DOCKER_BROKER_ENCRYPTION_KEY"
+
+// Reads a master key from a file, surrounding white space like a trailing newline is ignored.
+func ReadEncryptionKeyFile(path string) (string, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    key := strings.TrimSpace(string(data))
+    if len(key) == 0 {
+        return "", errors.New("Encryption key file " + path + " is empty")
+    }
+    return key, nil
+}
+
+// Replaces EncryptionKey with the master key from the environment or the key file when one is given.
+func (persister *Persister) loadEncryptionKey() error {
+    if key := os.Getenv(EncryptionKeyEnv); len(key) > 0 {
+        persister.EncryptionKey = key
+    } else if len(persister.EncryptionKeyFile) > 0 {
+        key, err := ReadEncryptionKeyFile(persister.EncryptionKeyFile)
+        if err != nil {
+            return err
+        }
+        persister.EncryptionKey = key
+    }
+    return ValidateEncryptionKey(persister.EncryptionKey)
+}
+
+// A master key is 32 random bytes in base64, as written by `openssl rand -base64 32`. Passphrases
+// are refused, they are far easier to guess than a key. An empty key turns encryption off.
+func ValidateEncryptionKey(key string) error {
+    if len(key) == 0 {
+        return nil
+    }
+    _, err := masterKey(key)
+    return err
+}
+
+// Seals value in an envelope under the master key, the value is kept as it is when no key is
+// configured or there is nothing to hide.
+func encrypt(key, value string) (string, error) {
+    if len(key) == 0 || len(value) == 0 {
+        return value, nil
+    }
+    datakey := make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, datakey); err != nil {
+        return "", err
+    }
+    sealed, err := seal(datakey, []byte(value))
+    if err != nil {
+        return "", err
+    }
+    return wrapDataKey(key, datakey, sealed)
+}
+
+func decrypt(key, value string) (string, error) {
+    if !strings.HasPrefix(value, envelopePrefix) {
+        return value, nil
+    }
+    datakey, sealed, err := unwrapDataKey(key, value)
+    if err != nil {
+        return "", err
+    }
+    plain, err := open(datakey, sealed)
+    if err != nil {
+        return "", err
+    }
+    return string(plain), nil
+}
+
+// Client keys and other secrets kept as BLOB.
+func encryptBytes(key string, value []byte) ([]byte, error) {
+    sealed, err := encrypt(key, string(value))
+    if err != nil {
+        return nil, err
+    }
+    return []byte(sealed), nil
+}
+
+func decryptBytes(key string, value []byte) ([]byte, error) {
+    plain, err := decrypt(key, string(value))
+    if err != nil {
+        return nil, err
+    }
+    return []byte(plain), nil
+}
+
+// Seals value under newKey instead of oldKey. Envelopes keep their data key and sealed value, plain
+// text is sealed in a new envelope. An empty newKey leaves plain text.
+func reencrypt(oldKey, newKey, value string) (string, error) {
+    if strings.HasPrefix(value, envelopePrefix) && len(newKey) > 0 {
+        datakey, sealed, err := unwrapDataKey(oldKey, value)
+        if err != nil {
+            return "", err
+        }
+        return wrapDataKey(newKey, datakey, sealed)
+    }
+    plain, err := decrypt(oldKey, value)
+    if err != nil {
+        return "", err
+    }
+    return encrypt(newKey, plain)
+}
+
+func reencryptBytes(oldKey, newKey string, value []byte) ([]byte, error) {
+    sealed, err := reencrypt(oldKey, newKey, string(value))
+    if err != nil {
+        return nil, err
+    }
+    return []byte(sealed), nil
+}
+
+func wrapDataKey(key string, datakey, sealed []byte) (string, error) {
+    master, err := masterKey(key)
+    if err != nil {
+        return "", err
+    }
+    wrapped, err := seal(master, datakey)
+    if err != nil {
+        return "", err
+    }
+    return envelopePrefix + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unwrapDataKey(key, value string) ([]byte, []byte, error) {
+    if len(key) == 0 {
+        return nil, nil, errors.New("Found an encrypted value but no encryption key is configured")
+    }
+    parts := strings.Split(strings.TrimPrefix(value, envelopePrefix), ":")
+    if len(parts) != 2 {
+        return nil, nil, errors.New("Encrypted value is malformed")
+    }
+    wrapped, err := base64.StdEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil, nil, err
+    }
+    sealed, err := base64.StdEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, nil, err
+    }
+    master, err := masterKey(key)
+    if err != nil {
+        return nil, nil, err
+    }
+    datakey, err := open(master, wrapped)
+    if err != nil {
+        return nil, nil, err
+    }
+    return datakey, sealed, nil
+}
+
+// The AES-256 key the base64 of the master key stands for.
+func masterKey(key string) ([]byte, error) {
+    master, err := base64.StdEncoding.DecodeString(key)
+    if err != nil || len(master) != 32 {
+        return nil, errors.New("The encryption key has to be 32 random bytes in base64, like the output of openssl rand -base64 32")
+    }
+    return master, nil
+}
+
+// AES-GCM with the nonce put in front of the sealed value.
+func seal(key, plain []byte) ([]byte, error) {
+    gcm, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, err
+    }
+    return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+    gcm, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+    if len(sealed) < gcm.NonceSize() {
+        return nil, errors.New("Encrypted value is truncated")
+    }
+    plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+    if err != nil {
+        return nil, errors.New("Failed to decrypt value, the encryption key does not match")
+    }
+    return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
@@ -0,0 +1,320 @@
+package brokerapi
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "strings"
+    "time"
+)
+
+// Everything the broker keeps about agents, instances, bindings and its configuration. Records
+// that do not exist are reported with sql.ErrNoRows by every implementation, secrets like the
+// credentials of bindings, the service urls of instances, the credentials of images, the client
+// keys of docker hosts and the registry passwords are encrypted with the encryption key of the
+// store when it has one. Instances and bindings are only ever inserted, adding one whose key is
+// already taken fails.
+type Store interface {
+    //service agents and the host ports they handed out
+    AddServiceAgents([]ServiceAgent) error
+    AddorUpdateServiceAgent(ServiceAgent) error
+    MarkServiceAgentActive(dockerhost string) error
+    MarkServiceAgentInactive(dockerhost string) error
+    GetServiceAgent(dockerhost string) (ServiceAgent,error)
+    // agents that pinged within three of their ping intervals
+    GetLiveServiceAgents() ([]ServiceAgent,error)
+    GetPortBindings(dockerhost string) (int,int,[]int,error)
+    WritePortBinding(ports []int, dockerhost string) error
+
+    //service instances and their volumes
+    AddServiceInstance(service_name string, service_port, host_port int,
+            service_url, container_id, service_agent, container_name, image_name string,
+            pr ProvisioningRequest, started_at time.Time) error
+    GetServiceInstance(instanceid string) (ServiceInstance,error)
+    GetServiceAgentFromInstance(instanceid string) (string,error)
+    GetContainerIdAndImageName(instanceid string) (string,string)
+    GetServicePort(instanceid string) int
+    // the port of the docker host the service port is published on
+    GetHostPort(instanceid string) int
+    GetServiceInstancePlan(instanceid string) string
+    GetServiceUrl(instanceid string) string
+    UpdateServiceInstance(instanceid, planid, containerid string, parameters map[string]interface{}) error
+    DeleteServiceInstance(instanceid string) error
+    AddServiceVolume(ServiceVolume) error
+    GetServiceVolumes(instanceid string) ([]ServiceVolume,error)
+    DeleteServiceVolume(instanceid, path string) error
+
+    //service bindings
+    AddServiceBinding(binding ServiceBinding, started_at time.Time) error
+    GetServiceBinding(instanceid, bindingid string) (ServiceBinding,error)
+    DeleteServiceBinding(instanceid, bindingid string) error
+
+    //asynchronous operations and the audit trail
+    AddOperation(Operation) error
+    UpdateOperation(Operation) error
+    GetOperation(instanceid, bindingid, operationid string) (Operation,error)
+    AddAuditEvent(AuditEvent) error
+    GetAuditEvents(instanceid string) ([]AuditEvent,error)
+
+    //catalog
+    AddServiceConf(user, password, catalog string) error
+    HasServiceConf(catalog string) bool
+    GetServiceId(catalog string) int
+    GetServiceConf() ([]ServiceDefinition,error)
+    DeleteServiceConf(id int) error
+    AddImageConf(service_id int, name, plan, dashboardurl, credentials string, numinstances int, containername string) error
+    // replaces the plan when it exists
+    AddImagePlanConf(service_id int, imgdef ImageDefinition, dashboardurl, credentials string) error
+    CountImageConf() (int,error)
+    DeleteImageConf(service_id int, name, plan string) error
+
+    //certificates of docker hosts, registry credentials and users of the broker API
+    AddBrokerCertsConf(agent string, clientcertfile, clientkeyfile, cafile []byte, servername string) error
+    HasBrokerCerts(agent string) bool
+    GetBrokerCerts() ([]BrokerCerts,error)
+    DeleteBrokerCertsConf(agent string) error
+    AddRegistryAuthConf(RegistryAuth) error
+    HasRegistryAuth(registry string) bool
+    GetRegistryAuths() ([]RegistryAuth,error)
+    DeleteRegistryAuthConf(registry string) error
+    AddUserConf(BrokerUser) error
+    HasUser(name string) bool
+    GetUsers() ([]BrokerUser,error)
+    DeleteUserConf(name string) error
+
+    // seals all secrets with newKey instead of the current key and keeps using newKey
+    RotateEncryptionKey(newKey string) error
+    Close() error
+}
+
+// Reported by the stores not backed by SQL when an inserted record already exists, the SQL
+// persister reports the violated primary key of its driver instead.
+var ErrRecordExists = errors.New("record already exists")
+
+// Opens the store the persister section of the broker config describes. The "bolt" driver keeps
+// everything in the single file named by Database, the "memory" driver keeps nothing across
+// restarts and the SQL drivers get their schema migrated. The master key is taken from the
+// environment or the key file when given.
+func OpenStore(persister Persister) (Store,error) {
+    if err := persister.loadEncryptionKey(); err != nil {
+        return nil,err
+    }
+    switch persister.getDBType() {
+    case BOLT :
+        return OpenBoltStore(persister.Database, persister.EncryptionKey)
+    case MEMORY :
+        return NewMemoryStore(persister.EncryptionKey),nil
+    }
+    if err := persister.Connect(); err != nil {
+        return nil,err
+    }
+    if err := persister.Migrate(); err != nil {
+        return nil,err
+    }
+    return &persister,nil
+}
+
+// Records of the stores not backed by SQL. A service instance as kept in the store,
+// ServiceInstance hides most of it from JSON.
+type storedInstance struct {
+    ServiceName         string
+    ServicePort         int
+    HostPort            int
+    ServiceUrl          string
+    ContainerId         string
+    ServiceAgent        string
+    ContainerName       string
+    ImageName           string
+    InstanceId          string
+    PlanId              string
+    OrgId               string
+    SpaceId             string
+    Parameters          map[string]interface{}
+    Context             map[string]interface{}
+    OriginatingIdentity *OriginatingIdentity
+    StartedAt           time.Time
+}
+
+type storedBinding struct {
+    InstanceId          string
+    BindingId           string
+    AppId               string
+    //sealed JSON of the credentials
+    Credentials         string
+    SyslogDrainUrl      string
+    Parameters          map[string]interface{}
+    Context             map[string]interface{}
+    OriginatingIdentity *OriginatingIdentity
+    StartedAt           time.Time
+}
+
+type storedService struct {
+    Id       int
+    User     string
+    Password string
+    Catalog  string
+}
+
+type storedImage struct {
+    ServiceId    int
+    Image        ImageDefinition
+    DashboardUrl string
+    Credentials  string
+}
+
+func newStoredInstance(service_name string, service_port, host_port int,
+            service_url, container_id, service_agent, container_name, image_name string,
+            pr ProvisioningRequest, started_at time.Time, encryptionKey string) (storedInstance,error) {
+    sealed, err := encrypt(encryptionKey,service_url)
+    if err != nil {
+        return storedInstance{},err
+    }
+    return storedInstance{ServiceName: service_name,
+                          ServicePort: service_port,
+                          HostPort: host_port,
+                          ServiceUrl: sealed,
+                          ContainerId: container_id,
+                          ServiceAgent: service_agent,
+                          ContainerName: container_name,
+                          ImageName: image_name,
+                          InstanceId: pr.InstanceId,
+                          PlanId: pr.PlanId,
+                          OrgId: pr.OrgId,
+                          SpaceId: pr.SpaceId,
+                          Parameters: pr.Parameters,
+                          Context: pr.Context,
+                          OriginatingIdentity: pr.OriginatingIdentity,
+                          StartedAt: started_at},nil
+}
+
+func (stored storedInstance) serviceInstance(encryptionKey string) (ServiceInstance,error) {
+    instance := ServiceInstance{InstanceId: stored.InstanceId,
+                                ServiceId: stored.ServiceName,
+                                PlanId: stored.PlanId,
+                                OrgId: stored.OrgId,
+                                SpaceId: stored.SpaceId,
+                                Parameters: stored.Parameters,
+                                Context: stored.Context,
+                                OriginatingIdentity: stored.OriginatingIdentity}
+    url, err := decrypt(encryptionKey,stored.ServiceUrl)
+    if err != nil {
+        return instance,err
+    }
+    //without a dashboard the response of the provision executable is kept instead
+    if !strings.HasPrefix(url, "{") {
+        instance.DashboardUrl = url
+    }
+    return instance,nil
+}
+
+func (stored storedInstance) serviceUrl(encryptionKey string) string {
+    url, err := decrypt(encryptionKey,stored.ServiceUrl)
+    if err != nil {
+        log.Println("error decrypting service url ",err)
+    }
+    return url
+}
+
+func newStoredBinding(binding ServiceBinding, started_at time.Time, encryptionKey string) (storedBinding,error) {
+    credentials, err := json.Marshal(binding.Credentials)
+    if err != nil {
+        return storedBinding{},err
+    }
+    sealed, err := encrypt(encryptionKey,string(credentials))
+    if err != nil {
+        return storedBinding{},err
+    }
+    return storedBinding{InstanceId: binding.InstanceId,
+                         BindingId: binding.BindingId,
+                         AppId: binding.AppId,
+                         Credentials: sealed,
+                         SyslogDrainUrl: binding.SyslogDrainUrl,
+                         Parameters: binding.Parameters,
+                         Context: binding.Context,
+                         OriginatingIdentity: binding.OriginatingIdentity,
+                         StartedAt: started_at},nil
+}
+
+func (stored storedBinding) serviceBinding(encryptionKey string) (ServiceBinding,error) {
+    binding := ServiceBinding{InstanceId: stored.InstanceId,
+                              BindingId: stored.BindingId,
+                              AppId: stored.AppId,
+                              SyslogDrainUrl: stored.SyslogDrainUrl,
+                              Parameters: stored.Parameters,
+                              Context: stored.Context,
+                              OriginatingIdentity: stored.OriginatingIdentity}
+    plain, err := decrypt(encryptionKey,stored.Credentials)
+    if err != nil {
+        return binding,err
+    }
+    json.Unmarshal([]byte(plain),&binding.Credentials)
+    return binding,nil
+}
+
+// The maps of the definition come marshalled by the caller, like for the SQL persister.
+func newStoredImage(service_id int, imgdef ImageDefinition, dashboardurl, credentials, encryptionKey string) (storedImage,error) {
+    imgdef.DashBoardUrl = nil
+    imgdef.Credentials = nil
+    sealed, err := encrypt(encryptionKey,credentials)
+    if err != nil {
+        return storedImage{},err
+    }
+    return storedImage{ServiceId: service_id, Image: imgdef, DashboardUrl: dashboardurl, Credentials: sealed},nil
+}
+
+func (stored storedImage) imageDefinition(encryptionKey string) (ImageDefinition,error) {
+    imgdef := stored.Image
+    if len(stored.DashboardUrl) > 0 {
+        json.Unmarshal([]byte(stored.DashboardUrl),&imgdef.DashBoardUrl)
+    }
+    if len(stored.Credentials) > 0 {
+        plain, err := decrypt(encryptionKey,stored.Credentials)
+        if err != nil {
+            return imgdef,err
+        }
+        json.Unmarshal([]byte(plain),&imgdef.Credentials)
+    }
+    return imgdef,nil
+}
+
+// The certificates of a docker host with the client key sealed, and back.
+func sealBrokerCerts(certs BrokerCerts, encryptionKey string) (BrokerCerts,error) {
+    var err error
+    certs.ClientKey, err = encryptBytes(encryptionKey,certs.ClientKey)
+    return certs,err
+}
+
+func openBrokerCerts(certs BrokerCerts, encryptionKey string) (BrokerCerts,error) {
+    var err error
+    certs.ClientKey, err = decryptBytes(encryptionKey,certs.ClientKey)
+    return certs,err
+}
+
+// Registry credentials with the password sealed, and back.
+func sealRegistryAuth(auth RegistryAuth, encryptionKey string) (RegistryAuth,error) {
+    var err error
+    auth.Password, err = encrypt(encryptionKey,auth.Password)
+    return auth,err
+}
+
+func openRegistryAuth(auth RegistryAuth, encryptionKey string) (RegistryAuth,error) {
+    var err error
+    auth.Password, err = decrypt(encryptionKey,auth.Password)
+    return auth,err
+}
+
+// Seals the secrets of the records with newKey instead of oldKey.
+func (stored *storedInstance) reencrypt(oldKey, newKey string) (err error) {
+    stored.ServiceUrl, err = reencrypt(oldKey,newKey,stored.ServiceUrl)
+    return err
+}
+
+func (stored *storedBinding) reencrypt(oldKey, newKey string) (err error) {
+    stored.Credentials, err = reencrypt(oldKey,newKey,stored.Credentials)
+    return err
+}
+
+func (stored *storedImage) reencrypt(oldKey, newKey string) (err error) {
+    stored.Credentials, err = reencrypt(oldKey,newKey,stored.Credentials)
+    return err
+}
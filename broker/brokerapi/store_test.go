@@ -0,0 +1,384 @@
+package brokerapi_test
+
+import (
+    "github.com/brahmaroutu/docker-broker/broker/brokerapi"
+    "github.com/brahmaroutu/docker-broker/broker/testhelpers"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "database/sql"
+    "io/ioutil"
+    "os"
+    "time"
+)
+
+// The contract every Store has to keep, run against each backend below.
+func storeConformance(open func() brokerapi.Store, cleanup func(brokerapi.Store)) {
+    var store brokerapi.Store
+
+    BeforeEach(func() {
+        store = open()
+    })
+
+    AfterEach(func() {
+        cleanup(store)
+    })
+
+    It("should keep instances and bindings", func() {
+        pr := brokerapi.ProvisioningRequest{InstanceId: "myFakeInstance", ServiceId: "mysql", PlanId: "100",
+                                            Parameters: map[string]interface{}{"database": "orders"}}
+        err := store.AddServiceInstance("mysql", 3306, 49153, "mysql://fakehost:49153", "myFakeContainer", "localhost",
+                                        "myFakeName", "mysql", pr, time.Now())
+        Expect(err).ShouldNot(HaveOccurred())
+
+        instance, err := store.GetServiceInstance("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(instance.PlanId).To(Equal("100"))
+        Expect(instance.DashboardUrl).To(Equal("mysql://fakehost:49153"))
+        Expect(instance.Parameters).To(Equal(pr.Parameters))
+        cId, imageName := store.GetContainerIdAndImageName("myFakeInstance")
+        Expect(cId).To(Equal("myFakeContainer"))
+        Expect(imageName).To(Equal("mysql"))
+        Expect(store.GetServicePort("myFakeInstance")).To(Equal(3306))
+        Expect(store.GetHostPort("myFakeInstance")).To(Equal(49153))
+        Expect(store.GetServiceUrl("myFakeInstance")).To(Equal("mysql://fakehost:49153"))
+        agent, err := store.GetServiceAgentFromInstance("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(agent).To(Equal("localhost"))
+
+        Expect(store.UpdateServiceInstance("myFakeInstance", "200", "myNewContainer", nil)).ShouldNot(HaveOccurred())
+        Expect(store.GetServiceInstancePlan("myFakeInstance")).To(Equal("200"))
+
+        binding := brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "myFakeBinding", AppId: "myFakeApp",
+                                            Credentials: brokerapi.Credentials{"password": "fakePassword"}}
+        Expect(store.AddServiceBinding(binding, time.Now())).ShouldNot(HaveOccurred())
+        stored, err := store.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.AppId).To(Equal("myFakeApp"))
+        Expect(stored.Credentials).To(Equal(binding.Credentials))
+
+        Expect(store.DeleteServiceBinding("myFakeInstance", "myFakeBinding")).ShouldNot(HaveOccurred())
+        Expect(store.DeleteServiceBinding("myFakeInstance", "myFakeBinding")).To(Equal(sql.ErrNoRows))
+        _, err = store.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).To(Equal(sql.ErrNoRows))
+        Expect(store.DeleteServiceInstance("myFakeInstance")).ShouldNot(HaveOccurred())
+        _, err = store.GetServiceInstance("myFakeInstance")
+        Expect(err).To(Equal(sql.ErrNoRows))
+        Expect(store.GetServicePort("myFakeInstance")).To(Equal(-1))
+        Expect(store.GetHostPort("myFakeInstance")).To(Equal(-1))
+    })
+
+    It("should refuse instances and bindings that already exist", func() {
+        pr := brokerapi.ProvisioningRequest{InstanceId: "myFakeInstance", ServiceId: "mysql", PlanId: "100"}
+        err := store.AddServiceInstance("mysql", 3306, 49153, "mysql://fakehost:49153", "myFakeContainer", "localhost",
+                                        "myFakeName", "mysql", pr, time.Now())
+        Expect(err).ShouldNot(HaveOccurred())
+        pr.PlanId = "200"
+        err = store.AddServiceInstance("mysql", 3306, 49154, "mysql://fakehost:49154", "otherContainer", "localhost",
+                                       "otherName", "mysql", pr, time.Now())
+        Expect(err).Should(HaveOccurred())
+        Expect(store.GetServiceInstancePlan("myFakeInstance")).To(Equal("100"))
+        cId, _ := store.GetContainerIdAndImageName("myFakeInstance")
+        Expect(cId).To(Equal("myFakeContainer"))
+
+        binding := brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "myFakeBinding", AppId: "myFakeApp",
+                                            Credentials: brokerapi.Credentials{"password": "fakePassword"}}
+        Expect(store.AddServiceBinding(binding, time.Now())).ShouldNot(HaveOccurred())
+        other := binding
+        other.AppId = "otherApp"
+        other.Credentials = brokerapi.Credentials{"password": "otherPassword"}
+        Expect(store.AddServiceBinding(other, time.Now())).Should(HaveOccurred())
+        stored, err := store.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.AppId).To(Equal("myFakeApp"))
+        Expect(stored.Credentials).To(Equal(binding.Credentials))
+    })
+
+    It("should keep the volumes of instances", func() {
+        volume := brokerapi.ServiceVolume{InstanceId: "myFakeInstance", Path: "/var/lib/mysql", Source: "myFakeVolume"}
+        Expect(store.AddServiceVolume(volume)).ShouldNot(HaveOccurred())
+        Expect(store.AddServiceVolume(brokerapi.ServiceVolume{InstanceId: "otherInstance", Path: "/data"})).ShouldNot(HaveOccurred())
+
+        volumes, err := store.GetServiceVolumes("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(volumes).To(Equal([]brokerapi.ServiceVolume{volume}))
+
+        Expect(store.DeleteServiceVolume("myFakeInstance", "/var/lib/mysql")).ShouldNot(HaveOccurred())
+        volumes, err = store.GetServiceVolumes("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(volumes).To(BeEmpty())
+        Expect(store.DeleteServiceVolume("otherInstance", "/data")).ShouldNot(HaveOccurred())
+    })
+
+    It("should keep the port bindings of agents across pings", func() {
+        sa := testnet.NewServiceAgent()
+        sa.Portbind_min = 49000
+        sa.Portbind_max = 49100
+        Expect(store.AddorUpdateServiceAgent(sa)).ShouldNot(HaveOccurred())
+        Expect(store.WritePortBinding([]int{49001}, sa.DockerHost)).ShouldNot(HaveOccurred())
+        Expect(store.AddorUpdateServiceAgent(sa)).ShouldNot(HaveOccurred())
+
+        pb_min, pb_max, pb, err := store.GetPortBindings(sa.DockerHost)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(pb_min).To(Equal(49000))
+        Expect(pb_max).To(Equal(49100))
+        Expect(pb).To(Equal([]int{49001}))
+
+        serviceagents, err := store.GetLiveServiceAgents()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(serviceagents).To(HaveLen(1))
+        _, err = store.GetServiceAgent("unknownhost")
+        Expect(err).To(Equal(sql.ErrNoRows))
+    })
+
+    It("should mark agents active and inactive", func() {
+        sa := testnet.NewServiceAgent()
+        Expect(store.AddServiceAgents([]brokerapi.ServiceAgent{sa})).ShouldNot(HaveOccurred())
+
+        Expect(store.MarkServiceAgentInactive(sa.DockerHost)).ShouldNot(HaveOccurred())
+        stored, err := store.GetServiceAgent(sa.DockerHost)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.IsActive).To(BeFalse())
+
+        Expect(store.MarkServiceAgentActive(sa.DockerHost)).ShouldNot(HaveOccurred())
+        stored, err = store.GetServiceAgent(sa.DockerHost)
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.IsActive).To(BeTrue())
+    })
+
+    It("should keep the catalog", func() {
+        Expect(store.AddServiceConf("admin", "admin", "My Docker Catalog")).ShouldNot(HaveOccurred())
+        Expect(store.HasServiceConf("My Docker Catalog")).To(BeTrue())
+        Expect(store.HasServiceConf("Other Catalog")).To(BeFalse())
+        id := store.GetServiceId("My Docker Catalog")
+        Expect(id).To(BeNumerically(">", 0))
+
+        services, err := store.GetServiceConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(services).To(BeEmpty())
+
+        imgdef := brokerapi.ImageDefinition{Name: "mysql", Plan: "100", Numinstances: 1, Env: []string{"MYSQL_CHARSET=utf8"}}
+        Expect(store.AddImagePlanConf(id, imgdef, "", `{"user":"admin"}`)).ShouldNot(HaveOccurred())
+        count, err := store.CountImageConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(count).To(Equal(1))
+
+        services, err = store.GetServiceConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(services).To(HaveLen(1))
+        Expect(services[0].Catalog).To(Equal("My Docker Catalog"))
+        Expect(services[0].Images).To(HaveLen(1))
+        Expect(services[0].Images[0].Env).To(Equal(imgdef.Env))
+        Expect(services[0].Images[0].Credentials).To(Equal(map[string]interface{}{"user": "admin"}))
+
+        //changing the limits of a plan replaces it
+        imgdef.Memory = 536870912
+        Expect(store.AddImagePlanConf(id, imgdef, "", `{"user":"admin"}`)).ShouldNot(HaveOccurred())
+        count, err = store.CountImageConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(count).To(Equal(1))
+        services, err = store.GetServiceConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(services[0].Images).To(HaveLen(1))
+        Expect(services[0].Images[0].Memory).To(Equal(536870912))
+
+        Expect(store.DeleteImageConf(id, "mysql", "100")).ShouldNot(HaveOccurred())
+        Expect(store.DeleteImageConf(id, "mysql", "100")).To(Equal(sql.ErrNoRows))
+        Expect(store.DeleteServiceConf(id)).ShouldNot(HaveOccurred())
+        Expect(store.HasServiceConf("My Docker Catalog")).To(BeFalse())
+    })
+
+    It("should list the plans of a catalog by image and plan", func() {
+        Expect(store.AddServiceConf("admin", "admin", "My Docker Catalog")).ShouldNot(HaveOccurred())
+        id := store.GetServiceId("My Docker Catalog")
+        for _, plan := range [][2]string{{"mysql", "200"}, {"mysql", "100"}, {"mariadb", "100"}} {
+            imgdef := brokerapi.ImageDefinition{Name: plan[0], Plan: plan[1], Numinstances: 1}
+            Expect(store.AddImagePlanConf(id, imgdef, "", "")).ShouldNot(HaveOccurred())
+        }
+
+        services, err := store.GetServiceConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(services).To(HaveLen(1))
+        plans := []string{}
+        for _, image := range services[0].Images {
+            plans = append(plans, image.Name+"_"+image.Plan)
+        }
+        Expect(plans).To(Equal([]string{"mariadb_100", "mysql_100", "mysql_200"}))
+    })
+
+    It("should keep certificates, registry credentials and users", func() {
+        Expect(store.AddBrokerCertsConf("myFakeHost", []byte("cert"), []byte("key"), []byte("ca"), "myFakeServer")).ShouldNot(HaveOccurred())
+        Expect(store.HasBrokerCerts("myFakeHost")).To(BeTrue())
+        certs, err := store.GetBrokerCerts()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(certs).To(HaveLen(1))
+        Expect(certs[0].ClientKey).To(Equal([]byte("key")))
+        Expect(store.DeleteBrokerCertsConf("myFakeHost")).ShouldNot(HaveOccurred())
+        Expect(store.HasBrokerCerts("myFakeHost")).To(BeFalse())
+
+        auth := brokerapi.RegistryAuth{Registry: "registry.example.com", Username: "fakeUser", Password: "fakePassword"}
+        Expect(store.AddRegistryAuthConf(auth)).ShouldNot(HaveOccurred())
+        Expect(store.HasRegistryAuth("registry.example.com")).To(BeTrue())
+        auths, err := store.GetRegistryAuths()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(auths).To(HaveLen(1))
+        Expect(auths[0].Password).To(Equal("fakePassword"))
+        Expect(store.DeleteRegistryAuthConf("registry.example.com")).ShouldNot(HaveOccurred())
+        Expect(store.HasRegistryAuth("registry.example.com")).To(BeFalse())
+
+        Expect(store.AddUserConf(brokerapi.BrokerUser{Name: "fakeUser", Password: "fakePassword"})).ShouldNot(HaveOccurred())
+        Expect(store.HasUser("fakeUser")).To(BeTrue())
+        users, err := store.GetUsers()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(users).To(HaveLen(1))
+        Expect(store.DeleteUserConf("fakeUser")).ShouldNot(HaveOccurred())
+        Expect(store.HasUser("fakeUser")).To(BeFalse())
+    })
+
+    It("should read the secrets back after rotating the encryption key", func() {
+        pr := brokerapi.ProvisioningRequest{InstanceId: "myFakeInstance", PlanId: "100"}
+        Expect(store.AddServiceInstance("mysql", 3306, 49153, `{"password":"fakePassword"}`, "myFakeContainer", "localhost",
+                                        "myFakeName", "mysql", pr, time.Now())).ShouldNot(HaveOccurred())
+        binding := brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "myFakeBinding",
+                                            Credentials: brokerapi.Credentials{"password": "fakePassword"}}
+        Expect(store.AddServiceBinding(binding, time.Now())).ShouldNot(HaveOccurred())
+        Expect(store.AddServiceConf("admin", "admin", "My Docker Catalog")).ShouldNot(HaveOccurred())
+        id := store.GetServiceId("My Docker Catalog")
+        Expect(store.AddImageConf(id, "mysql", "100", "", `{"password":"fakePassword"}`, 1, "")).ShouldNot(HaveOccurred())
+        Expect(store.AddBrokerCertsConf("myFakeHost", []byte("cert"), []byte("fakeKey"), []byte("ca"), "")).ShouldNot(HaveOccurred())
+        Expect(store.AddRegistryAuthConf(brokerapi.RegistryAuth{Registry: "registry.example.com", Password: "fakePassword"})).ShouldNot(HaveOccurred())
+
+        Expect(store.RotateEncryptionKey(testnet.NewEncryptionKey)).ShouldNot(HaveOccurred())
+
+        Expect(store.GetServiceUrl("myFakeInstance")).To(Equal(`{"password":"fakePassword"}`))
+        instance, err := store.GetServiceInstance("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(instance.DashboardUrl).To(BeEmpty())
+        stored, err := store.GetServiceBinding("myFakeInstance", "myFakeBinding")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(stored.Credentials).To(Equal(binding.Credentials))
+        services, err := store.GetServiceConf()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(services).To(HaveLen(1))
+        Expect(services[0].Images[0].Credentials).To(Equal(map[string]interface{}{"password": "fakePassword"}))
+        certs, err := store.GetBrokerCerts()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(certs).To(HaveLen(1))
+        Expect(certs[0].ClientKey).To(Equal([]byte("fakeKey")))
+        auths, err := store.GetRegistryAuths()
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(auths).To(HaveLen(1))
+        Expect(auths[0].Password).To(Equal("fakePassword"))
+    })
+
+    It("should return the most recent operation of an instance", func() {
+        started := time.Now()
+        Expect(store.AddOperation(brokerapi.Operation{Id: "op1", InstanceId: "myFakeInstance", Type: brokerapi.OperationProvision,
+                                  State: brokerapi.OperationSucceeded, StartedAt: started})).ShouldNot(HaveOccurred())
+        request := brokerapi.OperationRequest{PlanId: "200", Parameters: map[string]interface{}{"database": "orders"}}
+        Expect(store.AddOperation(brokerapi.Operation{Id: "op2", InstanceId: "myFakeInstance", Type: brokerapi.OperationUpdate,
+                                  State: brokerapi.OperationInProgress, StartedAt: started.Add(time.Second), Request: request})).ShouldNot(HaveOccurred())
+
+        op, err := store.GetOperation("myFakeInstance", "", "")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(op.Id).To(Equal("op2"))
+        op, err = store.GetOperation("myFakeInstance", "", "op1")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(op.State).To(Equal(brokerapi.OperationSucceeded))
+        _, err = store.GetOperation("myFakeInstance", "myFakeBinding", "")
+        Expect(err).To(Equal(sql.ErrNoRows))
+
+        Expect(store.UpdateOperation(brokerapi.Operation{Id: "op2", State: brokerapi.OperationFailed, Description: "fake failure",
+                                     UpdatedAt: started.Add(2*time.Second)})).ShouldNot(HaveOccurred())
+        op, err = store.GetOperation("myFakeInstance", "", "op2")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(op.State).To(Equal(brokerapi.OperationFailed))
+        Expect(op.Description).To(Equal("fake failure"))
+        Expect(op.Request).To(Equal(request))
+    })
+
+    It("should return the audit trail of an instance oldest first", func() {
+        now := time.Now()
+        Expect(store.AddAuditEvent(brokerapi.AuditEvent{InstanceId: "myFakeInstance", Operation: "bind", Time: now.Add(time.Second)})).ShouldNot(HaveOccurred())
+        Expect(store.AddAuditEvent(brokerapi.AuditEvent{InstanceId: "myFakeInstance", Operation: "provision", Time: now})).ShouldNot(HaveOccurred())
+        Expect(store.AddAuditEvent(brokerapi.AuditEvent{InstanceId: "otherInstance", Operation: "provision", Time: now})).ShouldNot(HaveOccurred())
+
+        events, err := store.GetAuditEvents("myFakeInstance")
+        Expect(err).ShouldNot(HaveOccurred())
+        Expect(events).To(HaveLen(2))
+        Expect(events[0].Operation).To(Equal("provision"))
+        Expect(events[1].Operation).To(Equal("bind"))
+    })
+}
+
+var _ = Describe("Store", func() {
+    Context("backed by SQL", func() {
+        storeConformance(func() brokerapi.Store {
+            store, err := brokerapi.OpenStore(testnet.NewSQLPersister())
+            Expect(err).ShouldNot(HaveOccurred())
+            return store
+        }, func(store brokerapi.Store) {
+            testnet.RemoveSQLPersister(*store.(*brokerapi.Persister))
+        })
+    })
+
+    Context("backed by BoltDB", func() {
+        var path string
+
+        storeConformance(func() brokerapi.Store {
+            file, err := ioutil.TempFile("", "broker_boltdb")
+            Expect(err).ShouldNot(HaveOccurred())
+            file.Close()
+            path = file.Name()
+            store, err := brokerapi.OpenBoltStore(path, testnet.EncryptionKey)
+            Expect(err).ShouldNot(HaveOccurred())
+            return store
+        }, func(store brokerapi.Store) {
+            store.Close()
+            os.Remove(path)
+        })
+    })
+
+    Context("in memory", func() {
+        storeConformance(func() brokerapi.Store {
+            return brokerapi.NewMemoryStore(testnet.EncryptionKey)
+        }, func(store brokerapi.Store) {
+            store.Close()
+        })
+
+        It("should be opened for the memory driver", func() {
+            opened, err := brokerapi.OpenStore(brokerapi.Persister{Driver: "memory"})
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(opened).To(BeAssignableToTypeOf(&brokerapi.MemoryStore{}))
+        })
+
+        It("should take the encryption key from the key file or the environment", func() {
+            fileKey := "ZmFrZUZpbGVLZXkuLi4uLi4uLi4uLi4uLi4uLi4uLi4="
+            envKey := "ZmFrZUVudktleS4uLi4uLi4uLi4uLi4uLi4uLi4uLi4="
+            file, err := ioutil.TempFile("", "broker_key")
+            Expect(err).ShouldNot(HaveOccurred())
+            defer os.Remove(file.Name())
+            file.WriteString(fileKey+"\n")
+            file.Close()
+
+            opened, err := brokerapi.OpenStore(brokerapi.Persister{Driver: "memory", EncryptionKey: testnet.EncryptionKey, EncryptionKeyFile: file.Name()})
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(opened.(*brokerapi.MemoryStore).EncryptionKey).To(Equal(fileKey))
+
+            os.Setenv(brokerapi.EncryptionKeyEnv, envKey)
+            defer os.Unsetenv(brokerapi.EncryptionKeyEnv)
+            opened, err = brokerapi.OpenStore(brokerapi.Persister{Driver: "memory", EncryptionKeyFile: file.Name()})
+            Expect(err).ShouldNot(HaveOccurred())
+            Expect(opened.(*brokerapi.MemoryStore).EncryptionKey).To(Equal(envKey))
+        })
+
+        It("should refuse encryption keys that are not 32 bytes in base64", func() {
+            for _,key := range []string{"my secret passphrase", "c2hvcnQga2V5"} {
+                _, err := brokerapi.OpenStore(brokerapi.Persister{Driver: "memory", EncryptionKey: key})
+                Expect(err).Should(HaveOccurred(),key)
+                Expect(err.Error()).To(ContainSubstring("32 random bytes in base64"))
+            }
+        })
+    })
+})
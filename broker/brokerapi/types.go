@@ -5,6 +5,7 @@
 package brokerapi
 
 import (
+    "reflect"
     "time"
     )
     
@@ -22,6 +23,9 @@ type BrokerService interface {
     // Removes created service instance.
     Deprovision(ProvisioningRequest) error
 
+    // Changes the plan and/or parameters of a created service instance.
+    Update(UpdateRequest) error
+
     // Binds to specified service instance.
     // Returns  credentials necessary to establish connection to this
     // service instance as well as optional syslog drain URL.
@@ -45,20 +49,43 @@ type AgentManagerInterface interface {
     Catalog() (Catalog, error)
     
     GetServiceAgent(instanceid string) (BrokerService, error)
+    GetProvisioningAgent(ProvisioningRequest) (BrokerService, error)
     
     AddImage(string,ImageDefinition) error
-    GetImage(string,string) ([]ImageDefinition,error)
-    DeleteImage(string,string) error
+    GetImage(catalog,name,plan string) ([]ImageDefinition,error)
+    DeleteImage(catalog,name,plan string) error
+
+    //instances and bindings as they were provisioned and bound
+    GetServiceInstance(instanceid string) (ServiceInstance, error)
+    GetServiceBinding(instanceid, bindingid string) (ServiceBinding, error)
+    //nil when the id is not taken yet, a conflict when it is taken with other attributes
+    ExistingServiceInstance(ProvisioningRequest) (*ServiceInstance, error)
+    ExistingServiceBinding(BindingRequest) (*ServiceBinding, error)
     
     AddCerts(BrokerCerts) error
     GetCerts(string) ([]BrokerCerts,error)
     DeleteCerts(string) error
 
+    AddRegistryAuth(RegistryAuth) error
+    GetRegistryAuths(string) ([]RegistryAuth,error)
+    DeleteRegistryAuth(string) error
+
+    AddUser(BrokerUser) error
+    GetUsers(string) ([]BrokerUser,error)
+    DeleteUser(string) error
+    AuthenticateUser(name, password string) (BrokerUser,error)
+
+    //asynchronous operations, persisted so that any broker can answer the poll
+    //request holds the attributes a repeated request has to ask for as well
+    StartOperation(instanceid, bindingid, optype string, request OperationRequest) (Operation, error)
+    FinishOperation(Operation, error) error
+    LastOperation(instanceid, bindingid, operationid string) (Operation, error)
 }
 
 type DispatcherInterface interface {
     //algorithm implementation to find best ServiceAgent for provisioning    
-    NewBrokerService() (BrokerService, error)
+    //the request is handed over so that the context of the platform can be taken into account
+    NewBrokerService(ProvisioningRequest) (BrokerService, error)
 }
 
 const (
@@ -66,6 +93,8 @@ const (
     ErrCodeConflict = 10
     // Raised by Broker Service if service instance or service instance binding cannot be found
     ErrCodeGone = 20
+    // Raised by Broker Service if the request carries invalid values
+    ErrCodeBadRequest = 30
     // Raised by Broker Service for any other issues
     ErrCodeOther = 99
 )
@@ -77,24 +106,99 @@ type BrokerServiceError interface {
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#provisioning
 type ProvisioningRequest struct {
-    InstanceId string `json:"-"`
-    ServiceId  string `json:"service_id"`
-    PlanId     string `json:"plan_id"`
-    OrgId      string `json:"organization_guid"`
-    SpaceId    string `json:"space_guid"`
+    InstanceId        string                 `json:"-"`
+    ServiceId         string                 `json:"service_id"`
+    PlanId            string                 `json:"plan_id"`
+    OrgId             string                 `json:"organization_guid"`
+    SpaceId           string                 `json:"space_guid"`
+    Parameters        map[string]interface{} `json:"parameters,omitempty"`
+    //the platform the request comes from, e.g. {"platform":"cloudfoundry","organization_guid":...}
+    Context           map[string]interface{} `json:"context,omitempty"`
+    AcceptsIncomplete bool                   `json:"-"`
+    //set when provisioning asynchronously, progress is reported into the operation
+    OperationId       string                 `json:"-"`
+    //the user of the platform that asked for the request
+    OriginatingIdentity *OriginatingIdentity `json:"-"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#updating-a-service-instance
+type UpdateRequest struct {
+    InstanceId        string                 `json:"-"`
+    ServiceId         string                 `json:"service_id"`
+    PlanId            string                 `json:"plan_id,omitempty"`
+    Parameters        map[string]interface{} `json:"parameters,omitempty"`
+    PreviousValues    struct {
+        PlanId    string `json:"plan_id,omitempty"`
+        ServiceId string `json:"service_id,omitempty"`
+        OrgId     string `json:"organization_id,omitempty"`
+        SpaceId   string `json:"space_id,omitempty"`
+    } `json:"previous_values"`
+    Context           map[string]interface{} `json:"context,omitempty"`
+    AcceptsIncomplete bool `json:"-"`
+    //set when updating asynchronously, progress is reported into the operation
+    OperationId       string `json:"-"`
+    OriginatingIdentity *OriginatingIdentity `json:"-"`
 }
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#binding
 type BindingRequest struct {
-    InstanceId string `json:"-"`
-    BindingId  string `json:"-"`
-    ServiceId  string `json:"service_id"`
-    PlanId     string `json:"plan_id"`
-    AppId      string `json:"app_guid"`
+    InstanceId        string                 `json:"-"`
+    BindingId         string                 `json:"-"`
+    ServiceId         string                 `json:"service_id"`
+    PlanId            string                 `json:"plan_id"`
+    AppId             string                 `json:"app_guid"`
+    Parameters        map[string]interface{} `json:"parameters,omitempty"`
+    Context           map[string]interface{} `json:"context,omitempty"`
+    AcceptsIncomplete bool                   `json:"-"`
+    OriginatingIdentity *OriginatingIdentity `json:"-"`
+}
+
+// Sent in the X-Broker-API-Originating-Identity header as the platform followed by its
+// base64 encoded JSON value, e.g. cloudfoundry eyJ1c2VyX2lkIjoiNjgzZWE3NDgifQ==
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/profile.md#originating-identity-header
+type OriginatingIdentity struct {
+    Platform string                 `json:"platform"`
+    Value    map[string]interface{} `json:"value"`
+}
+
+// Who did what to which instance, and binding or container, written for every lifecycle call.
+type AuditEvent struct {
+    InstanceId          string
+    BindingId           string
+    ContainerId         string
+    Operation           string
+    Context             map[string]interface{}
+    OriginatingIdentity *OriginatingIdentity
+    Time                time.Time
 }
 
 type Credentials map[string]interface{}
 
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#fetching-a-service-instance
+type ServiceInstance struct {
+    InstanceId   string                 `json:"-"`
+    ServiceId    string                 `json:"service_id"`
+    PlanId       string                 `json:"plan_id"`
+    DashboardUrl string                 `json:"dashboard_url,omitempty"`
+    Parameters   map[string]interface{} `json:"parameters,omitempty"`
+    OrgId        string                 `json:"-"`
+    SpaceId      string                 `json:"-"`
+    Context      map[string]interface{} `json:"-"`
+    OriginatingIdentity *OriginatingIdentity `json:"-"`
+}
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#fetching-a-service-binding
+type ServiceBinding struct {
+    InstanceId  string                 `json:"-"`
+    BindingId   string                 `json:"-"`
+    AppId       string                 `json:"-"`
+    Credentials Credentials            `json:"credentials"`
+    SyslogDrainUrl string              `json:"syslog_drain_url,omitempty"`
+    Parameters  map[string]interface{} `json:"parameters,omitempty"`
+    Context     map[string]interface{} `json:"-"`
+    OriginatingIdentity *OriginatingIdentity `json:"-"`
+}
+
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
 type Catalog struct {
     Services []Service `json:"services"`
@@ -102,14 +206,17 @@ type Catalog struct {
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
 type Service struct {
-    Id          string                 `json:"id"`
-    Name        string                 `json:"name"`
-    Description string                 `json:"description"`
-    Bindable    bool                   `json:"bindable"`
-    Tags        []string               `json:"tags,omitempty"`
-    Requires    []string               `json:"requires,omitempty"`
-    Plans       []Plan                 `json:"plans"`
-    Metadata    map[string]interface{} `json:"metadata,omitempty"`
+    Id             string                 `json:"id"`
+    Name           string                 `json:"name"`
+    Description    string                 `json:"description"`
+    Bindable       bool                   `json:"bindable"`
+    PlanUpdateable bool                   `json:"plan_updateable,omitempty"`
+    InstancesRetrievable bool             `json:"instances_retrievable,omitempty"`
+    BindingsRetrievable  bool             `json:"bindings_retrievable,omitempty"`
+    Tags           []string               `json:"tags,omitempty"`
+    Requires       []string               `json:"requires,omitempty"`
+    Plans          []Plan                 `json:"plans"`
+    Metadata       map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
@@ -120,6 +227,55 @@ type Plan struct {
     Metadata    map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// The only platform feature images may require, see the requires field of the catalog.
+const RequiresSyslogDrain = "syslog_drain"
+
+const (
+    OperationProvision   = "provision"
+    OperationDeprovision = "deprovision"
+    OperationUpdate      = "update"
+    OperationBind        = "bind"
+    OperationUnbind      = "unbind"
+
+    OperationInProgress = "in progress"
+    OperationSucceeded  = "succeeded"
+    OperationFailed     = "failed"
+)
+
+// See https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#polling-last-operation
+type Operation struct {
+    Id          string
+    InstanceId  string
+    BindingId   string
+    Type        string
+    State       string
+    Description string
+    StartedAt   time.Time
+    UpdatedAt   time.Time
+    Request     OperationRequest
+}
+
+// The attributes of the request that started an operation.
+type OperationRequest struct {
+    ServiceId  string                 `json:"service_id,omitempty"`
+    PlanId     string                 `json:"plan_id,omitempty"`
+    OrgId      string                 `json:"organization_guid,omitempty"`
+    SpaceId    string                 `json:"space_guid,omitempty"`
+    Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// Whether other asks for the same, no parameters equal empty ones.
+func (request OperationRequest) Matches(other OperationRequest) bool {
+    if request.ServiceId != other.ServiceId || request.PlanId != other.PlanId ||
+       request.OrgId != other.OrgId || request.SpaceId != other.SpaceId {
+        return false
+    }
+    if len(request.Parameters) == 0 && len(other.Parameters) == 0 {
+        return true
+    }
+    return reflect.DeepEqual(request.Parameters, other.Parameters)
+}
+
 // Other types
 type BrokerError struct {
     Description string `json:"description"`
@@ -142,13 +298,41 @@ type Version struct {
     GoVersion string
 }
 
+// An image is offered once per plan, all plans of an image make up one catalog service.
 type ImageDefinition struct {
     Name          string
     Plan          string
+    Description   string
     DashBoardUrl  map[string] interface{}
     Credentials   map[string] interface{}
     Numinstances  int
     Containername string
+    //container settings of the plan, memory limits are in bytes
+    Memory        int
+    MemorySwap    int
+    CpuShares     int
+    Cpuset        string
+    Env           []string
+    //tag or digest (sha256:...) of the image to run, pulled when missing on the docker host
+    Tag           string
+    Digest        string
+    //data paths of the container kept in volumes, removed on deprovision unless retained
+    Volumes       []string
+    RetainVolumes bool
+    //platform features the service needs, e.g. "syslog_drain" to have the logs of bound apps
+    //streamed to SyslogDrainUrl. The template may use $HOST and $PORT like the credentials,
+    //a "syslog_drain_url" in the output of /bind takes precedence.
+    Requires       []string
+    SyslogDrainUrl string
+}
+
+// Storage backing a data path of a service instance. Source is either a named volume
+// or, when HostPath is set, a directory on the docker host.
+type ServiceVolume struct {
+    InstanceId string
+    Path       string
+    Source     string
+    HostPath   bool
 }
 
 type ServiceDefinition struct {
@@ -173,11 +357,40 @@ type ServiceAgent struct {
     Portbindings []uint8
 }
 
+// TLS material for talking to a docker host. The host certificate is verified against CA,
+// ServerName overrides the name it is checked for when it differs from Host.
 type BrokerCerts struct {
     Host       string
     ClientCert []byte
     ClientKey  []byte
     CA         []byte
+    ServerName string
+}
+
+const (
+    // Cloud Controller, may call the service broker API under /v2
+    RoleCloudController = "cloudcontroller"
+    // Agents, may ping and manage the certificates of their own docker host
+    RoleAgent = "agent"
+    // Operators, may call everything including image, certificate, registry and user management
+    RoleAdmin = "admin"
+)
+
+// A user of the broker API. Host is the docker host of an agent.
+type BrokerUser struct {
+    Name     string
+    Password string
+    Role     string
+    Host     string
+}
+
+// Credentials for pulling images from a private registry. Registry is the host[:port]
+// the images are referred by, e.g. registry.example.com:5000/mysql.
+type RegistryAuth struct {
+    Registry string
+    Username string
+    Password string
+    Email    string
 }
 
 
@@ -11,7 +11,6 @@ mysqladmin create $newDB
 mysql -e "CREATE USER '$newUser'@'%' IDENTIFIED by '$password'"
 mysql -e "GRANT ALL PRIVILEGES ON *.* to '$newUser'@'%' WITH GRANT OPTION"
 mysql -e "FLUSH PRIVILEGES"
-mysql -u$newUser -p$password < ~/go/src/github.com/brahmaroutu/docker-broker/broker/setup.sql 
 
 /etc/init.d/mysql stop
 
@@ -1,8 +1,13 @@
 package dockerapi
 
 import (
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
     "github.com/brahmaroutu/docker-broker/broker/brokerapi"
     "log"
+    "reflect"
+    "time"
 )
 
 type AgentManager struct {
@@ -11,12 +16,11 @@ type AgentManager struct {
 }
 
 func NewAgentManager(config BrokerConfiguration, dispatcher brokerapi.DispatcherInterface) (*AgentManager, error) {
-    config.Persister.Connect()
     return &AgentManager{config, dispatcher}, nil
 }
 
 func (am *AgentManager) Ping(sa brokerapi.ServiceAgent) error {
-    err := am.config.Persister.AddorUpdateServiceAgent(sa)
+    err := am.config.Store.AddorUpdateServiceAgent(sa)
     if err != nil {
         return err
     }
@@ -27,34 +31,97 @@ func (am *AgentManager) GetServiceAgent(instanceid string) (brokerapi.BrokerServ
     var brokerservice brokerapi.BrokerService
     var err error
     if len(instanceid) == 0 {
-        //use DISPATCHER to pick the ServiceAgent from persister
-        brokerservice, err = am.Dispatcher.NewBrokerService()
-        if err != nil {
-            return nil, err
-        }
+        return am.GetProvisioningAgent(brokerapi.ProvisioningRequest{})
     } else {
         //look for service agent that holds this instance
-        serviceagent, err := am.config.Persister.GetServiceAgentFromInstance("cf_instance_id='" + instanceid + "'")
-        log.Println("GetServiceAgentFromInstance cf_instance_id='" + instanceid + "'",serviceagent)
+        serviceagent, err := am.config.Store.GetServiceAgentFromInstance(instanceid)
+        log.Println("GetServiceAgentFromInstance",instanceid,serviceagent)
         if err != nil {
             return nil, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone,"Failed to find the service instance ("+err.Error()+")"})
         }
-        serviceagents, err := am.config.Persister.GetServiceAgentList("docker_host='" + serviceagent + "'")
-        log.Println("GetServiceAgentList host='" + serviceagent + "'",serviceagents)
-        if len(serviceagents) == 0 {
+        sa, err := am.config.Store.GetServiceAgent(serviceagent)
+        log.Println("GetServiceAgent",serviceagent,sa)
+        if err == sql.ErrNoRows {
             return nil, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Handler: can't find agent - assume its already gone"})
         }
         if err != nil {
             return nil, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, err.Error()})
         }
 
-        brokerservice, err = NewDockerClient(serviceagents[0],am.config)
+        dockerclient, err := NewDockerClient(sa,am.config)
+        if err != nil {
+            return nil, err
+        }
+        brokerservice = dockerclient
     }
 
     //handler should recycle this dockerclient, may be we should deref at the end of handler code ot simply call obj.close()?
     return brokerservice, err
 }
 
+// Picks the ServiceAgent a new instance is provisioned on.
+func (am *AgentManager) GetProvisioningAgent(pr brokerapi.ProvisioningRequest) (brokerapi.BrokerService, error) {
+    //use DISPATCHER to pick the ServiceAgent from persister
+    return am.Dispatcher.NewBrokerService(pr)
+}
+
+func (am *AgentManager) GetServiceInstance(instanceid string) (brokerapi.ServiceInstance, error) {
+    instance, err := am.config.Store.GetServiceInstance(instanceid)
+    if err == sql.ErrNoRows {
+        return instance, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Failed to find the service instance "+instanceid})
+    }
+    return instance, err
+}
+
+func (am *AgentManager) GetServiceBinding(instanceid, bindingid string) (brokerapi.ServiceBinding, error) {
+    binding, err := am.config.Store.GetServiceBinding(instanceid, bindingid)
+    if err == sql.ErrNoRows {
+        return binding, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Failed to find the service binding "+bindingid})
+    }
+    return binding, err
+}
+
+// Provisioning is idempotent, the instance is returned when it was provisioned with the same
+// attributes before and a conflict is reported when its id was used for something else.
+func (am *AgentManager) ExistingServiceInstance(pr brokerapi.ProvisioningRequest) (*brokerapi.ServiceInstance, error) {
+    instance, err := am.config.Store.GetServiceInstance(pr.InstanceId)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if instance.ServiceId != pr.ServiceId || instance.PlanId != pr.PlanId || instance.OrgId != pr.OrgId ||
+       instance.SpaceId != pr.SpaceId || !sameParameters(instance.Parameters, pr.Parameters) {
+        return nil, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeConflict,
+                             "Service instance "+pr.InstanceId+" already exists with different attributes"})
+    }
+    return &instance, nil
+}
+
+func (am *AgentManager) ExistingServiceBinding(br brokerapi.BindingRequest) (*brokerapi.ServiceBinding, error) {
+    binding, err := am.config.Store.GetServiceBinding(br.InstanceId, br.BindingId)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if binding.AppId != br.AppId || !sameParameters(binding.Parameters, br.Parameters) {
+        return nil, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeConflict,
+                             "Service binding "+br.BindingId+" already exists with different attributes"})
+    }
+    return &binding, nil
+}
+
+// Parameters are compared as they were decoded from JSON, no parameters equal empty ones.
+func sameParameters(stored, requested map[string]interface{}) bool {
+    if len(stored) == 0 && len(requested) == 0 {
+        return true
+    }
+    return reflect.DeepEqual(stored, requested)
+}
+
 func (am *AgentManager) Catalog() (brokerapi.Catalog, error) {
     return brokerapi.Catalog{am.config.GetServices()}, nil
 }
@@ -63,12 +130,12 @@ func (am *AgentManager) AddImage(catalog string, img brokerapi.ImageDefinition)
     return am.config.AddOrUpdateImageDefinition(catalog,img)
 }
 
-func (am *AgentManager) GetImage(catalog,name string) ([]brokerapi.ImageDefinition,error) {
-    return am.config.GetImageDefinitions(name)
+func (am *AgentManager) GetImage(catalog,name,plan string) ([]brokerapi.ImageDefinition,error) {
+    return am.config.GetImageDefinitions(name,plan)
 }
 
-func (am *AgentManager) DeleteImage(catalog,name string) error {
-    return am.config.DeleteImageDefinition(catalog,name)
+func (am *AgentManager) DeleteImage(catalog,name,plan string) error {
+    return am.config.DeleteImageDefinition(catalog,name,plan)
 }
 
 func (am *AgentManager) AddCerts(certs brokerapi.BrokerCerts) error {
@@ -82,3 +149,75 @@ func (am *AgentManager) GetCerts(host string) ([]brokerapi.BrokerCerts, error) {
 func (am *AgentManager) DeleteCerts(host string) error {
     return am.config.DeleteCertificate(host)
 }
+
+func (am *AgentManager) AddRegistryAuth(auth brokerapi.RegistryAuth) error {
+    return am.config.AddOrUpdateRegistryAuth(auth)
+}
+
+func (am *AgentManager) GetRegistryAuths(registry string) ([]brokerapi.RegistryAuth, error) {
+    return am.config.GetRegistryAuths(registry)
+}
+
+func (am *AgentManager) DeleteRegistryAuth(registry string) error {
+    return am.config.DeleteRegistryAuth(registry)
+}
+
+func (am *AgentManager) AddUser(user brokerapi.BrokerUser) error {
+    return am.config.AddOrUpdateUser(user)
+}
+
+func (am *AgentManager) GetUsers(name string) ([]brokerapi.BrokerUser, error) {
+    return am.config.GetUsers(name)
+}
+
+func (am *AgentManager) DeleteUser(name string) error {
+    return am.config.DeleteUser(name)
+}
+
+func (am *AgentManager) AuthenticateUser(name, password string) (brokerapi.BrokerUser, error) {
+    return am.config.AuthenticateUser(name, password)
+}
+
+func (am *AgentManager) StartOperation(instanceid, bindingid, optype string, request brokerapi.OperationRequest) (brokerapi.Operation, error) {
+    opid, err := newOperationId()
+    if err != nil {
+        return brokerapi.Operation{}, err
+    }
+    now := time.Now()
+    op := brokerapi.Operation{Id: opid, InstanceId: instanceid, BindingId: bindingid, Type: optype,
+                              State: brokerapi.OperationInProgress, StartedAt: now, UpdatedAt: now, Request: request}
+    err = am.config.Store.AddOperation(op)
+    return op, err
+}
+
+func (am *AgentManager) FinishOperation(op brokerapi.Operation, err error) error {
+    if err != nil {
+        log.Println("Operation ",op.Type," failed for ",op.InstanceId," : ",err)
+        op.State = brokerapi.OperationFailed
+        op.Description = err.Error()
+    } else {
+        op.State = brokerapi.OperationSucceeded
+        op.Description = ""
+    }
+    op.UpdatedAt = time.Now()
+    return am.config.Store.UpdateOperation(op)
+}
+
+func (am *AgentManager) LastOperation(instanceid, bindingid, operationid string) (brokerapi.Operation, error) {
+    op, err := am.config.Store.GetOperation(instanceid, bindingid, operationid)
+    if err == sql.ErrNoRows {
+        return op, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Failed to find the operation ("+err.Error()+")"})
+    }
+    if err != nil {
+        return op, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Failed to read the operation ("+err.Error()+")"})
+    }
+    return op, nil
+}
+
+func newOperationId() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
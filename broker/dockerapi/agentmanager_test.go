@@ -13,14 +13,13 @@ import (
 )
 
 var _ = Describe("Agentmanager", func() {
-    var persister brokerapi.Persister
+    var persister brokerapi.Store
     var am *dockerapi.AgentManager
     var dockerServices []brokerapi.Service
     var cm dockerapi.BrokerConfiguration
     var err error
     JustBeforeEach(func() {
-        persister = testnet.NewPersister()
-        persister.Connect()
+        persister = testnet.NewStore()
         cm = testnet.BrokerConfiguration()
 
         dispatcher := testnet.SimpleDispatcher()
@@ -32,11 +31,8 @@ var _ = Describe("Agentmanager", func() {
     })
     
     Describe("brokertest test simpledispatcher", func() {
-        BeforeEach(func() {        
-            testnet.SetupSQL(persister)
-        })
         AfterEach(func() {
-            testnet.CleanupSQL(persister)
+            testnet.CleanupStore()
         })
 
         It("able to receive a ping", func() {
@@ -117,6 +113,172 @@ var _ = Describe("Agentmanager", func() {
         })
         
         
+        It("should record the outcome of an operation", func() {
+            request := brokerapi.OperationRequest{ServiceId: "mysql", PlanId: "100", Parameters: map[string]interface{}{"database":"orders"}}
+            op,err := am.StartOperation("myFakeInstance", "", brokerapi.OperationProvision, request)
+            Expect(err).To(BeNil())
+            Expect(op.Id).ShouldNot(BeEmpty())
+
+            last,err := am.LastOperation("myFakeInstance", "", op.Id)
+            Expect(err).To(BeNil())
+            Expect(last.State).To(Equal(brokerapi.OperationInProgress))
+            Expect(last.Request).To(Equal(request))
+
+            err = am.FinishOperation(op, errors.New("container failed to start"))
+            Expect(err).To(BeNil())
+
+            last,err = am.LastOperation("myFakeInstance", "", "")
+            Expect(err).To(BeNil())
+            Expect(last.Id).To(Equal(op.Id))
+            Expect(last.State).To(Equal(brokerapi.OperationFailed))
+            Expect(last.Description).To(Equal("container failed to start"))
+        })
+
+        It("should keep binding operations apart from instance operations", func() {
+            op,err := am.StartOperation("myFakeInstance", "fakeBindId", brokerapi.OperationUnbind, brokerapi.OperationRequest{})
+            Expect(err).To(BeNil())
+
+            last,err := am.LastOperation("myFakeInstance", "fakeBindId", "")
+            Expect(err).To(BeNil())
+            Expect(last.Id).To(Equal(op.Id))
+            Expect(last.BindingId).To(Equal("fakeBindId"))
+
+            _,err = am.LastOperation("myFakeInstance", "", "")
+            Expect(err).ShouldNot(BeNil())
+        })
+
+        It("fails to return an operation for an unknown instance", func() {
+            _,err = am.LastOperation("myFakeInstance", "", "")
+            Expect(err).Should(BeAssignableToTypeOf(&dockerapi.CFError{}))
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeGone))
+        })
+
+        It("fails with an internal error when the operations cannot be read", func() {
+            //the tables of the store are never created
+            store := testnet.NewSQLPersister()
+            Expect(store.Connect()).ShouldNot(HaveOccurred())
+            defer testnet.RemoveSQLPersister(store)
+            config := testnet.BrokerConfiguration()
+            config.Store = &store
+            am,err = dockerapi.NewAgentManager(config,testnet.SimpleDispatcher())
+            Expect(err).ShouldNot(HaveOccurred())
+
+            _,err = am.LastOperation("myFakeInstance", "", "")
+            Expect(err).Should(BeAssignableToTypeOf(&dockerapi.CFError{}))
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeOther))
+        })
+
+        It("should offer all plans of an image as one service", func() {
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "200", Description: "large mysql",
+                                  Numinstances: 1, Memory: 536870912, MemorySwap: 1073741824, CpuShares: 512, Cpuset: "0-1",
+                                  Env: []string{"MYSQL_CHARSET=utf8"}})
+            Expect(err).To(BeNil())
+
+            catalog,err := am.Catalog()
+            Expect(err).To(BeNil())
+            Expect(catalog.Services).Should(HaveLen(len(dockerServices)))
+            for _,service := range catalog.Services {
+                if service.Name == "mysql" {
+                    Expect(service.Plans).Should(HaveLen(2))
+                    Expect(service.Plans[1].Id).To(Equal("mysql_200"))
+                    Expect(service.Plans[1].Description).To(Equal("large mysql"))
+                    Expect(service.Plans[1].Metadata["bullets"]).To(Equal([]string{"512MB memory", "1024MB memory and swap", "512 CPU shares", "CPUs 0-1"}))
+                    Expect(service.Plans[0].Metadata).To(BeNil())
+                }
+            }
+
+            images,err := am.GetImage("My Docker Catalog","mysql","200")
+            Expect(err).To(BeNil())
+            Expect(images).Should(HaveLen(1))
+            Expect(images[0].Memory).To(Equal(536870912))
+            Expect(images[0].MemorySwap).To(Equal(1073741824))
+            Expect(images[0].CpuShares).To(Equal(512))
+            Expect(images[0].Cpuset).To(Equal("0-1"))
+            Expect(images[0].Env).To(Equal([]string{"MYSQL_CHARSET=utf8"}))
+
+            err = am.DeleteImage("My Docker Catalog","mysql","")
+            Expect(err).ShouldNot(BeNil())
+            err = am.DeleteImage("My Docker Catalog","mysql","200")
+            Expect(err).To(BeNil())
+        })
+
+        It("should change the limits of an existing plan", func() {
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "200", Numinstances: 1, Memory: 536870912})
+            Expect(err).To(BeNil())
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "200", Numinstances: 1, Memory: 1073741824, CpuShares: 256})
+            Expect(err).To(BeNil())
+
+            images,err := am.GetImage("My Docker Catalog","mysql","200")
+            Expect(err).To(BeNil())
+            Expect(images).Should(HaveLen(1))
+            Expect(images[0].Memory).To(Equal(1073741824))
+            Expect(images[0].CpuShares).To(Equal(256))
+
+            //brokers holding a copy of the configuration see the change as well
+            Expect(cm.GetImageDefinitionForPlan("mysql","200").Memory).To(Equal(1073741824))
+        })
+
+        It("should refuse invalid resource limits", func() {
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1, Memory: 1024})
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeBadRequest))
+
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1,
+                                  Memory: 536870912, MemorySwap: 1024})
+            Expect(err).ShouldNot(BeNil())
+
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1, Cpuset: "0-1;2"})
+            Expect(err).ShouldNot(BeNil())
+
+            _,err = am.GetImage("My Docker Catalog","mysql","300")
+            Expect(err).ShouldNot(BeNil())
+        })
+
+        It("should offer log draining for images requiring it", func() {
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1,
+                                  SyslogDrainUrl: "syslog://$HOST:514"})
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeBadRequest))
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1,
+                                  Requires: []string{"route_forwarding"}})
+            Expect(err).ShouldNot(BeNil())
+
+            err = am.AddImage("My Docker Catalog", brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1,
+                                  Requires: []string{brokerapi.RequiresSyslogDrain}, SyslogDrainUrl: "syslog://$HOST:514"})
+            Expect(err).To(BeNil())
+
+            catalog,err := am.Catalog()
+            Expect(err).To(BeNil())
+            for _,service := range catalog.Services {
+                if service.Name == "mysql" {
+                    Expect(service.Requires).To(Equal([]string{brokerapi.RequiresSyslogDrain}))
+                } else {
+                    Expect(service.Requires).To(BeEmpty())
+                }
+            }
+            images,err := am.GetImage("My Docker Catalog","mysql","300")
+            Expect(err).To(BeNil())
+            Expect(images[0].SyslogDrainUrl).To(Equal("syslog://$HOST:514"))
+        })
+
+        It("should keep registry credentials without handing out passwords", func() {
+            err = am.AddRegistryAuth(brokerapi.RegistryAuth{Registry: "registry.example.com:5000", Username: "dev", Password: "secret"})
+            Expect(err).To(BeNil())
+            err = am.AddRegistryAuth(brokerapi.RegistryAuth{Registry: "registry.example.com:5000", Username: "ops", Password: "secret2"})
+            Expect(err).To(BeNil())
+
+            auths,err := am.GetRegistryAuths("registry.example.com:5000")
+            Expect(err).To(BeNil())
+            Expect(auths).To(Equal([]brokerapi.RegistryAuth{brokerapi.RegistryAuth{Registry: "registry.example.com:5000", Username: "ops", Password: "********"}}))
+            Expect(cm.GetRegistryAuth("registry.example.com:5000").Password).To(Equal("secret2"))
+
+            err = am.DeleteRegistryAuth("registry.example.com:5000")
+            Expect(err).To(BeNil())
+            _,err = am.GetRegistryAuths("registry.example.com:5000")
+            Expect(err).ShouldNot(BeNil())
+            Expect(cm.GetRegistryAuth("registry.example.com:5000")).To(BeNil())
+        })
+
         It("should return a catalog list", func() {
             catalog,err := am.Catalog()
             Expect(err).To(BeNil())
@@ -8,19 +8,75 @@ import (
     "os"
     "strconv"
     "errors"
+    "regexp"
+    "strings"
+    "golang.org/x/crypto/bcrypt"
 )
 
+//smallest memory limit docker accepts
+const minMemory = 4*1024*1024
+
 type BrokerConfiguration struct {
     Services     brokerapi.ServiceDefinition
     Persister    brokerapi.Persister
+    //opened from Persister
+    Store        brokerapi.Store `json:"-"`
     ListenIP     string
     Port         int
     Dispatcher   string
     BrokerCerts  []brokerapi.BrokerCerts
+    //directory on the docker hosts to keep service volumes in, named volumes are used when empty
+    VolumeRoot   string
+    //PEM files to serve the broker API over HTTPS, agents may authenticate with certificates of ClientCAFile
+    CertFile     string
+    KeyFile      string
+    ClientCAFile string
 }
 
 
 func  NewConfiguration(configFile string) (*BrokerConfiguration, error) {
+    cm,err := readConfiguration(configFile)
+    if err != nil {
+        return nil,err
+    }
+    
+    // if DB has config, we will replace configuration from DB, 
+    // else we write this as our first conf to DB.
+    if count,_ := cm.Store.CountImageConf(); count > 0 {
+        log.Printf("Using existing config from DB")
+        cm.readConfigFromDB()
+    } else {
+        log.Printf("Using config file to populate config in DB");
+        cm.writeConfigToDB()
+    }
+    return cm,err    
+}
+
+// Brings the schema of the persister in the config file up to date without starting the broker.
+func MigrateSchema(configFile string) error {
+    cm,err := readConfiguration(configFile)
+    if err != nil {
+        return err
+    }
+    defer cm.Store.Close()
+    return nil
+}
+
+// Seals the secrets kept by the persister in the config file with newKey instead of its current
+// master key. The broker has to be given newKey afterwards.
+func RotateEncryptionKey(configFile, newKey string) error {
+    if err := brokerapi.ValidateEncryptionKey(newKey); err != nil {
+        return err
+    }
+    cm,err := readConfiguration(configFile)
+    if err != nil {
+        return err
+    }
+    defer cm.Store.Close()
+    return cm.Store.RotateEncryptionKey(newKey)
+}
+
+func readConfiguration(configFile string) (*BrokerConfiguration, error) {
     if _, err := os.Stat(configFile); os.IsNotExist(err) {
         log.Printf("Config file does not exist '%v': %v\n", configFile, err)
         return nil,err
@@ -39,22 +95,16 @@ func  NewConfiguration(configFile string) (*BrokerConfiguration, error) {
         return nil,err
     }
     
-    cm.Persister.Connect()
-    
-    // if DB has config, we will replace configuration from DB, 
-    // else we write this as our first conf to DB.
-    if cm.Persister.HasEntry("imageconfigurations","") {
-        log.Printf("Using existing config from DB")
-        cm.readConfigFromDB()
-    } else {
-        log.Printf("Using config file to populate config in DB");
-        cm.writeConfigToDB()
+    cm.Store,err = brokerapi.OpenStore(cm.Persister)
+    if err != nil {
+        log.Println("Cannot open the store:", err)
+        return nil,err
     }
-    return &cm,err    
+    return &cm,nil
 }
 
 func (cm *BrokerConfiguration) readConfigFromDB() error {
-    services,err := cm.Persister.GetServiceConf()
+    services,err := cm.Store.GetServiceConf()
     if err != nil {
         return err
     }
@@ -62,7 +112,7 @@ func (cm *BrokerConfiguration) readConfigFromDB() error {
     log.Println("Updating services with ",services[0])
     cm.Services = services[0]
         
-    brokercerts,err := cm.Persister.GetBrokerCerts()
+    brokercerts,err := cm.Store.GetBrokerCerts()
     if err != nil {
         return err
     }
@@ -79,13 +129,13 @@ func (cm *BrokerConfiguration) writeConfigToDB() error {
 
 func (cm *BrokerConfiguration) writeServiceConf() error {
     service := cm.Services
-    if !cm.Persister.HasEntry("serviceconfigurations","catalog='"+service.Catalog+"'") {
-        err := cm.Persister.AddServiceConf(service.User,service.Password,service.Catalog)
+    if !cm.Store.HasServiceConf(service.Catalog) {
+        err := cm.Store.AddServiceConf(service.User,service.Password,service.Catalog)
         if err != nil {
             log.Println("Error writing ",service," Error:",err)
         }
     }
-    id := cm.Persister.GetServiceId(service.Catalog)
+    id := cm.Store.GetServiceId(service.Catalog)
     for _,imgdef := range service.Images {
         err := cm.writeImageConf(id,imgdef)
         if err != nil {
@@ -124,10 +174,75 @@ func (cm *BrokerConfiguration) MarshalImageMaps(imgdef brokerapi.ImageDefinition
     return dashurl,credentials,err
 }
 
+var cpusetPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+var digestPattern = regexp.MustCompile(`^[a-z0-9]+:[a-f0-9]{32,}$`)
+
+// Checks the resource limits of a plan before they are handed to docker.
+func validateImageDefinition(imgdef brokerapi.ImageDefinition) error {
+    invalid := func(msg string) error {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "Plan "+imgdef.Plan+" of "+imgdef.Name+": "+msg})
+    }
+    if len(imgdef.Name) == 0 || len(imgdef.Plan) == 0 {
+        return invalid("Name and Plan are required")
+    }
+    if imgdef.Memory < 0 || (imgdef.Memory > 0 && imgdef.Memory < minMemory) {
+        return invalid("Memory must be 0 (unlimited) or at least "+strconv.Itoa(minMemory)+" bytes")
+    }
+    if imgdef.MemorySwap < -1 || (imgdef.MemorySwap > 0 && imgdef.MemorySwap < imgdef.Memory) {
+        return invalid("MemorySwap must be -1 (unlimited swap), 0 or at least Memory")
+    }
+    if imgdef.MemorySwap > 0 && imgdef.Memory == 0 {
+        return invalid("MemorySwap requires Memory to be set")
+    }
+    if imgdef.CpuShares < 0 {
+        return invalid("CpuShares cannot be negative")
+    }
+    if len(imgdef.Cpuset) > 0 && !cpusetPattern.MatchString(imgdef.Cpuset) {
+        return invalid("Cpuset must be a list of cpus or cpu ranges such as 0-2,4")
+    }
+    if len(imgdef.Tag) > 0 && !tagPattern.MatchString(imgdef.Tag) {
+        return invalid("Tag "+imgdef.Tag+" is not a valid image tag")
+    }
+    if len(imgdef.Digest) > 0 && !digestPattern.MatchString(imgdef.Digest) {
+        return invalid("Digest must look like sha256:<hex>")
+    }
+    paths := make(map[string] bool)
+    for _, path := range imgdef.Volumes {
+        if !strings.HasPrefix(path,"/") || strings.Contains(path,":") || paths[path] {
+            return invalid("Volumes must be distinct absolute paths, got "+path)
+        }
+        paths[path] = true
+    }
+    for _, feature := range imgdef.Requires {
+        if feature != brokerapi.RequiresSyslogDrain {
+            return invalid("Requires may only contain "+brokerapi.RequiresSyslogDrain+", got "+feature)
+        }
+    }
+    if len(imgdef.SyslogDrainUrl) > 0 && !requiresSyslogDrain(&imgdef) {
+        return invalid("SyslogDrainUrl requires "+brokerapi.RequiresSyslogDrain)
+    }
+    return nil
+}
+
+func requiresSyslogDrain(imgdef *brokerapi.ImageDefinition) bool {
+    for _, feature := range imgdef.Requires {
+        if feature == brokerapi.RequiresSyslogDrain {
+            return true
+        }
+    }
+    return false
+}
+
 func (cm *BrokerConfiguration) writeImageConf(service_id int, imgdef brokerapi.ImageDefinition) error {
+    if err := validateImageDefinition(imgdef); err != nil {
+        return err
+    }
     dashurl,credentials,err := cm.MarshalImageMaps(imgdef)
-     
-    err = cm.Persister.AddImageConf(service_id,imgdef.Name,imgdef.Plan,dashurl, credentials,imgdef.Numinstances,imgdef.Containername)
+    if err != nil {
+        return err
+    }
+    err = cm.Store.AddImagePlanConf(service_id,imgdef,dashurl,credentials)
     return err
 }
 
@@ -141,6 +256,9 @@ func (cm *BrokerConfiguration) GetOpts() brokerapi.Options {
         LogFile:  "",
         Trace:    false,
         PidFile:  "",
+        CertFile:     cm.CertFile,
+        KeyFile:      cm.KeyFile,
+        ClientCAFile: cm.ClientCAFile,
     }
  
     if host := os.Getenv("VCAP_APP_HOST"); host != "" {
@@ -153,22 +271,47 @@ func (cm *BrokerConfiguration) GetOpts() brokerapi.Options {
     return opts
 }
 
+// All plans of an image are offered as one service, services and plans keep the order of the configuration.
 func (cm *BrokerConfiguration) GetServices() []brokerapi.Service {
-    dockerServices := make([]brokerapi.Service, len(cm.Services.Images))
-    for i, image := range cm.Services.Images {
-        dockerServices[i] = brokerapi.Service{
+    cm.refreshImageDefinitions()
+    dockerServices := []brokerapi.Service{}
+    index := make(map[string] int)
+    for _, image := range cm.Services.Images {
+        description := image.Description
+        if len(description) == 0 {
+            description = "Service plan"
+        }
+        plan := brokerapi.Plan{
+            Id:          image.Name + "_" + image.Plan,
+            Name:        image.Plan,
+            Description: description,
+            Metadata:    planMetadata(image),
+        }
+        log.Printf("  Name: %v Plan: %v", image.Name, image.Plan)
+        //the catalog only knows requirements of services, a plan draining logs needs them for all
+        var requires []string
+        if requiresSyslogDrain(&image) {
+            requires = []string{brokerapi.RequiresSyslogDrain}
+        }
+        if i,ok := index[image.Name]; ok {
+            dockerServices[i].Plans = append(dockerServices[i].Plans, plan)
+            if len(requires) > 0 {
+                dockerServices[i].Requires = requires
+            }
+            continue
+        }
+        index[image.Name] = len(dockerServices)
+        dockerServices = append(dockerServices, brokerapi.Service{
             Id:          image.Name,
             Name:        image.Name,
             Description: image.Name + " docker service",
             Bindable:    true,
+            PlanUpdateable: true,
+            InstancesRetrievable: true,
+            BindingsRetrievable: true,
             Tags:        []string{"docker"},
-            Plans: []brokerapi.Plan{
-                brokerapi.Plan{
-                    Id:          image.Name + "_" + image.Plan,
-                    Name:        image.Plan,
-                    Description: "Service plan",
-                },
-            },
+            Requires:    requires,
+            Plans:       []brokerapi.Plan{plan},
             Metadata: map[string]interface{}{
                 "displayName":         "docker image",
                 "imageUrl":            nil,
@@ -176,16 +319,51 @@ func (cm *BrokerConfiguration) GetServices() []brokerapi.Service {
                 "providerDisplayName": "docker",
                 "documentationUrl":    nil,
                 "supportUrl":          nil},
-        }
-        log.Printf("  Name: %v Plan: %v", image.Name, image.Plan)
+        })
     }
     return dockerServices
 }
 
-func (cm *BrokerConfiguration) GetImageDefinition(imagename string) *brokerapi.ImageDefinition {
-    if count,_:= cm.Persister.GetCount("imageconfigurations",""); int32(len(cm.Services.Images)) != count {
-        cm.readConfigFromDB()
+// Tells users what a plan buys them, plans without limits carry no metadata.
+func planMetadata(image brokerapi.ImageDefinition) map[string]interface{} {
+    bullets := []string{}
+    if image.Memory > 0 {
+        bullets = append(bullets, strconv.Itoa(image.Memory/(1024*1024))+"MB memory")
     }
+    if image.MemorySwap > 0 {
+        bullets = append(bullets, strconv.Itoa(image.MemorySwap/(1024*1024))+"MB memory and swap")
+    }
+    if image.CpuShares > 0 {
+        bullets = append(bullets, strconv.Itoa(image.CpuShares)+" CPU shares")
+    }
+    if len(image.Cpuset) > 0 {
+        bullets = append(bullets, "CPUs "+image.Cpuset)
+    }
+    if len(bullets) == 0 {
+        return nil
+    }
+    return map[string]interface{}{
+        "displayName": image.Plan,
+        "bullets":     bullets,
+        "memory":      image.Memory,
+        "memory_swap": image.MemorySwap,
+        "cpu_shares":  image.CpuShares,
+        "cpuset":      image.Cpuset,
+    }
+}
+
+// Other brokers may have added, changed or removed image definitions through the REST API, the
+// number of plans does not tell whether their limits changed.
+func (cm *BrokerConfiguration) refreshImageDefinitions() {
+    services,err := cm.Store.GetServiceConf()
+    if err != nil || len(services) == 0 {
+        return
+    }
+    cm.Services.Images = services[0].Images
+}
+
+func (cm *BrokerConfiguration) GetImageDefinition(imagename string) *brokerapi.ImageDefinition {
+    cm.refreshImageDefinitions()
     for _, image := range cm.Services.Images {
         if image.Name == imagename {
             return &image
@@ -194,42 +372,86 @@ func (cm *BrokerConfiguration) GetImageDefinition(imagename string) *brokerapi.I
     return nil    
 }
 
+// Plans are referred to either by their name or by their catalog id (<image>_<plan>).
+func (cm *BrokerConfiguration) GetImageDefinitionForPlan(imagename, planid string) *brokerapi.ImageDefinition {
+    cm.refreshImageDefinitions()
+    for _, image := range cm.Services.Images {
+        if image.Name == imagename && (image.Plan == planid || image.Name+"_"+image.Plan == planid) {
+            return &image
+        }
+    }
+    return nil
+}
+
 func (cm *BrokerConfiguration) AddOrUpdateImageDefinition(catalog string, img brokerapi.ImageDefinition) error {
-    service_id := cm.Persister.GetServiceId(catalog)
+    service_id := cm.Store.GetServiceId(catalog)
     if service_id < 0 {
         return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Catalog is not Supported from the client"})
     }        
-    return cm.writeImageConf(service_id, img)
+    if err := cm.writeImageConf(service_id, img); err != nil {
+        return err
+    }
+    //copies of the configuration may still read the old slice
+    images := append([]brokerapi.ImageDefinition{}, cm.Services.Images...)
+    for i, image := range images {
+        if image.Name == img.Name && image.Plan == img.Plan {
+            images[i] = img
+            cm.Services.Images = images
+            return nil
+        }
+    }
+    cm.Services.Images = append(images, img)
+    return nil
 }
 
-func (cm *BrokerConfiguration) GetImageDefinitions(name string) ([]brokerapi.ImageDefinition, error) {
-    if len(name)>0 {
-        return []brokerapi.ImageDefinition{*cm.GetImageDefinition(name)},nil
-    }    
-    return cm.Services.Images,nil
-    
+// Returns all plans of the image, or only the given plan.
+func (cm *BrokerConfiguration) GetImageDefinitions(name,plan string) ([]brokerapi.ImageDefinition, error) {
+    cm.refreshImageDefinitions()
+    if len(name) == 0 {
+        return cm.Services.Images,nil
+    }
+    images := []brokerapi.ImageDefinition{}
+    for _, image := range cm.Services.Images {
+        if image.Name == name && (len(plan) == 0 || image.Plan == plan || image.Name+"_"+image.Plan == plan) {
+            images = append(images,image)
+        }
+    }
+    if len(images) == 0 {
+        return nil,brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Cannot find image "+name+" "+plan})
+    }
+    return images,nil
 }
 
-func (cm *BrokerConfiguration) DeleteImageDefinition(catalog,name string) error {
-    service_id := cm.Persister.GetServiceId(catalog)
-    image := cm.GetImageDefinition(name)
-    if len(catalog)==0 || len(name)==0 || image==nil {
+// The plan can only be left out if the image has a single plan.
+func (cm *BrokerConfiguration) DeleteImageDefinition(catalog,name,plan string) error {
+    service_id := cm.Store.GetServiceId(catalog)
+    if len(catalog)==0 || len(name)==0 {
         return errors.New("Cannot find image "+name+" to delete")
     }
+    images,err := cm.GetImageDefinitions(name,plan)
+    if err != nil {
+        return errors.New("Cannot find image "+name+" to delete")
+    }
+    if len(images) > 1 {
+        return errors.New("Image "+name+" has more than one plan, specify the plan to delete")
+    }
     
-    return cm.Persister.DeleteImageConf(service_id,name,image.Plan)
+    return cm.Store.DeleteImageConf(service_id,name,images[0].Plan)
 }
 
 func (cm *BrokerConfiguration) AddOrUpdateCertificates(certs brokerapi.BrokerCerts) error {
-    if cm.Persister.HasEntry("brokercertificates","serviceagent='"+certs.Host+"'") {
+    if cm.Store.HasBrokerCerts(certs.Host) {
         return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Certificate Exists for this host"+certs.Host})
     }
-    return cm.Persister.AddBrokerCertsConf(certs.Host,certs.ClientCert,certs.ClientKey,certs.CA)
+    if _,err := newTLSConfig(certs.ClientCert,certs.ClientKey,certs.CA,certs.ServerName); err != nil {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "Invalid certificates for host "+certs.Host+" ("+err.Error()+")"})
+    }
+    return cm.Store.AddBrokerCertsConf(certs.Host,certs.ClientCert,certs.ClientKey,certs.CA,certs.ServerName)
 }
 
 func (cm *BrokerConfiguration) GetCertificates(name string) ([]brokerapi.BrokerCerts, error) {
     var err error
-    cm.BrokerCerts,err = cm.Persister.GetBrokerCerts()
+    cm.BrokerCerts,err = cm.Store.GetBrokerCerts()
     if err != nil {
         log.Println("Failed to obtain certs ",err)
     }
@@ -256,16 +478,158 @@ func (cm *BrokerConfiguration) maskcerts(certs []brokerapi.BrokerCerts) []broker
 }
 
 func (cm *BrokerConfiguration) DeleteCertificate(name string) error {
-    if len(name)==0 || !cm.Persister.HasEntry("brokercertificates","serviceagent='"+name+"'") {
+    if len(name)==0 || !cm.Store.HasBrokerCerts(name) {
         return errors.New("Cannot find certificate "+name+" to delete")
     }
     
-    return cm.Persister.DeleteBrokerCertsConf(name)
+    return cm.Store.DeleteBrokerCertsConf(name)
 }
 
 
+// Credentials of a registry are replaced when they are added again.
+func (cm *BrokerConfiguration) AddOrUpdateRegistryAuth(auth brokerapi.RegistryAuth) error {
+    if len(auth.Registry) == 0 || len(auth.Username) == 0 {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "Registry and Username are required"})
+    }
+    if cm.Store.HasRegistryAuth(auth.Registry) {
+        if err := cm.Store.DeleteRegistryAuthConf(auth.Registry); err != nil {
+            return err
+        }
+    }
+    return cm.Store.AddRegistryAuthConf(auth)
+}
+
+// Passwords never leave the broker.
+func (cm *BrokerConfiguration) GetRegistryAuths(registry string) ([]brokerapi.RegistryAuth, error) {
+    auths,err := cm.Store.GetRegistryAuths()
+    if err != nil {
+        log.Println("Failed to obtain registry credentials ",err)
+        return nil,err
+    }
+    ret := []brokerapi.RegistryAuth{}
+    for _,auth := range auths {
+        if len(registry) == 0 || auth.Registry == registry {
+            auth.Password = "********"
+            ret = append(ret,auth)
+        }
+    }
+    if len(registry) > 0 && len(ret) == 0 {
+        return nil,brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Cannot find credentials for registry "+registry})
+    }
+    return ret,nil
+}
+
+func (cm *BrokerConfiguration) GetRegistryAuth(registry string) *brokerapi.RegistryAuth {
+    auths,err := cm.Store.GetRegistryAuths()
+    if err != nil {
+        log.Println("Failed to obtain registry credentials ",err)
+        return nil
+    }
+    for _,auth := range auths {
+        if auth.Registry == registry {
+            return &auth
+        }
+    }
+    return nil
+}
+
+func (cm *BrokerConfiguration) DeleteRegistryAuth(registry string) error {
+    if len(registry)==0 || !cm.Store.HasRegistryAuth(registry) {
+        return errors.New("Cannot find credentials for registry "+registry+" to delete")
+    }
+    return cm.Store.DeleteRegistryAuthConf(registry)
+}
+
+// Users are stored with a salted hash of their password, adding a user again replaces it.
+// The user of the services section stays the administrator and cannot be stored.
+func (cm *BrokerConfiguration) AddOrUpdateUser(user brokerapi.BrokerUser) error {
+    if len(user.Name) == 0 || len(user.Password) == 0 {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "Name and Password are required"})
+    }
+    if user.Name == cm.Services.User {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "User "+user.Name+" is configured in the services section"})
+    }
+    switch user.Role {
+    case brokerapi.RoleCloudController, brokerapi.RoleAdmin:
+    case brokerapi.RoleAgent:
+        if len(user.Host) == 0 {
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "Agent "+user.Name+" requires the Host of its docker host"})
+        }
+    default:
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeBadRequest, "Role "+user.Role+" is not one of "+
+            brokerapi.RoleCloudController+", "+brokerapi.RoleAgent+", "+brokerapi.RoleAdmin})
+    }
+
+    hash, err := hashPassword(user.Password)
+    if err != nil {
+        return err
+    }
+    user.Password = hash
+    if cm.Store.HasUser(user.Name) {
+        if err := cm.Store.DeleteUserConf(user.Name); err != nil {
+            return err
+        }
+    }
+    return cm.Store.AddUserConf(user)
+}
+
+func (cm *BrokerConfiguration) GetUsers(name string) ([]brokerapi.BrokerUser, error) {
+    users,err := cm.Store.GetUsers()
+    if err != nil {
+        log.Println("Failed to obtain users ",err)
+        return nil,err
+    }
+    ret := []brokerapi.BrokerUser{}
+    for _,user := range users {
+        if len(name) == 0 || user.Name == name {
+            user.Password = "********"
+            ret = append(ret,user)
+        }
+    }
+    if len(name) > 0 && len(ret) == 0 {
+        return nil,brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Cannot find user "+name})
+    }
+    return ret,nil
+}
+
+func (cm *BrokerConfiguration) DeleteUser(name string) error {
+    if len(name)==0 || !cm.Store.HasUser(name) {
+        return errors.New("Cannot find user "+name+" to delete")
+    }
+    return cm.Store.DeleteUserConf(name)
+}
+
+func (cm *BrokerConfiguration) AuthenticateUser(name, password string) (brokerapi.BrokerUser, error) {
+    users,err := cm.Store.GetUsers()
+    if err != nil {
+        log.Println("Failed to obtain users ",err)
+        return brokerapi.BrokerUser{},err
+    }
+    for _,user := range users {
+        if user.Name != name {
+            continue
+        }
+        if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+            return brokerapi.BrokerUser{},errors.New("Invalid Credentials for :"+name)
+        }
+        user.Password = ""
+        return user,nil
+    }
+    //unknown users take as long as wrong passwords
+    bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+    return brokerapi.BrokerUser{},errors.New("Invalid Credentials for :"+name)
+}
+
+//compared against for users that do not exist
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    return string(hash), err
+}
+
 func (cm *BrokerConfiguration) UseSSL(host string) bool {
-    if !cm.Persister.HasEntry("brokercertificates","serviceagent='"+host+"'") {
+    if !cm.Store.HasBrokerCerts(host) {
         return false;
     }
     cert,_ := cm.GetCertificates(host)
@@ -280,7 +644,7 @@ func (cm *BrokerConfiguration) GetSSL(host string) *SSLConfig {
                 cert = brokercerts
             }
         }
-           return &SSLConfig {ClientCert: cert.ClientCert, ClientKey: cert.ClientKey, CA: cert.CA}
+           return &SSLConfig {ClientCert: cert.ClientCert, ClientKey: cert.ClientKey, CA: cert.CA, ServerName: cert.ServerName}
        }
        return nil
 }
@@ -59,9 +59,20 @@ type ContainerInfo struct {
     SysInitPath    string
     ResolvConfPath string
     Volumes        map[string]string
+    Mounts         []MountPoint
     HostConfig     HostConfig
 }
 
+// A volume or directory of the docker host mounted into a container, daemons older than
+// API 1.20 only report Volumes.
+type MountPoint struct {
+    Type        string
+    Name        string
+    Source      string
+    Destination string
+    RW          bool
+}
+
 type Port struct {
     PrivatePort int
     PublicPort  int
@@ -155,6 +166,30 @@ func (client *DockerClient) RemoveContainer(id string) error {
     return err
 }
 
+func (client *DockerClient) RenameContainer(id, name string) error {
+    uri := fmt.Sprintf("/containers/%s/rename?name=%s", id, name)
+    _, err := client.DoRequest("POST", uri, nil)
+    return err
+}
+
+// Blocks until the container stops and returns its exit code.
+func (client *DockerClient) WaitContainer(id string) (int, error) {
+    data, err := client.DoRequest("POST", fmt.Sprintf("/containers/%s/wait", id), nil)
+    if err != nil {
+        return -1, err
+    }
+    var result struct {
+        StatusCode int
+    }
+    err = json.Unmarshal(data, &result)
+    return result.StatusCode, err
+}
+
+func (client *DockerClient) RemoveVolume(name string) error {
+    _, err := client.DoRequest("DELETE", fmt.Sprintf("/volumes/%s", name), nil)
+    return err
+}
+
 func (client *DockerClient) InspectContainer(id string) (ContainerInfo,error) {
     data, err := client.DoRequest("GET", fmt.Sprintf("/containers/%s/json", id), nil)
     var ci ContainerInfo      
@@ -14,7 +14,7 @@ var _ = Describe("Containers", func() {
     var Cconfig  dockerapi.ContainerConfig
     var brokerservice *dockerapi.DockerClient
     var serviceagent brokerapi.ServiceAgent
-    var persister brokerapi.Persister
+    var persister brokerapi.Store
     var ts *httptest.Server
     var handler *testnet.TestHandler   
     var err error
@@ -42,7 +42,7 @@ var _ = Describe("Containers", func() {
               ExposedPorts: exposedports,
         }    
         serviceagent = testnet.NewServiceAgent() 
-        persister = testnet.NewPersister()
+        persister = testnet.NewStore()
 
     })
     
@@ -81,6 +81,14 @@ var _ = Describe("Containers", func() {
             Expect(err).To(BeNil())
         })    
 
+        It("should rename container", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerService(serviceagent, persister, renameContainerRequest)    
+            defer ts.Close()    
+
+            err = brokerservice.RenameContainer("myFakeContainerId","myFakeName")
+            Expect(err).To(BeNil())
+        })    
+
         It("should inspect container", func() {
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerService(serviceagent, persister, inspectContainerRequest)    
             defer ts.Close()    
@@ -138,6 +146,14 @@ var removeContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
     },
 })    
 
+var renameContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeContainerId/rename?name=myFakeName",
+    Response: testnet.TestResponse{
+        Status: http.StatusNoContent,
+    },
+})    
+
 var inspectContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
     Method:  "GET",
     Path:    "/containers/myFakeContainerId/json",
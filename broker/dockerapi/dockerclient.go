@@ -1,18 +1,23 @@
 package dockerapi
 
 import (
+    "bufio"
     "bytes"
+    "database/sql"
     "errors"
     "fmt"
     "github.com/brahmaroutu/docker-broker/broker/brokerapi"
+    "io"
     "io/ioutil"
     "net"
     "net/http"
     "net/url"
+    "path"
     "strconv"
     "strings"
     "time"
     "crypto/tls"
+    "crypto/x509"
     "log"
     "sort"
 )
@@ -26,7 +31,7 @@ type DockerClient struct {
     URL        *url.URL
     HTTPClient *http.Client
     ServiceAgent brokerapi.ServiceAgent
-    persister  brokerapi.Persister
+    persister  brokerapi.Store
     brokerconfig BrokerConfiguration
 }
 
@@ -39,6 +44,7 @@ type SSLConfig struct {
     ClientCert    []byte
     ClientKey     []byte
     CA            []byte
+    ServerName    string
 }
 
 //type Callback func(*Event, ...interface{})
@@ -58,12 +64,15 @@ func NewDockerClient(sa brokerapi.ServiceAgent, config BrokerConfiguration) (*Do
     var httpClient *http.Client
     sslConfig := config.GetSSL(sa.DockerHost)
     if config.UseSSL(sa.DockerHost) {
-        httpClient = newHTTPsClient(u, sslConfig.ClientCert, sslConfig.ClientKey, sslConfig.CA)
+        httpClient, err = newHTTPsClient(u, sslConfig.ClientCert, sslConfig.ClientKey, sslConfig.CA, sslConfig.ServerName)
+        if err != nil {
+            log.Println("certificates of ",sa.DockerHost," caused ",err)
+            return nil, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Invalid certificates for docker host "+sa.DockerHost+" ("+err.Error()+")"})
+        }
     } else {
         httpClient = newHTTPClient(u)
     }
-       config.Persister.Connect()    
-    return &DockerClient{u, httpClient, sa, config.Persister,config}, nil
+    return &DockerClient{u, httpClient, sa, config.Store,config}, nil
 }
 
 func (client *DockerClient) DoRequest(method string, path string, body []byte) ([]byte, error) {
@@ -95,6 +104,78 @@ func (client *DockerClient) DoRequest(method string, path string, body []byte) (
     return data, nil
 }
 
+// Sends the request over a connection of its own and takes the connection over once the
+// daemon upgraded it, as the attach and exec APIs do. stdin is written to the connection,
+// which is then half closed so the process sees the end of its input, and everything the
+// daemon writes back until it closes the connection is returned.
+func (client *DockerClient) Hijack(method string, path string, body []byte, stdin []byte) ([]byte, error) {
+    req, err := http.NewRequest(method, client.URL.String()+path, bytes.NewBuffer(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Add("Content-Type", "application/json")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Upgrade", "tcp")
+
+    conn, err := client.dial()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    if err = req.Write(conn); err != nil {
+        return nil, err
+    }
+    br := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(br, req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 400 {
+        data, _ := ioutil.ReadAll(resp.Body)
+        if resp.StatusCode == 404 {
+            return nil, ErrNotFound
+        }
+        if resp.StatusCode == 409 {
+            return nil, ErrConflict
+        }
+        return nil, fmt.Errorf("%s: %s", resp.Status, data)
+    }
+    //daemons older than API 1.22 answer 200 and stream the output as the body
+    var out io.Reader = resp.Body
+    if resp.StatusCode == http.StatusSwitchingProtocols {
+        out = br
+    }
+
+    if len(stdin) > 0 {
+        if _, err = conn.Write(stdin); err != nil {
+            return nil, err
+        }
+    }
+    if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+        if err = cw.CloseWrite(); err != nil {
+            return nil, err
+        }
+    }
+    return ioutil.ReadAll(out)
+}
+
+// Opens a connection to the docker host the way HTTPClient does.
+func (client *DockerClient) dial() (net.Conn, error) {
+    transport, _ := client.HTTPClient.Transport.(*http.Transport)
+    if transport != nil && transport.Dial != nil {
+        return transport.Dial("tcp", client.URL.Host)
+    }
+    if client.URL.Scheme == "https" {
+        var config *tls.Config
+        if transport != nil {
+            config = transport.TLSClientConfig
+        }
+        return tls.Dial("tcp", client.URL.Host, config)
+    }
+    return net.Dial("tcp", client.URL.Host)
+}
+
 func newHTTPClient(u *url.URL) *http.Client {
     httpTransport := &http.Transport{}
     if u.Scheme == "unix" {
@@ -111,62 +192,96 @@ func newHTTPClient(u *url.URL) *http.Client {
     return &http.Client{Transport: httpTransport}
 }
 
-func newHTTPsClient(u *url.URL, clientCert,clientKey,CA []byte ) *http.Client {
-    cert, err := tls.X509KeyPair(clientCert,clientKey)
+func newHTTPsClient(u *url.URL, clientCert,clientKey,CA []byte, serverName string) (*http.Client, error) {
+    config, err := newTLSConfig(clientCert,clientKey,CA,serverName)
     if err != nil {
-        log.Fatalf("server: loadkeys: %s", err)
+        return nil, err
     }
-    config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
      tr := &http.Transport{
-        TLSClientConfig: &config,
+        TLSClientConfig: config,
     }
-    return &http.Client{Transport: tr}
+    return &http.Client{Transport: tr}, nil
      
 }
 
+// The docker host has to present a certificate signed by CA, the system roots are used when
+// no CA was uploaded. serverName is checked instead of the host name when set.
+func newTLSConfig(clientCert,clientKey,CA []byte, serverName string) (*tls.Config, error) {
+    cert, err := tls.X509KeyPair(clientCert,clientKey)
+    if err != nil {
+        return nil, errors.New("loading client key pair: "+err.Error())
+    }
+    config := &tls.Config{Certificates: []tls.Certificate{cert}, ServerName: serverName}
+    if len(CA) > 0 {
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(CA) {
+            return nil, errors.New("no PEM certificates found in CA")
+        }
+    }
+    return config, nil
+}
+
 func (client *DockerClient) Catalog() (brokerapi.Catalog, error) {
     return brokerapi.Catalog{}, brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Catalog is not Supported from the client"})
 }
 
 func (client *DockerClient) Provision(pr brokerapi.ProvisioningRequest) (string, error) {
     imageName := pr.ServiceId
+    imagerepo := repository(imageName)
+    imagedefinition := client.brokerconfig.GetImageDefinitionForPlan(imagerepo, pr.PlanId)
+    if imagedefinition == nil {
+        return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther,
+                             "Plan "+pr.PlanId+" is not offered for "+imagerepo})
+    }
     log.Println("Looking for image: ", imageName)
-    image, err := FindImage(*client, imageName)
+    imageref, err := client.ensureImage(imageName, imagedefinition, client.reportProgress(pr.InstanceId, pr.OperationId))
     if err != nil {
         return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
     }
-    log.Println("Image:", imageName, "info:", image.Id, "tags:", image.RepoTags)
+    log.Println("Image:", imageName, "runs as:", imageref)
 
-    imagerepo := strings.Split(image.RepoTags[0], ":")[0]
-    config := ContainerConfig{AttachStdout: false, AttachStdin: false, Image: imagerepo, Hostname: pr.InstanceId}
-    imagedefinition := client.brokerconfig.GetImageDefinition(imagerepo)
+    config := ContainerConfig{AttachStdout: false, AttachStdin: false, Image: imageref, Hostname: pr.InstanceId}
+    applyPlanSettings(&config, nil, imagedefinition)
     
     var cId, containername,service_port_str string
     var service_port,host_port int
+    //host ports handed out to the container, released again when the provision fails
+    var host_ports []int
     var dashurl string
 
     containername = pr.InstanceId
+    volumes := []brokerapi.ServiceVolume{}
     if needNewContainer(imagedefinition) {
+        volumes = client.instanceVolumes(pr.InstanceId, imagedefinition)
+        if len(volumes) > 0 {
+            config.Volumes = make(map[string]struct{})
+            for _, volume := range volumes {
+                config.Volumes[volume.Path] = struct{}{}
+            }
+        }
         log.Println("Creating container:")
         cId, err = config.CreateContainer(*client, pr.InstanceId)
         if err != nil {
             log.Println("creating container caused error ",err)
             if err == ErrConflict {
-                //see if this is the container created earlier but failed later, we can reuse the container
-                ci, err2 := client.InspectContainer(pr.InstanceId)
-                containername = ci.Name
-                cId = ci.Id
-                err = err2
+                //the instance is not in our DB, so the container is not ours to hand out
+                return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeConflict,
+                                     "A container named "+pr.InstanceId+" already exists"})
             }
+            return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
         }
-        ii, err := client.InspectImage(imagerepo)
+        ii, err := client.InspectImage(imageref)
         if err != nil {
             log.Println("Inspect image caused ", err)
+            client.discardContainer(cId, host_ports)
             return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
         }
         
         hostConfig := &HostConfig{PublishAllPorts: true, NetworkMode: "bridge"}
-        pb_min,pb_max,pb,err := client.persister.GetPortBindings("docker_host='"+client.ServiceAgent.DockerHost+"'")
+        for _, volume := range volumes {
+            hostConfig.Binds = append(hostConfig.Binds, volume.Source+":"+volume.Path)
+        }
+        pb_min,pb_max,pb,err := client.persister.GetPortBindings(client.ServiceAgent.DockerHost)
         if err != nil || pb_min == 0 || pb_max == 0 {
             log.Println("Unable to assign a port, port binding not configured(uses default port binding) or error occured ",err)
         } else {
@@ -178,16 +293,18 @@ func (client *DockerClient) Provision(pr brokerapi.ProvisioningRequest) (string,
                 service_port_str = strings.Split(k,"/")[0]
                 service_port,_ = strconv.Atoi(service_port_str)
                 host_port = next_port
+                host_ports = append(host_ports,next_port)
                 log.Println("Mapping ports ",service_port, " to host port ", host_port)
                 hostConfig.PortBindings[k] = []PortBinding{PortBinding{HostPort: strconv.Itoa(next_port)}}
             }
-            client.persister.WritePortBinding(pb,"docker_host='"+client.ServiceAgent.DockerHost+"'")
+            client.persister.WritePortBinding(pb,client.ServiceAgent.DockerHost)
         }
 
         log.Println("Starting container:", containername)
         err = client.StartContainer(cId, hostConfig)
         if err != nil {
             log.Println("StartContainer caused ", err)
+            client.discardContainer(cId, host_ports)
             return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
         }
     } else {
@@ -212,12 +329,15 @@ func (client *DockerClient) Provision(pr brokerapi.ProvisioningRequest) (string,
     } else {
         dockerExec := CommandExecutors[client.ServiceAgent.ExecCommand]
         if (dockerExec == nil) {
-            return "",errors.New("No Executor specified") 
+            err = errors.New("No Executor specified")
+        } else {
+            dockerExec = dockerExec.Init(client,cId,imagedefinition,lifecycleEnvironment(pr.Context,pr.OriginatingIdentity)) 
+            provision_response,err = dockerExec.(DockerExec).Provision(pr.Parameters)    
         }
-        dockerExec = dockerExec.Init(client,cId,imagedefinition) 
-    
-        provision_response,err = dockerExec.(DockerExec).Provision()    
         if err != nil {
+            if needNewContainer(imagedefinition) {
+                client.discardContainer(cId, host_ports)
+            }
             return "", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
         }
         
@@ -235,10 +355,224 @@ func (client *DockerClient) Provision(pr brokerapi.ProvisioningRequest) (string,
     err = client.persister.AddServiceInstance(imageName, service_port, 
               host_port, dashurl, cId, client.ServiceAgent.DockerHost, 
               containername, imageName, pr, time.Now())
+    if err != nil {
+        log.Println("Failed to record service instance ",pr.InstanceId," : ",err)
+        //nothing would point to the container anymore
+        if needNewContainer(imagedefinition) {
+            client.discardContainer(cId, host_ports)
+        }
+        return dashurl, err
+    }
+    for _, volume := range volumes {
+        if err = client.persister.AddServiceVolume(volume); err != nil {
+            log.Println("Failed to record volume ",volume.Source," of ",pr.InstanceId," : ",err)
+            return dashurl, err
+        }
+    }
+    client.audit(brokerapi.AuditEvent{Operation: brokerapi.OperationProvision, InstanceId: pr.InstanceId, ContainerId: cId,
+                                      Context: pr.Context, OriginatingIdentity: pr.OriginatingIdentity})
 
     return dashurl, err
 }
 
+// Removes the container of a provision that failed along with its host ports, so that the
+// request can be retried.
+func (client *DockerClient) discardContainer(cId string, host_ports []int) {
+    client.StopContainer(cId, 0)
+    if err := client.RemoveContainer(cId); err != nil {
+        log.Println("Failed to remove container ",cId," of failed provision : ",err)
+    }
+    if len(host_ports) > 0 {
+        client.releasePorts(host_ports...)
+    }
+}
+
+// Hands the host ports back to the pool of the docker host.
+func (client *DockerClient) releasePorts(ports ...int) {
+    _,_,pb,err := client.persister.GetPortBindings(client.ServiceAgent.DockerHost)
+    if err != nil {
+        log.Println("Failed to release ports ",ports," : ",err)
+        return
+    }
+    for _, port := range ports {
+        pb = DeleteItem(pb,port)
+    }
+    if err = client.persister.WritePortBinding(pb,client.ServiceAgent.DockerHost); err != nil {
+        log.Println("Failed to release ports ",ports," : ",err)
+    }
+}
+
+// Volumes backing the data paths of an instance, named after the instance so that they
+// can be found again. They live below the volume root of the broker when one is configured.
+func (client *DockerClient) instanceVolumes(instanceid string, imagedef *brokerapi.ImageDefinition) []brokerapi.ServiceVolume {
+    volumes := []brokerapi.ServiceVolume{}
+    for _, path := range imagedef.Volumes {
+        volume := brokerapi.ServiceVolume{InstanceId: instanceid, Path: path,
+                                          Source: instanceid + strings.Replace(path, "/", "_", -1)}
+        if len(client.brokerconfig.VolumeRoot) > 0 {
+            volume.Source = strings.TrimRight(client.brokerconfig.VolumeRoot, "/") + "/" + volume.Source
+            volume.HostPath = true
+        }
+        volumes = append(volumes, volume)
+    }
+    return volumes
+}
+
+// Removes the volumes of a deprovisioned instance unless they are to be retained. Volumes
+// that cannot be removed stay recorded in the persister so they can be cleaned up by hand.
+func (client *DockerClient) removeVolumes(instanceid, image string, retain bool) {
+    volumes, err := client.persister.GetServiceVolumes(instanceid)
+    if err != nil {
+        log.Println("Failed to read the volumes of ",instanceid," : ",err)
+        return
+    }
+    for _, volume := range volumes {
+        if retain {
+            log.Println("Retaining volume ",volume.Source," of ",instanceid)
+            continue
+        }
+        if volume.HostPath {
+            err = client.removeHostDirectory(image, volume.Source)
+        } else {
+            err = client.RemoveVolume(volume.Source)
+        }
+        if err != nil {
+            log.Println("Failed to remove volume ",volume.Source," of ",instanceid," : ",err)
+            continue
+        }
+        client.persister.DeleteServiceVolume(instanceid, volume.Path)
+    }
+}
+
+// The broker cannot reach the files of the docker host, a short lived container of the
+// service image removes the directory instead.
+func (client *DockerClient) removeHostDirectory(image, dir string) error {
+    config := ContainerConfig{Image: image, Entrypoint: []string{"rm"},
+                              Cmd: []string{"-rf", "/volumes/" + path.Base(dir)}}
+    id, err := config.CreateContainer(*client, "")
+    if err != nil {
+        return err
+    }
+    defer client.RemoveContainer(id)
+
+    err = client.StartContainer(id, &HostConfig{Binds: []string{path.Dir(dir) + ":/volumes"}})
+    if err != nil {
+        return err
+    }
+    status, err := client.WaitContainer(id)
+    if err == nil && status != 0 {
+        err = fmt.Errorf("removing %s exited with %d", dir, status)
+    }
+    return err
+}
+
+// Strips the tag off an image name, registry ports (host:5000/image) are kept.
+func repository(imageName string) string {
+    if i := strings.LastIndex(imageName, ":"); i > 0 && !strings.Contains(imageName[i:], "/") {
+        return imageName[:i]
+    }
+    return imageName
+}
+
+// Makes sure the image of the plan is on the docker host, pulling it when it is missing, and
+// returns the reference to create containers from. Plans without a tag or digest run whatever
+// the host has of the image, the tag of the service id (latest if none) is pulled otherwise.
+func (client *DockerClient) ensureImage(imageName string, imagedef *brokerapi.ImageDefinition, progress func(string)) (string, error) {
+    imagerepo := repository(imageName)
+    var ref, tag string
+    switch {
+    case len(imagedef.Digest) > 0:
+        tag = imagedef.Digest
+        ref = imagerepo + "@" + tag
+    case len(imagedef.Tag) > 0:
+        tag = imagedef.Tag
+        ref = imagerepo + ":" + tag
+    default:
+        if _, err := FindImage(*client, imageName); err == nil {
+            return imagerepo, nil
+        }
+        tag = "latest"
+        if imagerepo != imageName {
+            tag = imageName[len(imagerepo)+1:]
+        }
+        ref = imagerepo + ":" + tag
+    }
+
+    if len(imagedef.Digest) > 0 || len(imagedef.Tag) > 0 {
+        found, err := HasImage(*client, ref)
+        if err != nil {
+            return "", err
+        }
+        if found {
+            return ref, nil
+        }
+    }
+
+    log.Println("Pulling image ", ref)
+    auth := client.brokerconfig.GetRegistryAuth(registryOf(imagerepo))
+    err := client.PullImage(imagerepo, tag, auth, func(status string) {
+        progress("Pulling " + ref + ": " + status)
+    })
+    if err != nil {
+        return "", errors.New("Failed to pull image " + ref + " (" + err.Error() + ")")
+    }
+    return ref, nil
+}
+
+// Reports progress into the description of the operation, if there is one, at most once a second.
+func (client *DockerClient) reportProgress(instanceid, operationid string) func(string) {
+    var last time.Time
+    return func(status string) {
+        log.Println(status)
+        if len(operationid) == 0 || time.Since(last) < time.Second {
+            return
+        }
+        last = time.Now()
+        op, err := client.persister.GetOperation(instanceid, "", operationid)
+        if err != nil {
+            log.Println("Failed to find operation ",operationid," : ",err)
+            return
+        }
+        op.Description = status
+        op.UpdatedAt = last
+        client.persister.UpdateOperation(op)
+    }
+}
+
+// Applies the container settings of the plan, the env entries of the replaced plan (if any) are dropped.
+func applyPlanSettings(config *ContainerConfig, previous, imagedef *brokerapi.ImageDefinition) {
+    config.Memory = imagedef.Memory
+    config.MemorySwap = imagedef.MemorySwap
+    config.CpuShares = imagedef.CpuShares
+    config.Cpuset = imagedef.Cpuset
+    if previous != nil && len(previous.Env) > 0 {
+        env := []string{}
+        for _, e := range config.Env {
+            keep := true
+            for _, pe := range previous.Env {
+                if e == pe {
+                    keep = false
+                    break
+                }
+            }
+            if keep {
+                env = append(env, e)
+            }
+        }
+        config.Env = env
+    }
+    config.Env = append(config.Env, imagedef.Env...)
+}
+
+// Image definition of the plan the instance was provisioned with or last updated to.
+func (client *DockerClient) instanceImageDefinition(instanceid, imageName string) *brokerapi.ImageDefinition {
+    imagedefinition := client.brokerconfig.GetImageDefinitionForPlan(imageName, client.persister.GetServiceInstancePlan(instanceid))
+    if imagedefinition == nil {
+        imagedefinition = client.brokerconfig.GetImageDefinition(imageName)
+    }
+    return imagedefinition
+}
+
 func needNewContainer(imagedef *brokerapi.ImageDefinition) bool {
     //Srini check the map that tells how many instances running in each container
     if imagedef.Numinstances == 0 {
@@ -267,7 +601,7 @@ func (client *DockerClient) mapServerUrl(response map[string]interface{}, cId st
     }
     portbindings := ci.NetworkSettings.Ports
 
-    log.Println("incoming response ",response)
+    log.Println("incoming response ",responseKeys(response))
     port_replacement := make(map[string] string)
     var default_port string
     for k, v := range portbindings {
@@ -291,7 +625,7 @@ func (client *DockerClient) mapServerUrl(response map[string]interface{}, cId st
         v = strings.Replace(v.(string), "$PORT", default_port, -1)
         response[k] = v  
     }
-    log.Println("tranformed response ",response)
+    log.Println("tranformed response ",responseKeys(response))
     
     return true
 }
@@ -303,36 +637,34 @@ func (client *DockerClient) Deprovision(pr brokerapi.ProvisioningRequest) error
                              "Failed to find the Instance in the Database"})
     }
 
-    imagedefinition := client.brokerconfig.GetImageDefinition(imageName)
+    imagedefinition := client.instanceImageDefinition(pr.InstanceId, imageName)
+    //the platform only sends the context on provision and update
+    instance, _ := client.persister.GetServiceInstance(pr.InstanceId)
 
-    defer func() {
-        //TODO remove the reserved port binding for this container, we may check multitenancy here
-        _,_,pb,_ := client.persister.GetPortBindings("docker_host='"+client.ServiceAgent.DockerHost+"'")
-        service_port := client.persister.GetServicePort(pr.InstanceId)
-        pb = DeleteItem(pb,service_port)
-        client.persister.WritePortBinding(pb,"docker_host='"+client.ServiceAgent.DockerHost+"'")        
-        client.persister.DeleteServiceInstance(pr.InstanceId)
-    }()
-    
     var err error
     if len(imagedefinition.DashBoardUrl) == 0 && len(imagedefinition.Credentials) == 0 {
         dockerExec := CommandExecutors[client.ServiceAgent.ExecCommand]
         if (dockerExec == nil) {
-            log.Println("No Executor specified") 
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "No Executor specified"})
         }
-        dockerExec = dockerExec.Init(client,cId,imagedefinition) 
+        dockerExec = dockerExec.Init(client,cId,imagedefinition,lifecycleEnvironment(instance.Context,pr.OriginatingIdentity)) 
     
+        //a container that is already gone has nothing left to clean up
         response,err := dockerExec.Deprovision()    
-        if err != nil {
+        if err == ErrNotFound {
+            log.Println("Container ",cId," of ",pr.InstanceId," is already gone")
+        } else if err != nil {
             log.Println("Error occurred running deprovision script ",err)
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther,
+                                                "Failed to run deprovision ("+err.Error()+")"})
         }
-        log.Println("deprovision response is ", response)
+        log.Println("deprovision response has ", responseKeys(response))
     }
 
     if client.shouldRemoveContainer(imagedefinition) {
         log.Println("Stopping container:", cId)
         err = client.StopContainer(cId, 0)
-        if err != nil {
+        if err != nil && err != ErrNotFound {
             log.Println("Error stopping container ", err )
             return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther,
                                                 err.Error()})
@@ -340,48 +672,298 @@ func (client *DockerClient) Deprovision(pr brokerapi.ProvisioningRequest) error
 
         log.Println("Removing container:", cId)
         err = client.RemoveContainer(cId)
-        if err != nil {
+        if err != nil && err != ErrNotFound {
             log.Println("Error Removing container ", err )
             return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther,
                                                 err.Error()})
         }
     }
 
-    return err
+    client.removeVolumes(pr.InstanceId, imageName, imagedefinition.RetainVolumes)
+
+    //the instance is only forgotten once the container is really gone, so that a failed
+    //deprovision can be retried
+    //TODO we may check multitenancy here before releasing the port
+    client.releasePorts(client.persister.GetHostPort(pr.InstanceId))
+    if err = client.persister.DeleteServiceInstance(pr.InstanceId); err != nil {
+        return err
+    }
+    client.audit(brokerapi.AuditEvent{Operation: brokerapi.OperationDeprovision, InstanceId: pr.InstanceId, ContainerId: cId,
+                                      Context: instance.Context, OriginatingIdentity: pr.OriginatingIdentity})
+    return nil
+}
+
+func (client *DockerClient) Update(ur brokerapi.UpdateRequest) error {
+    cId,imageName := client.persister.GetContainerIdAndImageName(ur.InstanceId)
+    if cId == "" {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, 
+                             "Failed to find the Instance in the Database"})
+    }
+
+    currentplan := client.persister.GetServiceInstancePlan(ur.InstanceId)
+    planid := ur.PlanId
+    if len(planid) == 0 {
+        planid = currentplan
+    }
+    imagedefinition := client.brokerconfig.GetImageDefinitionForPlan(imageName, planid)
+    if imagedefinition == nil {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther,
+                             "Plan "+planid+" is not offered for "+imageName})
+    }
+
+    //the plan may be referred to by name or by catalog id, compare what they resolve to
+    previous := client.brokerconfig.GetImageDefinitionForPlan(imageName, currentplan)
+    planchanged := previous == nil || previous.Plan != imagedefinition.Plan
+
+    instance, _ := client.persister.GetServiceInstance(ur.InstanceId)
+    context := ur.Context
+    if len(context) == 0 {
+        context = instance.Context
+    }
+
+    //checked before the container is replaced, there is no way back afterwards
+    runUpdate := len(imagedefinition.DashBoardUrl) == 0 && len(imagedefinition.Credentials) == 0
+    dockerExec := CommandExecutors[client.ServiceAgent.ExecCommand]
+    if runUpdate && dockerExec == nil {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "No Executor specified"})
+    }
+
+    var err error
+    if planchanged && needNewContainer(imagedefinition) {
+        log.Println("Changing plan of ",ur.InstanceId," from ",currentplan," to ",planid)
+        cId, err = client.recreateContainer(cId, ur.InstanceId, imageName, previous, imagedefinition,
+                                            client.reportProgress(ur.InstanceId, ur.OperationId))
+        if err != nil {
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
+        }
+        //the old container is gone, the instance has to point to the new one even if /update fails
+        if err = client.persister.UpdateServiceInstance(ur.InstanceId, planid, cId, instance.Parameters); err != nil {
+            log.Println("Failed to record container ",cId," of ",ur.InstanceId," : ",err)
+            return err
+        }
+    }
+
+    if runUpdate {
+        dockerExec = dockerExec.Init(client,cId,imagedefinition,lifecycleEnvironment(context,ur.OriginatingIdentity)) 
+
+        response,err := dockerExec.Update(ur.Parameters)
+        if err != nil {
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther,
+                                                "Failed to run update ("+err.Error()+")"})
+        }
+        log.Println("update response has ", responseKeys(response))
+    }
+
+    //parameters not given keep their values
+    parameters := map[string]interface{}{}
+    for k,v := range instance.Parameters {
+        parameters[k] = v
+    }
+    for k,v := range ur.Parameters {
+        parameters[k] = v
+    }
+    if err = client.persister.UpdateServiceInstance(ur.InstanceId, planid, cId, parameters); err != nil {
+        return err
+    }
+    client.audit(brokerapi.AuditEvent{Operation: brokerapi.OperationUpdate, InstanceId: ur.InstanceId, ContainerId: cId,
+                                      Context: context, OriginatingIdentity: ur.OriginatingIdentity})
+    return nil
+}
+
+// Replaces the container of an instance by a fresh one of the image and with the settings of the
+// new plan. The new container takes over the volumes and port bindings of the old one so that the
+// service keeps its data and its credentials stay valid. On failure the old container is brought back.
+func (client *DockerClient) recreateContainer(cId, name, imageName string, previous, imagedef *brokerapi.ImageDefinition,
+                                              progress func(string)) (string, error) {
+    ci, err := client.InspectContainer(cId)
+    if err != nil {
+        log.Println("Inspect container caused ", err)
+        return "", err
+    }
+    if ci.Config == nil {
+        return "", errors.New("Cannot read the configuration of container "+cId)
+    }
+    //the new plan may pin another tag or digest, pulled while the old container still runs
+    imageref, err := client.ensureImage(imageName, imagedef, progress)
+    if err != nil {
+        return "", err
+    }
+    config := *ci.Config
+    config.Image = imageref
+    applyPlanSettings(&config, previous, imagedef)
+    //the mounts are handed over explicitly, the new container must not refer to the old one
+    //as that is removed once the new one runs
+    restoreConfig := ci.HostConfig
+    hostConfig := ci.HostConfig
+    hostConfig.VolumesFrom = nil
+    hostConfig.Binds = containerBinds(&ci)
+    added := []brokerapi.ServiceVolume{}
+    for _, volume := range client.instanceVolumes(name, imagedef) {
+        if !hasMount(hostConfig.Binds, volume.Path) {
+            hostConfig.Binds = append(hostConfig.Binds, volume.Source+":"+volume.Path)
+            added = append(added, volume)
+        }
+    }
+
+    oldname := name + "_previous"
+    if err = client.StopContainer(ci.Id, 0); err != nil {
+        return "", err
+    }
+    if err = client.RenameContainer(ci.Id, oldname); err != nil {
+        client.StartContainer(ci.Id, &restoreConfig)
+        return "", err
+    }
+
+    newId, err := config.CreateContainer(*client, name)
+    if err == nil {
+        err = client.StartContainer(newId, &hostConfig)
+        if err != nil {
+            client.RemoveContainer(newId)
+        }
+    }
+    if err != nil {
+        log.Println("Failed to replace container ",ci.Id," restoring it : ",err)
+        client.RenameContainer(ci.Id, name)
+        client.StartContainer(ci.Id, &restoreConfig)
+        return "", err
+    }
+
+    //the volumes live on as they are used by the new container
+    if err := client.RemoveContainer(ci.Id); err != nil {
+        log.Println("Failed to remove replaced container ",ci.Id," : ",err)
+    }
+    for _, volume := range added {
+        if err := client.persister.AddServiceVolume(volume); err != nil {
+            log.Println("Failed to record volume ",volume.Source," of ",name," : ",err)
+        }
+    }
+    return newId, nil
+}
+
+// The mounts of a container as binds another container can be started with. Volumes are
+// bound by name and directories of the docker host by path.
+func containerBinds(ci *ContainerInfo) []string {
+    var binds []string
+    binds = append(binds, ci.HostConfig.Binds...)
+    for _, mount := range ci.Mounts {
+        source := mount.Name
+        if len(source) == 0 {
+            source = mount.Source
+        }
+        if len(source) == 0 || hasMount(binds, mount.Destination) {
+            continue
+        }
+        bind := source+":"+mount.Destination
+        if !mount.RW {
+            bind += ":ro"
+        }
+        binds = append(binds, bind)
+    }
+    if len(ci.Mounts) == 0 {
+        for path, source := range ci.Volumes {
+            if !hasMount(binds, path) {
+                binds = append(binds, source+":"+path)
+            }
+        }
+    }
+    return binds
+}
+
+// Whether one of binds mounts something at path.
+func hasMount(binds []string, path string) bool {
+    for _, bind := range binds {
+        parts := strings.Split(bind, ":")
+        if len(parts) > 1 && parts[1] == path {
+            return true
+        }
+    }
+    return false
 }
 
 func (client *DockerClient) Bind(br brokerapi.BindingRequest) (string, brokerapi.Credentials, string, error) {
     cId,imageName := client.persister.GetContainerIdAndImageName(br.InstanceId)
     log.Println("Found container id for ",br.InstanceId," and the value is ",cId,imageName)
 
-    imagedefinition := client.brokerconfig.GetImageDefinition(imageName)
+    imagedefinition := client.instanceImageDefinition(br.InstanceId, imageName)
 
-    //write the binding to table
-    client.persister.AddServiceBinding(br.InstanceId, br.BindingId, br.AppId, time.Now())
-    
     creds := make(brokerapi.Credentials)
     var err error
+    //set when /bind handed out credentials of its own, they are revoked again when the binding fails
+    var dockerExec DockerExec
     if len(imagedefinition.DashBoardUrl) > 0 || len(imagedefinition.Credentials) > 0 {
         for k,v := range imagedefinition.Credentials {
             creds[k] = v
         } 
     } else {
-        dockerExec := CommandExecutors[client.ServiceAgent.ExecCommand]
+        dockerExec = CommandExecutors[client.ServiceAgent.ExecCommand]
         if (dockerExec == nil) {
             return "",nil,"",errors.New("No Executor specified") 
         }
     
-        dockerExec = dockerExec.Init(client,cId,imagedefinition) 
-        creds,err = dockerExec.Bind()    
+        dockerExec = dockerExec.Init(client,cId,imagedefinition,lifecycleEnvironment(br.Context,br.OriginatingIdentity)) 
+        creds,err = dockerExec.Bind(br.BindingId, br.AppId, br.Parameters)    
         if err != nil {
             return "",nil,"", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
         }
     
-        log.Println("bind response is ", creds)
+        log.Println("bind response has ", len(creds), " credentials")
     }
     client.mapServerUrl(creds, cId)
 
-    return "credentials", creds, "unknown", err
+    drainurl, err := client.syslogDrainUrl(imagedefinition, creds, cId)
+    if err != nil {
+        client.revokeBinding(dockerExec, br.BindingId, creds)
+        return "",nil,"", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
+    }
+
+    //write the binding to table, the credentials are handed out again when it is fetched
+    err = client.persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: br.InstanceId, BindingId: br.BindingId,
+                                             AppId: br.AppId, Credentials: creds, SyslogDrainUrl: drainurl, Parameters: br.Parameters,
+                                             Context: br.Context, OriginatingIdentity: br.OriginatingIdentity}, time.Now())
+    if err != nil {
+        client.revokeBinding(dockerExec, br.BindingId, creds)
+        return "",nil,"", brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Failed to record service binding ("+err.Error()+")"})
+    }
+    client.audit(brokerapi.AuditEvent{Operation: brokerapi.OperationBind, InstanceId: br.InstanceId, BindingId: br.BindingId,
+                                      ContainerId: cId, Context: br.Context, OriginatingIdentity: br.OriginatingIdentity})
+
+    return "credentials", creds, drainurl, err
+}
+
+// Hands the credentials /bind handed out to /unbind, the binding they were created for failed
+// and is never going to be unbound by the platform.
+func (client *DockerClient) revokeBinding(dockerExec DockerExec, bindingid string, creds brokerapi.Credentials) {
+    if dockerExec == nil {
+        return
+    }
+    if _, err := dockerExec.Unbind(bindingid, creds); err != nil {
+        log.Println("Failed to revoke the credentials of binding ",bindingid," : ",err)
+    }
+}
+
+// Only images requiring syslog_drain get their logs drained, to the syslog_drain_url /bind
+// returned or else to the one of the image definition. Cloud Foundry is only handed URLs it
+// can drain to.
+func (client *DockerClient) syslogDrainUrl(imagedef *brokerapi.ImageDefinition, creds brokerapi.Credentials, cId string) (string, error) {
+    if !requiresSyslogDrain(imagedef) {
+        return "", nil
+    }
+    drainurl, _ := creds["syslog_drain_url"].(string)
+    delete(creds, "syslog_drain_url")
+    if len(drainurl) == 0 && len(imagedef.SyslogDrainUrl) > 0 {
+        template := map[string]interface{}{"syslog_drain_url": imagedef.SyslogDrainUrl}
+        client.mapServerUrl(template, cId)
+        drainurl = template["syslog_drain_url"].(string)
+    }
+    if len(drainurl) == 0 {
+        return "", nil
+    }
+    u, err := url.Parse(drainurl)
+    if err != nil || len(u.Host) == 0 || strings.Contains(u.Host, "$") ||
+       (u.Scheme != "syslog" && u.Scheme != "syslog-tls" && u.Scheme != "https") {
+        return "", errors.New("Invalid syslog drain URL "+drainurl+", expected syslog://, syslog-tls:// or https:// and a host")
+    }
+    return drainurl, nil
 }
 
 func (client *DockerClient) Unbind(br brokerapi.BindingRequest) error {
@@ -390,34 +972,54 @@ func (client *DockerClient) Unbind(br brokerapi.BindingRequest) error {
         return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Failed to find the Instance in the Database"})
     }
 
-    var err error
-    defer func() { err = client.persister.DeleteServiceBinding(br.InstanceId, br.BindingId)
-        if err != nil {
-            err = brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Failed to delete service binding ("+err.Error()+")"})
+    binding, err := client.persister.GetServiceBinding(br.InstanceId, br.BindingId)
+    if err == sql.ErrNoRows {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Failed to find the service binding"})
+    }
+    if err != nil {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Failed to read service binding ("+err.Error()+")"})
+    }
+
+    imagedefinition := client.instanceImageDefinition(br.InstanceId, imageName)
+    if len(imagedefinition.DashBoardUrl) == 0 && len(imagedefinition.Credentials) == 0 {
+        dockerExec := CommandExecutors[client.ServiceAgent.ExecCommand]
+        if (dockerExec == nil) {
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "No Executor specified"})
         }
-    }()
 
-    imagedefinition := client.brokerconfig.GetImageDefinition(imageName)
-    if len(imagedefinition.DashBoardUrl) > 0 || len(imagedefinition.Credentials) > 0 {
-        return nil
+        dockerExec = dockerExec.Init(client,cId,imagedefinition,lifecycleEnvironment(binding.Context,br.OriginatingIdentity)) 
+        _,err := dockerExec.Unbind(br.BindingId, binding.Credentials)    
+        if err != nil {
+            return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Failed to run unbind ("+err.Error()+")"})
+        }
     }
-    
-    serviceurl := client.persister.GetServiceUrl("container_id='" + cId + "'")
 
-    dockerExec := CommandExecutors[client.ServiceAgent.ExecCommand]
-    if (dockerExec == nil) {
-        return errors.New("No Executor specified") 
+    err = client.persister.DeleteServiceBinding(br.InstanceId, br.BindingId)
+    if err == sql.ErrNoRows {
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeGone, "Failed to find the service binding"})
     }
-
-    dockerExec = dockerExec.Init(client,cId,imagedefinition) 
-    _,err = dockerExec.Unbind(serviceurl)    
     if err != nil {
-        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, err.Error()})
+        return brokerapi.BrokerServiceError(&CFError{brokerapi.ErrCodeOther, "Failed to delete service binding ("+err.Error()+")"})
     }
-    
+    client.audit(brokerapi.AuditEvent{Operation: brokerapi.OperationUnbind, InstanceId: br.InstanceId, BindingId: br.BindingId,
+                                      ContainerId: cId, Context: binding.Context, OriginatingIdentity: br.OriginatingIdentity})
     return nil
 }
 
+// Writes the audit trail of who asked for what, the operation already happened so a failure
+// to record it is only logged.
+func (client *DockerClient) audit(event brokerapi.AuditEvent) {
+    event.Time = time.Now()
+    user := "unknown"
+    if event.OriginatingIdentity != nil {
+        user = fmt.Sprintf("%v %v", event.OriginatingIdentity.Platform, event.OriginatingIdentity.Value)
+    }
+    log.Println("Audit: ",event.Operation," of ",event.InstanceId," ",event.BindingId," on container ",event.ContainerId," by ",user)
+    if err := client.persister.AddAuditEvent(event); err != nil {
+        log.Println("Failed to record audit event for ",event.InstanceId," : ",err)
+    }
+}
+
 func (cfe *CFError) Code() int {
     return cfe.ErrorCode
 }
@@ -443,11 +1045,11 @@ func FindNextNum(inta myint, minnum,maxnum int) int {
 }
 
 func DeleteItem(inta myint,val int) []int {
-    if len(inta)==0 {
-        return inta
-    }    
     sort.Sort(inta)
     i := sort.SearchInts(inta,val)
+    if i == len(inta) || inta[i] != val {
+        return inta
+    }
     return append(inta[:i], inta[i+1:]...)
 }
 
@@ -8,7 +8,15 @@ import (
     . "github.com/onsi/ginkgo"
     . "github.com/onsi/gomega"
 
+    "bytes"
+    "crypto/x509"
+    "encoding/json"
+    "encoding/pem"
     "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
     "time"
     "net/http"
     "net/http/httptest"
@@ -17,7 +25,7 @@ import (
 var _ = Describe("Dockerclient", func() {
     var brokerservice *dockerapi.DockerClient
     var serviceagent brokerapi.ServiceAgent
-    var persister brokerapi.Persister
+    var persister brokerapi.Store
     var cm dockerapi.BrokerConfiguration
     var ts *httptest.Server
     var handler *testnet.TestHandler   
@@ -26,12 +34,11 @@ var _ = Describe("Dockerclient", func() {
     Describe("brokertest test dockerclient", func() {
         BeforeEach(func() {        
             serviceagent = testnet.NewServiceAgent() 
-            persister = testnet.NewPersister()
+            persister = testnet.NewStore()
             cm = testnet.BrokerConfiguration()
-            testnet.SetupSQL(persister)
         })
         AfterEach(func() {
-            testnet.CleanupSQL(persister)
+            testnet.CleanupStore()
         })
         
         It("create docker client", func() {
@@ -43,6 +50,73 @@ var _ = Describe("Dockerclient", func() {
             Expect(brokerservice.HTTPClient).ShouldNot(BeNil())
         })
 
+        It("should verify the docker host certificate against the uploaded CA", func() {
+            ts,handler = testnet.NewTLSServer([]testnet.TestRequest{emptyGetRequest,emptyGetRequest})
+            defer ts.Close()
+            clientCert,clientKey,CA := tlsMaterial(ts)
+            host := strings.Split(strings.TrimPrefix(ts.URL,"https://"),":")
+            serviceagent.DockerHost = host[0]
+            serviceagent.DockerPort,_ = strconv.Atoi(host[1])
+
+            err = cm.AddOrUpdateCertificates(brokerapi.BrokerCerts{Host: serviceagent.DockerHost, ClientCert: clientCert, ClientKey: clientKey, CA: CA})
+            Expect(err).To(BeNil())
+            brokerservice,err = dockerapi.NewDockerClient(serviceagent,cm)
+            Expect(err).To(BeNil())
+            Expect("https://"+brokerservice.URL.Host).To(Equal(ts.URL))
+            _,err = brokerservice.DoRequest("GET","/",nil)
+            Expect(err).To(BeNil())
+
+            //the certificate of the test server is issued for example.com
+            err = cm.DeleteCertificate(serviceagent.DockerHost)
+            Expect(err).To(BeNil())
+            err = cm.AddOrUpdateCertificates(brokerapi.BrokerCerts{Host: serviceagent.DockerHost, ClientCert: clientCert, ClientKey: clientKey, CA: CA, ServerName: "example.com"})
+            Expect(err).To(BeNil())
+            brokerservice,err = dockerapi.NewDockerClient(serviceagent,cm)
+            Expect(err).To(BeNil())
+            _,err = brokerservice.DoRequest("GET","/",nil)
+            Expect(err).To(BeNil())
+            Expect(handler.CallCount).To(Equal(2))
+        })
+
+        It("should refuse docker hosts whose certificate cannot be verified", func() {
+            ts,handler = testnet.NewTLSServer([]testnet.TestRequest{})
+            defer ts.Close()
+            clientCert,clientKey,CA := tlsMaterial(ts)
+            host := strings.Split(strings.TrimPrefix(ts.URL,"https://"),":")
+            serviceagent.DockerHost = host[0]
+            serviceagent.DockerPort,_ = strconv.Atoi(host[1])
+
+            err = cm.AddOrUpdateCertificates(brokerapi.BrokerCerts{Host: serviceagent.DockerHost, ClientCert: clientCert, ClientKey: clientKey, CA: CA, ServerName: "docker.example.org"})
+            Expect(err).To(BeNil())
+            brokerservice,err = dockerapi.NewDockerClient(serviceagent,cm)
+            Expect(err).To(BeNil())
+            _,err = brokerservice.DoRequest("GET","/",nil)
+            Expect(err).ShouldNot(BeNil())
+
+            err = cm.DeleteCertificate(serviceagent.DockerHost)
+            Expect(err).To(BeNil())
+            err = cm.AddOrUpdateCertificates(brokerapi.BrokerCerts{Host: serviceagent.DockerHost, ClientCert: clientCert, ClientKey: clientKey})
+            Expect(err).To(BeNil())
+            brokerservice,err = dockerapi.NewDockerClient(serviceagent,cm)
+            Expect(err).To(BeNil())
+            _,err = brokerservice.DoRequest("GET","/",nil)
+            Expect(err).ShouldNot(BeNil())
+            Expect(handler.CallCount).To(Equal(0))
+        })
+
+        It("should report bad certificates of a docker host as an error", func() {
+            err = cm.AddOrUpdateCertificates(brokerapi.BrokerCerts{Host: serviceagent.DockerHost, ClientCert: []byte("cert"), ClientKey: []byte("key")})
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeBadRequest))
+
+            //certificates stored before they were checked on upload
+            persister.AddBrokerCertsConf(serviceagent.DockerHost,[]byte("cert"),[]byte("key"),nil,"")
+            brokerservice,err = dockerapi.NewDockerClient(serviceagent,cm)
+            Expect(brokerservice).To(BeNil())
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(HavePrefix("Invalid certificates for docker host "+serviceagent.DockerHost))
+        })
+
         It("should not respond to catalog request", func() {
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerService(serviceagent,persister, emptyGetRequest)    
             defer ts.Close()
@@ -55,7 +129,6 @@ var _ = Describe("Dockerclient", func() {
         })
 
         It("should provision a service", func() {
-            persister.Connect()
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
             defer ts.Close()
 
@@ -72,8 +145,314 @@ var _ = Describe("Dockerclient", func() {
             Expect(provisionurl).To(Equal("mysql://fakehost:1234"))
         })
 
+        It("should not take over a container it did not provision", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,provision_CreateExistingContainerRequest})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                    OrgId:      "myFakeOrg",
+                    SpaceId:    "myFakeSpace",
+                }            
+            _, err := brokerservice.Provision(pr)
+            Expect(err).Should(BeAssignableToTypeOf(&dockerapi.CFError{}))
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeConflict))
+            Expect(handler.CallCount).To(Equal(2))
+        })
+
+        It("should remove the container of a provision that failed", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,provision_FailStartContainerRequest,testnet.Deprovision_StopContainerRequest,testnet.Deprovision_RemoveContainerRequest})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                    OrgId:      "myFakeOrg",
+                    SpaceId:    "myFakeSpace",
+                }            
+            serviceagent.Portbind_min = 49000
+            serviceagent.Portbind_max = 49100
+            persister.AddorUpdateServiceAgent(serviceagent)
+            persister.WritePortBinding([]int{49000}, serviceagent.DockerHost)
+
+            _, err := brokerservice.Provision(pr)
+            Expect(err).ShouldNot(BeNil())
+            Expect(handler.CallCount).To(Equal(6))
+            cId,_ := persister.GetContainerIdAndImageName(pr.InstanceId)
+            Expect(cId).To(BeEmpty())
+            //the host port the container was given goes back to the pool
+            _,_,pb,err := persister.GetPortBindings(serviceagent.DockerHost)
+            Expect(err).To(BeNil())
+            Expect(pb).To(Equal([]int{49000}))
+        })
+
+        It("should remove the container of a provision it fails to record", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,testnet.Provision_CreateContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest,testnet.Deprovision_StopContainerRequest,testnet.Deprovision_RemoveContainerRequest})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                    OrgId:      "myFakeOrg",
+                    SpaceId:    "myFakeSpace",
+                }            
+            //taken while the container was started
+            other := pr
+            other.PlanId = "200"
+            persister.AddServiceInstance("mysql:latest", 3306, 49153, "mysql://fakehost:49153", "otherContainer", "otherhost",
+                                         "otherContainer", "mysql", other, time.Now())
+
+            _, err := brokerservice.Provision(pr)
+            Expect(err).ShouldNot(BeNil())
+            Expect(handler.CallCount).To(Equal(7))
+            cId,_ := persister.GetContainerIdAndImageName(pr.InstanceId)
+            Expect(cId).To(Equal("otherContainer"))
+        })
+
+        It("should provision a service with the container settings of its plan", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,provision_CreatePlanContainerRequest,testnet.Provision_InspectImageRequest,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200",
+                Description: "large mysql", Numinstances: 1, Memory: 536870912, MemorySwap: 1073741824, CpuShares: 512, Cpuset: "0-1",
+                Env: []string{"MYSQL_CHARSET=utf8"}}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "mysql_200",
+                    OrgId:      "myFakeOrg",
+                    SpaceId:    "myFakeSpace",
+                }            
+            provisionurl, err := brokerservice.Provision(pr)
+            Expect(err).To(BeNil())
+            Expect(provisionurl).To(Equal("mysql://fakehost:1234"))
+        })
+
+        It("should provision a service with its data paths in volumes", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,provision_CreateVolumeContainerRequest,testnet.Provision_InspectImageRequest,provision_StartVolumeContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200",
+                Numinstances: 1, Volumes: []string{"/var/lib/mysql"}}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "mysql_200",
+                }            
+            _, err := brokerservice.Provision(pr)
+            Expect(err).To(BeNil())
+
+            volumes,err := persister.GetServiceVolumes("myFakeInstance")
+            Expect(err).To(BeNil())
+            Expect(volumes).To(Equal([]brokerapi.ServiceVolume{brokerapi.ServiceVolume{InstanceId: "myFakeInstance",
+                                     Path: "/var/lib/mysql", Source: "myFakeInstance_var_lib_mysql"}}))
+        })
+
+        It("should pull the image of a plan when it is missing and report the progress", func() {
+            inspectImage := testnet.Provision_InspectImageRequest
+            inspectImage.Path = "/images/mysql:5.7/json"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,pullImageRequest("mysql","5.7",`{"status":"Pulling from library/mysql","id":"5.7"}{"status":"Download complete","id":"a3ed95caeb02"}`),provision_CreateTaggedContainerRequest,inspectImage,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200",
+                Numinstances: 1, Tag: "5.7"}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+            persister.AddOperation(brokerapi.Operation{Id: "myFakeOperation", InstanceId: "myFakeInstance", Type: brokerapi.OperationProvision,
+                State: brokerapi.OperationInProgress, StartedAt: time.Now(), UpdatedAt: time.Now()})
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql",
+                    PlanId:     "mysql_200",
+                    OperationId: "myFakeOperation",
+                }            
+            _, err := brokerservice.Provision(pr)
+            Expect(err).To(BeNil())
+
+            op,err := persister.GetOperation("myFakeInstance", "", "myFakeOperation")
+            Expect(err).To(BeNil())
+            Expect(op.Description).To(Equal("Pulling mysql:5.7: 5.7 Pulling from library/mysql"))
+        })
+
+        It("should send the registry credentials when pulling an image", func() {
+            inspectImage := testnet.Provision_InspectImageRequest
+            inspectImage.Path = "/images/mysql:5.7/json"
+            pullImage := pullImageRequest("mysql","5.7",`{"status":"Download complete","id":"a3ed95caeb02"}`)
+            pullImage.Header["X-Registry-Auth"] = []string{"eyJlbWFpbCI6ImRldkBleGFtcGxlLmNvbSIsInBhc3N3b3JkIjoic2VjcmV0Iiwic2VydmVyYWRkcmVzcyI6ImRvY2tlci5pbyIsInVzZXJuYW1lIjoiZGV2In0="}
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,pullImage,provision_CreateTaggedContainerRequest,inspectImage,testnet.Provision_StartContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200",
+                Numinstances: 1, Tag: "5.7"}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+            persister.AddRegistryAuthConf(brokerapi.RegistryAuth{Registry: "docker.io", Username: "dev", Password: "secret", Email: "dev@example.com"})
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql",
+                    PlanId:     "200",
+                }            
+            _, err := brokerservice.Provision(pr)
+            Expect(err).To(BeNil())
+        })
+
+        It("should fail to provision when the image cannot be pulled", func() {
+            digest := "sha256:2a2ba1ab2d0d8e8e5d8e1ca3d4b1b8f1a3b2c9a1d1f6d2a6d1b1b8f1a3b2c9a1"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_ListAllImagesRequest,pullImageRequest("mysql",digest,`{"error":"manifest unknown"}`)})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200",
+                Numinstances: 1, Digest: digest}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql",
+                    PlanId:     "200",
+                }            
+            _, err := brokerservice.Provision(pr)
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(Equal("Failed to pull image mysql@"+digest+" (manifest unknown)"))
+        })
+
+        It("should fail to provision a plan that is not offered", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "mysql_999",
+                }            
+            _, err := brokerservice.Provision(pr)
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(Equal("Plan mysql_999 is not offered for mysql"))
+        })
+
+        It("should update the plan of a service by replacing its container", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_InspectContainerRequest,testnet.Provision_ListAllImagesRequest,testnet.Deprovision_StopContainerRequest,update_RenameContainerRequest,update_CreateContainerRequest,update_StartContainerRequest,testnet.Deprovision_RemoveContainerRequest})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234",  "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+            persister.AddImageConf(persister.GetServiceId("My Docker Catalog"), "mysql", "200",
+                `{"dashboard_url":"mysql://fakehost:1234"}`, "", 1, "")
+
+            ur := brokerapi.UpdateRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "mysql_200",
+                }
+            err = brokerservice.Update(ur)
+            Expect(err).To(BeNil())
+
+            cId,_ := persister.GetContainerIdAndImageName("myFakeInstance")
+            Expect(cId).To(Equal("myFakeNewContainer"))
+            Expect(persister.GetServiceInstancePlan("myFakeInstance")).To(Equal("mysql_200"))
+        })
+
+        It("should keep the volumes of a service over two changes of its plan", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{
+                update_InspectContainerRequest("myFakeInstance",`null`),testnet.Provision_ListAllImagesRequest,update_StopContainerRequest("myFakeInstance"),update_RenameRequest("myFakeInstance"),
+                update_CreateRequest("myFakeNewContainer"),update_StartRequest("myFakeNewContainer",`["myFakeInstance_var_lib_mysql:/var/lib/mysql"]`),update_RemoveContainerRequest("myFakeInstance"),
+                update_InspectContainerRequest("myFakeNewContainer",`["myFakeInstance_var_lib_mysql:/var/lib/mysql"]`),testnet.Provision_ListAllImagesRequest,update_StopContainerRequest("myFakeNewContainer"),update_RenameRequest("myFakeNewContainer"),
+                update_CreateRequest("myFakeThirdContainer"),update_StartRequest("myFakeThirdContainer",`["myFakeInstance_var_lib_mysql:/var/lib/mysql","myFakeInstance_var_log_mysql:/var/log/mysql"]`),update_RemoveContainerRequest("myFakeNewContainer")})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234",  "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+            serviceid := persister.GetServiceId("My Docker Catalog")
+            persister.AddImagePlanConf(serviceid, brokerapi.ImageDefinition{Name: "mysql", Plan: "200", Numinstances: 1,
+                Volumes: []string{"/var/lib/mysql"}}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+            persister.AddImagePlanConf(serviceid, brokerapi.ImageDefinition{Name: "mysql", Plan: "300", Numinstances: 1,
+                Volumes: []string{"/var/lib/mysql","/var/log/mysql"}}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+
+            err = brokerservice.Update(brokerapi.UpdateRequest{InstanceId: "myFakeInstance", PlanId: "mysql_200"})
+            Expect(err).To(BeNil())
+            err = brokerservice.Update(brokerapi.UpdateRequest{InstanceId: "myFakeInstance", PlanId: "mysql_300"})
+            Expect(err).To(BeNil())
+            Expect(handler.CallCount).To(Equal(14))
+
+            cId,_ := persister.GetContainerIdAndImageName("myFakeInstance")
+            Expect(cId).To(Equal("myFakeThirdContainer"))
+            volumes,err := persister.GetServiceVolumes("myFakeInstance")
+            Expect(err).To(BeNil())
+            Expect(volumes).To(HaveLen(1))
+            Expect(volumes[0].Path).To(Equal("/var/log/mysql"))
+        })
+
+        It("should replace the container of a service by one of the image of the new plan", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{
+                update_InspectContainerRequest("myFakeInstance",`null`),testnet.Provision_ListAllImagesRequest,update_StopContainerRequest("myFakeInstance"),update_RenameRequest("myFakeInstance"),
+                update_CreateImageRequest("myFakeNewContainer","mysql:5.6.19"),update_StartRequest("myFakeNewContainer",`["myFakeInstance_var_lib_mysql:/var/lib/mysql"]`),update_RemoveContainerRequest("myFakeInstance")})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234",  "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200", Numinstances: 1,
+                Tag: "5.6.19"}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+
+            err = brokerservice.Update(brokerapi.UpdateRequest{InstanceId: "myFakeInstance", PlanId: "mysql_200"})
+            Expect(err).To(BeNil())
+            Expect(handler.CallCount).To(Equal(7))
+
+            cId,_ := persister.GetContainerIdAndImageName("myFakeInstance")
+            Expect(cId).To(Equal("myFakeNewContainer"))
+        })
+
+        It("should record the new container of a service when the update executable fails", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{
+                update_InspectContainerRequest("myFakeInstance",`null`),testnet.Provision_ListAllImagesRequest,update_StopContainerRequest("myFakeInstance"),update_RenameRequest("myFakeInstance"),
+                update_CreateRequest("myFakeNewContainer"),update_StartRequest("myFakeNewContainer",`["myFakeInstance_var_lib_mysql:/var/lib/mysql"]`),update_RemoveContainerRequest("myFakeInstance"),
+                update_FailCreateExecRequest("myFakeNewContainer")})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "",  "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200", Numinstances: 1,
+                Volumes: []string{"/var/lib/mysql"}}, "", "")
+
+            err = brokerservice.Update(brokerapi.UpdateRequest{InstanceId: "myFakeInstance", PlanId: "mysql_200"})
+            Expect(err).ShouldNot(BeNil())
+            Expect(handler.CallCount).To(Equal(8))
+
+            cId,_ := persister.GetContainerIdAndImageName("myFakeInstance")
+            Expect(cId).To(Equal("myFakeNewContainer"))
+            Expect(persister.GetServiceInstancePlan("myFakeInstance")).To(Equal("mysql_200"))
+        })
+
+        It("should fail to update to a plan that is not offered", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234",  "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+
+            err = brokerservice.Update(brokerapi.UpdateRequest{InstanceId: "myFakeInstance", PlanId: "mysql_999"})
+            Expect(err).ShouldNot(BeNil())
+            Expect(persister.GetServiceInstancePlan("myFakeInstance")).To(Equal("100"))
+        })
+
         It("should bind a service", func() {
-            persister.Connect()
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_InspectContainerRequest})    
             defer ts.Close()
 
@@ -104,12 +483,271 @@ var _ = Describe("Dockerclient", func() {
             Expect(creds["username"]).To(Equal("fakeUser"))
             Expect(creds["password"]).To(Equal("fakePassword"))
             Expect(creds["database"]).To(Equal("fakeDB"))
-            Expect(somestr).To(Equal("unknown"))
+            Expect(somestr).To(BeEmpty())
+        })
+
+        It("should hand out the syslog drain of images requiring it", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_InspectContainerRequest,testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "300",
+                Numinstances: 1, Requires: []string{brokerapi.RequiresSyslogDrain}, SyslogDrainUrl: "syslog-tls://$HOST:6514"},
+                "", `{"uri":"mysql://$HOST:$PORT"}`)
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    AppId:      "myFakeApp",
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql",
+                    PlanId:     "mysql_300",
+                }            
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+            
+            _,creds,drainurl,err := brokerservice.Bind(br)
+            Expect(err).To(BeNil())
+            Expect(creds["uri"]).To(HavePrefix("mysql://"+serviceagent.ServiceHost))
+            Expect(drainurl).To(Equal("syslog-tls://"+serviceagent.ServiceHost+":6514"))
+            binding,err := persister.GetServiceBinding("myFakeInstance", "fakeBindId")
+            Expect(err).To(BeNil())
+            Expect(binding.SyslogDrainUrl).To(Equal(drainurl))
+        })
+
+        It("should refuse to hand out a syslog drain Cloud Foundry cannot drain to", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{bind_CreateDrainExecRequest,startExecRequest(`{}`,execFrame(1,`{"user":"fakeUser","syslog_drain_url":"ftp://$HOST"}`)),inspectExecRequest(0),testnet.Provision_InspectContainerRequest,
+                                                                                                                                revoke_CreateExecRequest,startExecRequest(`{"user":"fakeUser"}`,""),inspectExecRequest(0)})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "300",
+                Numinstances: 1, Requires: []string{brokerapi.RequiresSyslogDrain}}, "", "")
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    AppId:      "myFakeApp",
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql",
+                    PlanId:     "mysql_300",
+                }            
+            persister.AddServiceInstance("mysql", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "mysql", pr, time.Now())    
+            
+            _,_,_,err := brokerservice.Bind(br)
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(HavePrefix("Invalid syslog drain URL"))
+            _,err = persister.GetServiceBinding("myFakeInstance", "fakeBindId")
+            Expect(err).ShouldNot(BeNil())
+            //the credentials /bind handed out are revoked again
+            Expect(handler.CallCount).To(Equal(7))
+        })
+
+
+        It("should revoke the credentials of a binding it fails to record", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{bind_CreateExecRequest,startExecRequest(`{"readonly":true}`,execFrame(1,`{"user":"fakeNewUser"}`)),inspectExecRequest(0),testnet.Provision_InspectContainerRequest,
+                                                                                                                                revoke_CreateExecRequest,startExecRequest(`{"user":"fakeNewUser"}`,""),inspectExecRequest(0)})    
+            defer ts.Close()
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    AppId:      "myFakeApp",
+                    Parameters: map[string]interface{}{"readonly":true},
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+            persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "fakeBindId", AppId: "myFakeApp",
+                                        Credentials: brokerapi.Credentials{"user":"fakeUser"}}, time.Now())
+
+            _,_,_,err := brokerservice.Bind(br)
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(HavePrefix("Failed to record service binding"))
+            Expect(handler.CallCount).To(Equal(7))
+            binding,err := persister.GetServiceBinding("myFakeInstance", "fakeBindId")
+            Expect(err).To(BeNil())
+            Expect(binding.Credentials).To(Equal(brokerapi.Credentials{"user":"fakeUser"}))
+        })
+
+        It("should pass the bind parameters to the bind executable", func() {
+            //the executor simply echoes back what it receives on stdin
+            serviceagent.ExecCommand = "DockerCommandExec"
+            serviceagent.ExecArgs = "/bin/sh,-c,cat"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                    AppId:      "myFakeApp",
+                    Parameters: map[string]interface{}{"user":"readonly","url":"$HOST"},
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+            
+            _,creds,_,err := brokerservice.Bind(br)
+            Expect(err).To(BeNil())
+            Expect(creds["user"]).To(Equal("readonly"))
+            Expect(creds["url"]).To(Equal(serviceagent.ServiceHost))
+        })
+
+        It("should bind a service through the docker exec API", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{bind_CreateExecRequest,startExecRequest(`{"readonly":true}`,execFrame(1,`{"user":"fakeUser","url":"$HOST"}`)+execFrame(2,"warning")),inspectExecRequest(0),testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                    AppId:      "myFakeApp",
+                    Parameters: map[string]interface{}{"readonly":true},
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+            
+            _,creds,_,err := brokerservice.Bind(br)
+            Expect(err).To(BeNil())
+            Expect(creds["user"]).To(Equal("fakeUser"))
+            Expect(creds["url"]).To(Equal(serviceagent.ServiceHost))
+
+            //the credentials of the binding are kept encrypted
+            Expect(bindingIsEncrypted(persister,"myFakeInstance","fakeBindId")).To(BeTrue())
+            binding,err := persister.GetServiceBinding("myFakeInstance", "fakeBindId")
+            Expect(err).To(BeNil())
+            Expect(binding.Credentials).To(Equal(creds))
+        })
+
+        It("should neither serve nor log the secrets of a binding", func() {
+            var logs bytes.Buffer
+            log.SetOutput(&logs)
+            defer log.SetOutput(os.Stderr)
+
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{bind_CreateExecRequest,startExecRequest(`{"readonly":"fakeInputSecret"}`,execFrame(1,`{"user":"fakeUser","password":"fakeBindSecret","uri":"mysql://fakeUser:fakeBindSecret@$HOST:$PORT"}`)),inspectExecRequest(0),testnet.Provision_InspectContainerRequest})    
+            defer ts.Close()
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    AppId:      "myFakeApp",
+                    Parameters: map[string]interface{}{"readonly":"fakeInputSecret"},
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+
+            _,creds,_,err := brokerservice.Bind(br)
+            Expect(err).To(BeNil())
+            Expect(creds["password"]).To(Equal("fakeBindSecret"))
+            Expect(creds["uri"]).To(HavePrefix("mysql://fakeUser:fakeBindSecret@"+serviceagent.ServiceHost))
+
+            Expect(bindingIsEncrypted(persister,"myFakeInstance","fakeBindId")).To(BeTrue())
+
+            Expect(logs.String()).Should(ContainSubstring("password"))
+            Expect(logs.String()).ShouldNot(ContainSubstring("fakeBindSecret"))
+            Expect(logs.String()).ShouldNot(ContainSubstring("fakeInputSecret"))
+        })
+
+        It("should hand the credentials of the binding to the unbind executable", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{unbind_CreateExecRequest,startExecRequest(`{"user":"fakeUser"}`,""),inspectExecRequest(0)})    
+            defer ts.Close()
+
+            identity := &brokerapi.OriginatingIdentity{Platform: "cloudfoundry", Value: map[string]interface{}{"user_id":"683ea748"}}
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                    OriginatingIdentity: identity,
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+            persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: "myFakeInstance", BindingId: "fakeBindId", AppId: "myFakeApp",
+                                        Credentials: brokerapi.Credentials{"user":"fakeUser"}}, time.Now())
+            
+            err := brokerservice.Unbind(br)
+            Expect(err).To(BeNil())
+            Expect(handler.CallCount).To(Equal(3))
+            _,err = persister.GetServiceBinding("myFakeInstance", "fakeBindId")
+            Expect(err).ShouldNot(BeNil())
+
+            events,err := persister.GetAuditEvents("myFakeInstance")
+            Expect(err).To(BeNil())
+            Expect(events).To(HaveLen(1))
+            Expect(events[0].Operation).To(Equal(brokerapi.OperationUnbind))
+            Expect(events[0].BindingId).To(Equal("fakeBindId"))
+            Expect(events[0].OriginatingIdentity).To(Equal(identity))
         })
 
+        It("should fail to deprovision a service when the exec API reports a failure", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{deprovision_CreateExecRequest,startExecRequest("",execFrame(2,"no database")),inspectExecRequest(3)})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+            
+            err := brokerservice.Deprovision(pr)
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(Equal("Failed to run deprovision (/deprovision exited with 3: no database)"))
+            cId,_ := persister.GetContainerIdAndImageName(pr.InstanceId)
+            Expect(cId).To(Equal("myFakeInstance"))
+        })
+
+        It("should deprovision a service whose container is already gone", func() {
+            serviceagent.ExecCommand = "DockerAPIExec"
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{
+                deprovision_MissingRequest("POST","/containers/myFakeInstance/exec"),deprovision_MissingRequest("POST","/containers/myFakeInstance/stop?t=0"),
+                deprovision_MissingRequest("DELETE","/containers/myFakeInstance")})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "200",
+                }            
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "ubuntu", Plan: "200", Numinstances: 1}, "", "")
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeInstance", "ubuntu", pr, time.Now())    
+            
+            err := brokerservice.Deprovision(pr)
+            Expect(err).To(BeNil())
+            Expect(handler.CallCount).To(Equal(3))
+            cId,_ := persister.GetContainerIdAndImageName(pr.InstanceId)
+            Expect(cId).To(BeEmpty())
+        })
 
         It("should unbind a service", func() {
-            persister.Connect()
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Deprovision_StopContainerRequest, testnet.Deprovision_RemoveContainerRequest})    
             defer ts.Close()
 
@@ -130,7 +768,7 @@ var _ = Describe("Dockerclient", func() {
             persister.AddServiceInstance("mysql:latest", 1234, 49153, 
             "mysql://fakehost:1234", "myFakeContainerId", "fakehost", 
             "myFakeContainer", "mysql", pr, time.Now())    
-            persister.AddServiceBinding(br.InstanceId, br.BindingId, br.AppId, time.Now())
+            persister.AddServiceBinding(brokerapi.ServiceBinding{InstanceId: br.InstanceId, BindingId: br.BindingId, AppId: br.AppId}, time.Now())
             
             err := brokerservice.Unbind(br)
             Expect(err).To(BeNil())
@@ -138,7 +776,6 @@ var _ = Describe("Dockerclient", func() {
 
 
         It("should deprovision a service", func() {
-            persister.Connect()
             brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Deprovision_StopContainerRequest, testnet.Deprovision_RemoveContainerRequest})    
             defer ts.Close()
 
@@ -152,9 +789,101 @@ var _ = Describe("Dockerclient", func() {
             persister.AddServiceInstance("mysql:latest", 1234, 49153, 
             "mysql://fakehost:1234", "myFakeInstance", "fakehost", 
             "myFakeContainer", "mysql", pr, time.Now())    
+            persister.AddorUpdateServiceAgent(serviceagent)
+            persister.WritePortBinding([]int{49152,49153}, serviceagent.DockerHost)
+            
+            err := brokerservice.Deprovision(pr)
+            Expect(err).To(BeNil())
+            //the host port goes back to the pool, not the port of the service
+            _,_,pb,err := persister.GetPortBindings(serviceagent.DockerHost)
+            Expect(err).To(BeNil())
+            Expect(pb).To(Equal([]int{49152}))
+        })
+
+        It("should remove the volumes of a deprovisioned service", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Deprovision_StopContainerRequest, testnet.Deprovision_RemoveContainerRequest, deprovision_RemoveVolumeRequest})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234", "myFakeInstance", "fakehost", 
+            "myFakeContainer", "mysql", pr, time.Now())    
+            persister.AddServiceVolume(brokerapi.ServiceVolume{InstanceId: "myFakeInstance", Path: "/var/lib/mysql",
+                                                              Source: "myFakeInstance_var_lib_mysql"})
             
             err := brokerservice.Deprovision(pr)
             Expect(err).To(BeNil())
+            volumes,_ := persister.GetServiceVolumes("myFakeInstance")
+            Expect(volumes).To(BeEmpty())
+        })
+
+        It("should retain the volumes of a deprovisioned service when its plan says so", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{testnet.Deprovision_StopContainerRequest, testnet.Deprovision_RemoveContainerRequest})    
+            defer ts.Close()
+
+            persister.AddImagePlanConf(persister.GetServiceId("My Docker Catalog"), brokerapi.ImageDefinition{Name: "mysql", Plan: "200",
+                Numinstances: 1, Volumes: []string{"/var/lib/mysql"}, RetainVolumes: true}, `{"dashboard_url":"mysql://fakehost:1234"}`, "")
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "200",
+                }            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234", "myFakeInstance", "fakehost", 
+            "myFakeContainer", "mysql", pr, time.Now())    
+            persister.AddServiceVolume(brokerapi.ServiceVolume{InstanceId: "myFakeInstance", Path: "/var/lib/mysql",
+                                                              Source: "myFakeInstance_var_lib_mysql"})
+            
+            err := brokerservice.Deprovision(pr)
+            Expect(err).To(BeNil())
+            volumes,_ := persister.GetServiceVolumes("myFakeInstance")
+            Expect(volumes).Should(HaveLen(1))
+        })
+
+        It("should fail to deprovision a service when the deprovision script cannot run", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "ubuntu",
+                    PlanId:     "100",
+                    OrgId:      "myFakeOrg",
+                    SpaceId:    "myFakeSpace",
+                }            
+            
+            persister.AddServiceInstance("ubuntu", 1234, 49153, 
+            "", "myFakeInstance", "fakehost", 
+            "myFakeContainer", "ubuntu", pr, time.Now())    
+            
+            err := brokerservice.Deprovision(pr)
+            Expect(err).ShouldNot(BeNil())
+            Expect(err.Error()).To(Equal("No Executor specified"))
+
+            cId,_ := persister.GetContainerIdAndImageName(pr.InstanceId)
+            Expect(cId).To(Equal("myFakeInstance"))
+        })
+
+        It("should fail to unbind a binding that does not exist", func() {
+            brokerservice,serviceagent,ts,handler = testnet.NewBrokerServiceWithMultipleRequests(serviceagent,persister, []testnet.TestRequest{})    
+            defer ts.Close()
+
+            br := brokerapi.BindingRequest {InstanceId: "myFakeInstance",
+                    BindingId:  "fakeBindId",
+                }            
+            pr := brokerapi.ProvisioningRequest {InstanceId: "myFakeInstance",
+                    ServiceId:  "mysql:latest",
+                    PlanId:     "100",
+                }            
+            
+            persister.AddServiceInstance("mysql:latest", 1234, 49153, 
+            "mysql://fakehost:1234", "myFakeContainerId", "fakehost", 
+            "myFakeContainer", "mysql", pr, time.Now())    
+            
+            err := brokerservice.Unbind(br)
+            Expect(err).Should(BeAssignableToTypeOf(&dockerapi.CFError{}))
+            Expect(err.(*dockerapi.CFError).Code()).To(Equal(brokerapi.ErrCodeGone))
         })
 
     })
@@ -168,4 +897,331 @@ var emptyGetRequest = testnet.NewTestRequest(testnet.TestRequest{
     Response: testnet.TestResponse{
         Status: http.StatusOK,
     },
-})    
+})
+
+var update_RenameContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/rename?name=myFakeInstance_previous",
+    Response: testnet.TestResponse{
+        Status: http.StatusNoContent,
+    },
+})
+
+var update_CreateContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/create?name=myFakeInstance",
+    Response: testnet.TestResponse{
+        Status: http.StatusCreated,
+        Body : `{
+            "Id":"myFakeNewContainer",
+            "Warnings":[]
+        }`,
+    },
+})
+
+var update_StartContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeNewContainer/start",
+    Matcher: testnet.RequestBodyMatcher(`{"ContainerIDFile": "","Privileged": false,"PublishAllPorts": false,"NetworkMode": "","Binds": null,"PortBindings": {"80/tcp": [{"HostIp": "0.0.0.0","HostPort": "49153"}]},"Links": ["/name:alias"],"Dns": null,"DnsSearch": null,"VolumesFrom": null,"LxcConf": [],"RestartPolicy": {"Name": "","MaximumRetryCount": 0}}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusNoContent,
+    },
+})
+
+// A container the instance runs in, its volume shows up as mount whether it was bound or not.
+func update_InspectContainerRequest(id, binds string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "GET",
+        Path:    "/containers/"+id+"/json",
+        Response: testnet.TestResponse{
+            Status: http.StatusOK,
+            Body : `{"Id": "`+id+`","Config": {"Image": "mysql","Volumes": {"/var/lib/mysql": {}}},
+                     "Mounts": [{"Type": "volume","Name": "myFakeInstance_var_lib_mysql","Source": "/var/lib/docker/volumes/myFakeInstance_var_lib_mysql/_data",
+                                 "Destination": "/var/lib/mysql","RW": true}],
+                     "HostConfig": {"Binds": `+binds+`,"PortBindings": {"3306/tcp": [{"HostIp": "","HostPort": "49153"}]},"VolumesFrom": null}}`,
+        },
+    })
+}
+
+func update_StopContainerRequest(id string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/containers/"+id+"/stop?t=0",
+        Response: testnet.TestResponse{
+            Status: http.StatusNoContent,
+        },
+    })
+}
+
+func update_RenameRequest(id string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/containers/"+id+"/rename?name=myFakeInstance_previous",
+        Response: testnet.TestResponse{
+            Status: http.StatusNoContent,
+        },
+    })
+}
+
+func update_CreateRequest(newId string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/containers/create?name=myFakeInstance",
+        Response: testnet.TestResponse{
+            Status: http.StatusCreated,
+            Body : `{"Id":"`+newId+`","Warnings":[]}`,
+        },
+    })
+}
+
+// The new container gets the mounts passed as binds, never the volumes of the container it replaces.
+func update_StartRequest(id, binds string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/containers/"+id+"/start",
+        Matcher: testnet.RequestBodyMatcher(`{"ContainerIDFile": "","Privileged": false,"PublishAllPorts": false,"NetworkMode": "","Binds": `+binds+`,"PortBindings": {"3306/tcp": [{"HostIp": "","HostPort": "49153"}]},"Links": null,"Dns": null,"DnsSearch": null,"VolumesFrom": null,"LxcConf": null,"RestartPolicy": {"Name": "","MaximumRetryCount": 0}}`),
+        Response: testnet.TestResponse{
+            Status: http.StatusNoContent,
+        },
+    })
+}
+
+func update_RemoveContainerRequest(id string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "DELETE",
+        Path:    "/containers/"+id,
+        Response: testnet.TestResponse{
+            Status: http.StatusNoContent,
+        },
+    })
+}
+
+func update_CreateImageRequest(newId, image string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/containers/create?name=myFakeInstance",
+        Matcher: func(request *http.Request) {
+            defer GinkgoRecover()
+            var config dockerapi.ContainerConfig
+            err := json.NewDecoder(request.Body).Decode(&config)
+            Expect(err).To(BeNil())
+            Expect(config.Image).To(Equal(image))
+        },
+        Response: testnet.TestResponse{
+            Status: http.StatusCreated,
+            Body : `{"Id":"`+newId+`","Warnings":[]}`,
+        },
+    })
+}
+
+func deprovision_MissingRequest(method, path string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  method,
+        Path:    path,
+        Response: testnet.TestResponse{
+            Status: http.StatusNotFound,
+        },
+    })
+}
+
+func update_FailCreateExecRequest(id string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/containers/"+id+"/exec",
+        Response: testnet.TestResponse{
+            Status: http.StatusInternalServerError,
+        },
+    })
+}
+
+var provision_CreateExistingContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/create?name=myFakeInstance",
+    Response: testnet.TestResponse{
+        Status: http.StatusConflict,
+    },
+})
+
+var provision_FailStartContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/start",
+    Response: testnet.TestResponse{
+        Status: http.StatusInternalServerError,
+    },
+})
+
+var provision_CreatePlanContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/create?name=myFakeInstance",
+    Matcher: testnet.RequestBodyMatcher(`{"User": "","Memory": 536870912,"PortSpecs": null,"StdinOnce": false,
+                    "Image": "mysql","Domainname": "","Cpuset": "0-1","AttachStderr": false,"ExposedPorts": null,"Tty": false,"Cmd": null,"MemorySwap": 1073741824,"CpuShares": 512,"AttachStdin": false,"OpenStdin": false,"WorkingDir": "","NetworkDisabled": false,"OnBuild": null,
+                    "Hostname": "myFakeInstance","AttachStdout": false,"Env": ["MYSQL_CHARSET=utf8"],"Volumes": null,"Entrypoint": null}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusOK,
+        Body : `{
+            "Id":"myFakeInstance",
+            "Warnings":[]
+        }`,
+    },
+})
+
+var provision_CreateVolumeContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/create?name=myFakeInstance",
+    Matcher: testnet.RequestBodyMatcher(`{"User": "","Memory": 0,"PortSpecs": null,"StdinOnce": false,
+                    "Image": "mysql","Domainname": "","Cpuset": "","AttachStderr": false,"ExposedPorts": null,"Tty": false,"Cmd": null,"MemorySwap": 0,"CpuShares": 0,"AttachStdin": false,"OpenStdin": false,"WorkingDir": "","NetworkDisabled": false,"OnBuild": null,
+                    "Hostname": "myFakeInstance","AttachStdout": false,"Env": null,"Volumes": {"/var/lib/mysql": {}},"Entrypoint": null}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusOK,
+        Body : `{
+            "Id":"myFakeInstance",
+            "Warnings":[]
+        }`,
+    },
+})
+
+var provision_StartVolumeContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/start",
+    Matcher: testnet.RequestBodyMatcher(`{"ContainerIDFile": "","Privileged": false,"PublishAllPorts": true,"NetworkMode": "bridge","Binds": ["myFakeInstance_var_lib_mysql:/var/lib/mysql"],"PortBindings": null,"Links": null,"Dns": null,"DnsSearch": null,"VolumesFrom": null,"LxcConf": null,"RestartPolicy": {"Name": "","MaximumRetryCount": 0}}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusOK,
+    },
+})
+
+var deprovision_RemoveVolumeRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "DELETE",
+    Path:    "/volumes/myFakeInstance_var_lib_mysql",
+    Response: testnet.TestResponse{
+        Status: http.StatusNoContent,
+    },
+})
+
+var bind_CreateExecRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/exec",
+    Matcher: testnet.RequestBodyMatcher(`{"AttachStdin": true,"AttachStdout": true,"AttachStderr": true,"Tty": false,
+                    "Cmd": ["/bind","fakeBindId","myFakeApp"]}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusCreated,
+        Body : `{"Id":"myFakeExec"}`,
+    },
+})
+
+var bind_CreateDrainExecRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/exec",
+    Matcher: testnet.RequestBodyMatcher(`{"AttachStdin": true,"AttachStdout": true,"AttachStderr": true,"Tty": false,
+                    "Cmd": ["/bind","fakeBindId","myFakeApp"]}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusCreated,
+        Body : `{"Id":"myFakeExec"}`,
+    },
+})
+
+var unbind_CreateExecRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/exec",
+    Matcher: testnet.RequestBodyMatcher(`{"AttachStdin": true,"AttachStdout": true,"AttachStderr": true,"Tty": false,
+                    "Cmd": ["env","BROKER_ORIGINATING_IDENTITY={\"platform\":\"cloudfoundry\",\"value\":{\"user_id\":\"683ea748\"}}","/unbind","fakeBindId"]}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusCreated,
+        Body : `{"Id":"myFakeExec"}`,
+    },
+})
+
+var revoke_CreateExecRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/exec",
+    Matcher: testnet.RequestBodyMatcher(`{"AttachStdin": true,"AttachStdout": true,"AttachStderr": true,"Tty": false,
+                    "Cmd": ["/unbind","fakeBindId"]}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusCreated,
+        Body : `{"Id":"myFakeExec"}`,
+    },
+})
+
+var deprovision_CreateExecRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/myFakeInstance/exec",
+    Matcher: testnet.RequestBodyMatcher(`{"AttachStdin": false,"AttachStdout": true,"AttachStderr": true,"Tty": false,
+                    "Cmd": ["/deprovision"]}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusCreated,
+        Body : `{"Id":"myFakeExec"}`,
+    },
+})
+
+// the exec answers with output once it read stdin from the hijacked connection
+func startExecRequest(stdin, output string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/exec/myFakeExec/start",
+        Matcher: testnet.RequestBodyMatcher(`{"Detach": false,"Tty": false}`),
+        Stdin:   stdin,
+        Response: testnet.TestResponse{
+            Status: http.StatusOK,
+            Body : output,
+        },
+    })
+}
+
+func inspectExecRequest(exitcode int) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "GET",
+        Path:    "/exec/myFakeExec/json",
+        Response: testnet.TestResponse{
+            Status: http.StatusOK,
+            Body : fmt.Sprintf(`{"Running":false,"ExitCode":%d}`, exitcode),
+        },
+    })
+}
+
+// frame of the multiplexed stdout/stderr stream of docker
+func execFrame(stream byte, payload string) string {
+    return string([]byte{stream, 0, 0, 0, 0, 0, byte(len(payload) >> 8), byte(len(payload))}) + payload
+}
+
+var provision_CreateTaggedContainerRequest = testnet.NewTestRequest(testnet.TestRequest{
+    Method:  "POST",
+    Path:    "/containers/create?name=myFakeInstance",
+    Matcher: testnet.RequestBodyMatcher(`{"User": "","Memory": 0,"PortSpecs": null,"StdinOnce": false,
+                    "Image": "mysql:5.7","Domainname": "","Cpuset": "","AttachStderr": false,"ExposedPorts": null,"Tty": false,"Cmd": null,"MemorySwap": 0,"CpuShares": 0,"AttachStdin": false,"OpenStdin": false,"WorkingDir": "","NetworkDisabled": false,"OnBuild": null,
+                    "Hostname": "myFakeInstance","AttachStdout": false,"Env": null,"Volumes": null,"Entrypoint": null}`),
+    Response: testnet.TestResponse{
+        Status: http.StatusOK,
+        Body : `{
+            "Id":"myFakeInstance",
+            "Warnings":[]
+        }`,
+    },
+})
+
+// PEM encoded key pair of a TLS test server, its certificate is self signed so it is the CA as well.
+func tlsMaterial(ts *httptest.Server) ([]byte, []byte, []byte) {
+    cert := ts.TLS.Certificates[0]
+    key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+    Expect(err).To(BeNil())
+    certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+    return certpem, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), certpem
+}
+
+func pullImageRequest(name, tag, progress string) testnet.TestRequest {
+    return testnet.NewTestRequest(testnet.TestRequest{
+        Method:  "POST",
+        Path:    "/images/create?fromImage="+name+"&tag="+tag,
+        Response: testnet.TestResponse{
+            Status: http.StatusOK,
+            Body : progress,
+        },
+    })
+}
+
+// the binding cannot be read with another key when its credentials are kept encrypted
+func bindingIsEncrypted(persister brokerapi.Store, instanceid, bindingid string) bool {
+    store := persister.(*brokerapi.MemoryStore)
+    store.EncryptionKey = testnet.NewEncryptionKey
+    defer func() { store.EncryptionKey = testnet.EncryptionKey }()
+    _, err := store.GetServiceBinding(instanceid, bindingid)
+    return err != nil
+}
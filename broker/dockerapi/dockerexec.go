@@ -6,91 +6,320 @@ import (
     "log"
     "bytes"
     "encoding/json"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sort"
     "strings"
 )
 
 type DockerExec interface {
-    Provision()   (map[string] interface{},error)
-    Bind()    (map[string] interface{},error)
-    Unbind(serviceurl string)      (map[string] interface{},error)
+    Provision(parameters map[string] interface{})   (map[string] interface{},error)
+    Bind(bindingid, appid string, parameters map[string] interface{})    (map[string] interface{},error)
+    Unbind(bindingid string, credentials map[string] interface{})      (map[string] interface{},error)
     Deprovision() (map[string] interface{},error)
+    Update(parameters map[string] interface{}) (map[string] interface{},error)
     
-    Init(*DockerClient,string,*brokerapi.ImageDefinition) DockerExec
+    //env holds the variables the lifecycle executables are run with
+    Init(client *DockerClient, cId string, image *brokerapi.ImageDefinition, env []string) DockerExec
 }
 
 var CommandExecutors = map[string] DockerExec { 
     "DockerCommandExec" : DockerCommandExec{},
+    "DockerAPIExec"     : DockerAPIExec{},
     }
 
+// Runs a command in the container of the service instance, the lifecycle calls
+// below are the same for every way of getting into the container.
+type commandRunner interface {
+    ExecIn(command []string, input []byte) (map[string] interface{}, error)
+}
+
+
+// The context of the platform and the originating identity of the request are handed to the
+// lifecycle executables as JSON in BROKER_CONTEXT and BROKER_ORIGINATING_IDENTITY.
+func lifecycleEnvironment(context map[string] interface{}, identity *brokerapi.OriginatingIdentity) []string {
+    env := []string{}
+    if len(context) > 0 {
+        if data, err := json.Marshal(context); err == nil {
+            env = append(env, "BROKER_CONTEXT="+string(data))
+        }
+    }
+    if identity != nil {
+        if data, err := json.Marshal(identity); err == nil {
+            env = append(env, "BROKER_ORIGINATING_IDENTITY="+string(data))
+        }
+    }
+    return env
+}
+
+// Sets the variables through env(1), the exec API of older docker daemons cannot set any.
+func withEnvironment(command []string, env []string) []string {
+    if len(env) == 0 {
+        return command
+    }
+    return append(append([]string{ "env" }, env...), command...)
+}
 
 type DockerCommandExec struct {
     client *DockerClient
     cId    string
     image *brokerapi.ImageDefinition
+    env   []string
 }
 
-func (dcexec DockerCommandExec) Init(client *DockerClient ,cId string,image *brokerapi.ImageDefinition) DockerExec {
-    return &DockerCommandExec{client,cId,image}
+func (dcexec DockerCommandExec) Init(client *DockerClient ,cId string,image *brokerapi.ImageDefinition, env []string) DockerExec {
+    return &DockerCommandExec{client,cId,image,env}
 }
 
-func (dcexec *DockerCommandExec) ExecIn (command []string) (map[string] interface{}, error) {
+// Runs command inside the container, input (if any) is fed to its stdin.
+func (dcexec *DockerCommandExec) ExecIn (command []string, input []byte) (map[string] interface{}, error) {
     execargs := strings.Split( dcexec.client.ServiceAgent.ExecArgs, "," )
     if execargs[0] == "" {
       execargs = []string{}
     }
     execargs = append( execargs, "docker-enter", dcexec.cId )
-    execargs = append( execargs, command... )
+    execargs = append( execargs, withEnvironment(command, dcexec.env)... )
 
     log.Println( "ExecIn.args[0]:", execargs[0] )
     log.Println( "ExecIn.args[:]:", execargs )
 
     cmd := exec.Command(execargs[0], execargs[1:]...)
-    log.Println( "ExecIn.cmd:", cmd)        
+    if len(input) > 0 {
+        cmd.Stdin = bytes.NewReader(input)
+    }
     var out bytes.Buffer
     cmd.Stdout = &out
     var errout bytes.Buffer
     cmd.Stderr = &errout
     err := cmd.Run()
 
-    log.Println( "ExecIn: cmd.Run() :", err," - ",out.String(), " - ", errout.String())
+    log.Println( "ExecIn: cmd.Run() :", err," - ",out.Len(), " bytes of output - ", errout.Len(), " bytes of errors")
     if err != nil && err.Error() != "exit status 1" {
-        log.Println("Error running cmd: ", err, " : ", out.String(), errout.String())
+        log.Println("Error running cmd: ", err)
         return nil, err
     }
 
+    return parseExecResponse(out.String())
+}
+
+// Lifecycle executables answer with a JSON object on stdout, or nothing at all. The answer
+// of /provision and /bind holds credentials, so only its size and its keys get logged.
+func parseExecResponse(out string) (map[string] interface{}, error) {
     var response map[string]interface{}
-    resp := strings.TrimSpace( out.String() )
+    resp := strings.TrimSpace( out )
 
-    log.Printf("ExecIn: return: '%q'\n", resp )
+    log.Println("ExecIn: return: ", len(resp), " bytes")
     if resp == "" {
         response = nil
     } else {
-        err = json.Unmarshal([]byte(out.String()), &response)
+        err := json.Unmarshal([]byte(out), &response)
         if err != nil {
             log.Println("ExecOnContainer: Unmarshall error: ", err)
             return response, err
         }
     }
 
-    log.Println("ExecIn: Unmarshal response: ", response)
+    log.Println("ExecIn: Unmarshal response: ", responseKeys(response))
     return response, nil
 }
 
-func (dcexec DockerCommandExec) Provision()  (map[string] interface{}, error) {
-    response,err := dcexec.ExecIn([]string{ "/provision" })
-    return response,err
+// The keys of the answer of a lifecycle executable, sorted so they log the same every time.
+func responseKeys(response map[string] interface{}) []string {
+    keys := make([]string, 0, len(response))
+    for k := range response {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// The parameters of the request are handed to the lifecycle executables as a JSON object on stdin.
+func parametersInput(parameters map[string] interface{}) ([]byte, error) {
+    if parameters == nil {
+        parameters = map[string] interface{}{}
+    }
+    return json.Marshal(parameters)
 }
 
-func (dcexec DockerCommandExec) Bind()  (map[string] interface{}, error) {
-    response,err := dcexec.ExecIn([]string{ "/bind" })
-    return response,err
+func (dcexec DockerCommandExec) Provision(parameters map[string] interface{})  (map[string] interface{}, error) {
+    return provision(&dcexec, parameters)
 }
 
-func (dcexec DockerCommandExec) Unbind(serviceurl string)  (map[string] interface{}, error) {
-    return dcexec.ExecIn([]string{ "/unbind" , serviceurl })
+func (dcexec DockerCommandExec) Bind(bindingid, appid string, parameters map[string] interface{})  (map[string] interface{}, error) {
+    return bind(&dcexec, bindingid, appid, parameters)
+}
+
+func (dcexec DockerCommandExec) Unbind(bindingid string, credentials map[string] interface{})  (map[string] interface{}, error) {
+    return unbind(&dcexec, bindingid, credentials)
 }
 
 func (dcexec DockerCommandExec) Deprovision() (map[string] interface{}, error){
-    return dcexec.ExecIn([]string{ "/deprovision" })
+    return deprovision(&dcexec)
+}
+
+func (dcexec DockerCommandExec) Update(parameters map[string] interface{}) (map[string] interface{}, error) {
+    return update(&dcexec, parameters)
+}
+
+func provision(runner commandRunner, parameters map[string] interface{})  (map[string] interface{}, error) {
+    input, err := parametersInput(parameters)
+    if err != nil {
+        return nil, err
+    }
+    return runner.ExecIn([]string{ "/provision" }, input)
+}
+
+// /bind gets the binding and the app it is for, so it can hand out credentials of their own.
+func bind(runner commandRunner, bindingid, appid string, parameters map[string] interface{})  (map[string] interface{}, error) {
+    input, err := parametersInput(parameters)
+    if err != nil {
+        return nil, err
+    }
+    return runner.ExecIn([]string{ "/bind", bindingid, appid }, input)
+}
+
+// /unbind gets the credentials /bind handed out for the binding on stdin, to revoke them.
+func unbind(runner commandRunner, bindingid string, credentials map[string] interface{})  (map[string] interface{}, error) {
+    input, err := parametersInput(credentials)
+    if err != nil {
+        return nil, err
+    }
+    return runner.ExecIn([]string{ "/unbind", bindingid }, input)
 }
 
+func deprovision(runner commandRunner) (map[string] interface{}, error){
+    return runner.ExecIn([]string{ "/deprovision" }, nil)
+}
+
+// /update is optional, images without it simply keep running with the new plan.
+func update(runner commandRunner, parameters map[string] interface{}) (map[string] interface{}, error) {
+    input, err := parametersInput(parameters)
+    if err != nil {
+        return nil, err
+    }
+    return runner.ExecIn([]string{ "/bin/sh", "-c", "[ ! -x /update ] || exec /update" }, input)
+}
+
+// Runs the lifecycle executables through the exec API of the docker daemon, so the broker
+// needs no shell access to the docker host.
+type DockerAPIExec struct {
+    client *DockerClient
+    cId    string
+    image *brokerapi.ImageDefinition
+    env   []string
+}
+
+type execConfig struct {
+    AttachStdin  bool
+    AttachStdout bool
+    AttachStderr bool
+    Tty          bool
+    Cmd          []string
+}
+
+type execStartConfig struct {
+    Detach bool
+    Tty    bool
+}
+
+type execInspect struct {
+    Running  bool
+    ExitCode int
+}
+
+func (apiexec DockerAPIExec) Init(client *DockerClient ,cId string,image *brokerapi.ImageDefinition, env []string) DockerExec {
+    return &DockerAPIExec{client,cId,image,env}
+}
+
+// Runs command inside the container, input (if any) is written to its stdin over the
+// hijacked connection the exec is started on.
+func (apiexec *DockerAPIExec) ExecIn (command []string, input []byte) (map[string] interface{}, error) {
+    name := command[0]
+    command = withEnvironment(command, apiexec.env)
+    log.Println( "ExecIn.cmd:", name)
+
+    data, err := json.Marshal(execConfig{AttachStdin: len(input) > 0, AttachStdout: true, AttachStderr: true, Cmd: command})
+    if err != nil {
+        return nil, err
+    }
+    data, err = apiexec.client.DoRequest("POST", fmt.Sprintf("/containers/%s/exec", apiexec.cId), data)
+    if err != nil {
+        return nil, err
+    }
+    var created RespContainersCreate
+    if err = json.Unmarshal(data, &created); err != nil {
+        return nil, err
+    }
+
+    data, err = json.Marshal(execStartConfig{})
+    if err != nil {
+        return nil, err
+    }
+    data, err = apiexec.client.Hijack("POST", fmt.Sprintf("/exec/%s/start", created.Id), data, input)
+    if err != nil {
+        return nil, err
+    }
+    stdout, stderr, err := demuxStream(data)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err = apiexec.client.DoRequest("GET", fmt.Sprintf("/exec/%s/json", created.Id), nil)
+    if err != nil {
+        return nil, err
+    }
+    var inspect execInspect
+    if err = json.Unmarshal(data, &inspect); err != nil {
+        return nil, err
+    }
+
+    log.Println( "ExecIn: exit code :", inspect.ExitCode," - ",len(stdout), " bytes of output - ", len(stderr), " bytes of errors")
+    if inspect.ExitCode != 0 {
+        return nil, fmt.Errorf("%s exited with %d: %s", name, inspect.ExitCode, strings.TrimSpace(stderr))
+    }
+    return parseExecResponse(stdout)
+}
+
+// Without a tty docker multiplexes stdout and stderr, every frame starts with an 8 byte
+// header holding the stream (1 stdout, 2 stderr) and the big endian length of the payload.
+func demuxStream(data []byte) (string, string, error) {
+    var stdout, stderr bytes.Buffer
+    for len(data) > 0 {
+        if len(data) < 8 {
+            return "", "", errors.New("Truncated exec output")
+        }
+        size := int(binary.BigEndian.Uint32(data[4:8]))
+        if len(data) < 8+size {
+            return "", "", errors.New("Truncated exec output")
+        }
+        switch data[0] {
+        case 1:
+            stdout.Write(data[8:8+size])
+        case 2:
+            stderr.Write(data[8:8+size])
+        }
+        data = data[8+size:]
+    }
+    return stdout.String(), stderr.String(), nil
+}
+
+func (apiexec DockerAPIExec) Provision(parameters map[string] interface{})  (map[string] interface{}, error) {
+    return provision(&apiexec, parameters)
+}
+
+func (apiexec DockerAPIExec) Bind(bindingid, appid string, parameters map[string] interface{})  (map[string] interface{}, error) {
+    return bind(&apiexec, bindingid, appid, parameters)
+}
+
+func (apiexec DockerAPIExec) Unbind(bindingid string, credentials map[string] interface{})  (map[string] interface{}, error) {
+    return unbind(&apiexec, bindingid, credentials)
+}
+
+func (apiexec DockerAPIExec) Deprovision() (map[string] interface{}, error){
+    return deprovision(&apiexec)
+}
+
+func (apiexec DockerAPIExec) Update(parameters map[string] interface{}) (map[string] interface{}, error) {
+    return update(&apiexec, parameters)
+}
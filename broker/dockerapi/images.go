@@ -1,14 +1,22 @@
 package dockerapi
 
 import (
+    "encoding/base64"
     "encoding/json"
+    "errors"
     "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
     "strings"
     "time"
+    "github.com/brahmaroutu/docker-broker/broker/brokerapi"
 )
 
 type ImageInfo struct {
     RepoTags    []string
+    RepoDigests []string
     Id          string
     Parentid    string
     Created     uint64
@@ -94,6 +102,100 @@ func FindImage(docker DockerClient, tag string) (ImageInfo, error) {
     return ImageInfo{}, fmt.Errorf("Cannot find image")
 }
 
+// Looks for an image by its exact reference, repository:tag or repository@digest.
+func HasImage(docker DockerClient, ref string) (bool, error) {
+    images, err := ListAll(docker)
+    if err != nil {
+        return false, err
+    }
+    for _, image := range images {
+        for _, name := range append(image.RepoTags, image.RepoDigests...) {
+            if name == ref {
+                return true, nil
+            }
+        }
+    }
+    return false, nil
+}
+
+type pullMessage struct {
+    Id       string
+    Status   string
+    Progress string
+    Error    string
+}
+
+// Returns the registry an image repository is pulled from, the first path component when it
+// names a host (has a dot or a port, or is localhost), docker.io otherwise.
+func registryOf(repo string) string {
+    i := strings.Index(repo, "/")
+    if i < 0 {
+        return "docker.io"
+    }
+    host := repo[:i]
+    if strings.ContainsAny(host, ".:") || host == "localhost" {
+        return host
+    }
+    return "docker.io"
+}
+
+// The X-Registry-Auth header value docker expects, base64url encoded JSON.
+func registryAuthHeader(auth brokerapi.RegistryAuth) (string, error) {
+    data, err := json.Marshal(map[string]string{"username": auth.Username,
+                                                "password": auth.Password,
+                                                "email": auth.Email,
+                                                "serveraddress": auth.Registry})
+    if err != nil {
+        return "", err
+    }
+    return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// Pulls an image from its registry, tag can also be a digest. Docker streams its progress
+// as a sequence of JSON messages, each of them is handed to progress. auth is sent along
+// for private registries, it is nil for public images.
+func (docker *DockerClient) PullImage(name, tag string, auth *brokerapi.RegistryAuth, progress func(string)) error {
+    uri := "/images/create?fromImage="+url.QueryEscape(name)+"&tag="+url.QueryEscape(tag)
+    req, err := http.NewRequest("POST", docker.URL.String()+uri, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Add("Content-Type", "application/json")
+    if auth != nil {
+        header, err := registryAuthHeader(*auth)
+        if err != nil {
+            return err
+        }
+        req.Header.Add("X-Registry-Auth", header)
+    }
+    resp, err := docker.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == 404 {
+        return ErrNotFound
+    }
+    if resp.StatusCode >= 400 {
+        data, _ := ioutil.ReadAll(resp.Body)
+        return fmt.Errorf("%s: %s", resp.Status, data)
+    }
+
+    decoder := json.NewDecoder(resp.Body)
+    for {
+        var msg pullMessage
+        if err = decoder.Decode(&msg); err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        if len(msg.Error) > 0 {
+            return errors.New(msg.Error)
+        }
+        progress(strings.TrimSpace(msg.Id+" "+msg.Status+" "+msg.Progress))
+    }
+}
+
 func (docker *DockerClient) InspectImage(imageName string) (ImageConfig, error) {
     config := ImageConfig{}
     config.ContainerConfig = ImageRuntimeConfig{}
@@ -17,7 +17,7 @@ var _ = Describe("Images", func() {
     var ImageInfo1, ImageInfo2 dockerapi.ImageInfo
     var brokerservice *dockerapi.DockerClient
     var serviceagent brokerapi.ServiceAgent
-    var persister brokerapi.Persister
+    var persister brokerapi.Store
     var ts *httptest.Server
     var handler *testnet.TestHandler   
     var err error
@@ -44,7 +44,7 @@ var _ = Describe("Images", func() {
         }   
 
         serviceagent = testnet.NewServiceAgent()        
-        persister = testnet.NewPersister()
+        persister = testnet.NewStore()
     
         brokerservice,serviceagent,ts,handler = testnet.NewBrokerService(serviceagent,persister, listAllImageRequest)    
     })
@@ -11,16 +11,24 @@ type SimpleDispatcher struct {
 }
 
 func NewSimpleDispatcher(config BrokerConfiguration) *SimpleDispatcher {
-    config.Persister.Connect()    
     return &SimpleDispatcher{config}
 }
 
-func (sd *SimpleDispatcher) NewBrokerService() (brokerapi.BrokerService, error) {
-    serviceagents, err := sd.config.Persister.GetServiceAgentList(
-        sd.config.Persister.TimeElapsed("last_ping") + " < 3*ping_interval_secs and perf_factor=(select min(perf_factor) from serviceagents)")
+// Picks one of the least loaded live agents at random, the organization and space of the request
+// are not taken into account.
+func (sd *SimpleDispatcher) NewBrokerService(pr brokerapi.ProvisioningRequest) (brokerapi.BrokerService, error) {
+    liveagents, err := sd.config.Store.GetLiveServiceAgents()
     if err != nil {
         return nil, err
     }
+    var serviceagents []brokerapi.ServiceAgent
+    for _, sa := range liveagents {
+        if len(serviceagents) == 0 || sa.PerfFactor < serviceagents[0].PerfFactor {
+            serviceagents = []brokerapi.ServiceAgent{sa}
+        } else if sa.PerfFactor == serviceagents[0].PerfFactor {
+            serviceagents = append(serviceagents, sa)
+        }
+    }
     if len(serviceagents) == 0 {
         return nil, errors.New("no agents available")
     }
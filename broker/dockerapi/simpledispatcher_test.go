@@ -8,35 +8,31 @@ import (
     . "github.com/onsi/ginkgo"
     . "github.com/onsi/gomega"
 
-    "fmt"
     "time"
     "errors"
     )
 
 var _ = Describe("Simpledispatcher", func() {
     var config    dockerapi.BrokerConfiguration
-    var persister brokerapi.Persister
+    var persister brokerapi.Store
     var dispatcher brokerapi.DispatcherInterface
     var cm dockerapi.BrokerConfiguration
     var err error
     JustBeforeEach(func() {
         config = testnet.BrokerConfiguration(); 
         dispatcher = testnet.SimpleDispatcher()
-        persister = config.Persister
+        persister = config.Store
         cm = testnet.BrokerConfiguration()
     })
     
     Describe("brokertest test simpledispatcher", func() {
-        BeforeEach(func() {        
-            testnet.SetupSQL(persister)
-        })
         AfterEach(func() {
-            testnet.CleanupSQL(persister)
+            testnet.CleanupStore()
         })
 
         It("cannot create dispatcher when no agents are registered", func() {
             var newbrokerservice brokerapi.BrokerService
-            newbrokerservice, err = dispatcher.NewBrokerService()
+            newbrokerservice, err = dispatcher.NewBrokerService(brokerapi.ProvisioningRequest{})
             Expect(err).To(Equal(errors.New("no agents available")))
             Expect(newbrokerservice).Should(BeNil())    
         })
@@ -46,15 +42,11 @@ var _ = Describe("Simpledispatcher", func() {
             sa := testnet.NewServiceAgent()
 
             persister.AddorUpdateServiceAgent(sa)            
-            result,errs := persister.Db.Exec("update serviceagents set last_ping=?",time.Now().Add(-300*time.Minute))
-            fmt.Println(errs)
-            if err == nil {
-                i,_ := result.RowsAffected()
-                fmt.Println(i)
-            }
+            //the agent misses three pings
+            time.Sleep(time.Duration(3*sa.KeepAlive)*time.Second)
             
             var newbrokerservice brokerapi.BrokerService
-            newbrokerservice, err = dispatcher.NewBrokerService()
+            newbrokerservice, err = dispatcher.NewBrokerService(brokerapi.ProvisioningRequest{})
             Expect(err).To(Equal(errors.New("no agents available")))
             Expect(newbrokerservice).Should(BeNil())    
         })
@@ -64,7 +56,8 @@ var _ = Describe("Simpledispatcher", func() {
             sa := testnet.NewServiceAgent()
 
             persister.AddorUpdateServiceAgent(sa)            
-            persister.Db.Exec("update serviceagents set last_ping=?",time.Now().Add(-300*time.Minute))
+            //the agent misses three pings
+            time.Sleep(time.Duration(3*sa.KeepAlive)*time.Second)
 
             sa2 := testnet.NewServiceAgent()
             sa2.DockerHost = "localhost2";
@@ -73,7 +66,7 @@ var _ = Describe("Simpledispatcher", func() {
             persister.AddorUpdateServiceAgent(sa2)            
 
             var newbrokerservice brokerapi.BrokerService
-            newbrokerservice, err = dispatcher.NewBrokerService()
+            newbrokerservice, err = dispatcher.NewBrokerService(brokerapi.ProvisioningRequest{})
             Expect(err).To(BeNil())
             Expect(newbrokerservice).ShouldNot(BeNil())
         })
@@ -9,16 +9,43 @@ import (
 )
 
 func main() {
-    /* Usage: broker [ -config file ] */
+    /* Usage: broker [ -config file ] [ -migrate ] [ -rotatekey file ] */
 
     var configFile string
+    var migrate bool
+    var newKeyFile string
 
     flag.StringVar(&configFile, "config", "broker.config",
         "Location of configuration file")
+    flag.BoolVar(&migrate, "migrate", false,
+        "Migrate the DB schema and exit without starting the broker")
+    flag.StringVar(&newKeyFile, "rotatekey", "",
+        "Re-encrypt the secrets in the DB with the master key in this file and exit without starting the broker")
 
     flag.Parse()
 
     log.Println("ConfigFile:", configFile)
+    if migrate {
+        if err := dockerapi.MigrateSchema(configFile); err != nil {
+            log.Println("Failed to migrate the DB schema", err)
+            os.Exit(1)
+        }
+        log.Println("DB schema is at version", brokerapi.LatestSchemaVersion())
+        return
+    }
+    if len(newKeyFile) > 0 {
+        newKey, err := brokerapi.ReadEncryptionKeyFile(newKeyFile)
+        if err != nil {
+            log.Println("Failed to read the new encryption key", err)
+            os.Exit(1)
+        }
+        if err = dockerapi.RotateEncryptionKey(configFile, newKey); err != nil {
+            log.Println("Failed to rotate the encryption key", err)
+            os.Exit(1)
+        }
+        log.Println("Secrets are encrypted with the new key, configure it before starting the broker")
+        return
+    }
     config,err := dockerapi.NewConfiguration(configFile)
     if err != nil {
         log.Println("Failed to create configuration", err)
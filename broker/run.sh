@@ -14,7 +14,7 @@ mysql <<EOF
   FLUSH PRIVILEGES ;
 EOF
 
-# Set up broker DB and its tables
+# Set up broker DB, the broker creates its tables
 mysql < /setup.sql
 
 /etc/init.d/mysql stop
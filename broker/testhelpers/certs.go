@@ -0,0 +1,94 @@
+package testnet
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "path/filepath"
+    "time"
+
+    . "github.com/onsi/gomega"
+)
+
+// PEM files of a test CA and of a server and a client certificate it issued.
+type TestCertificates struct {
+    CAFile         string
+    ServerCertFile string
+    ServerKeyFile  string
+    ClientCertFile string
+    ClientKeyFile  string
+}
+
+// Writes the certificates into dir, the server certificate is issued for localhost and
+// 127.0.0.1, the client certificate for clientName.
+func NewTestCertificates(dir, clientName string) TestCertificates {
+    certs := TestCertificates{
+        CAFile:         filepath.Join(dir, "ca.pem"),
+        ServerCertFile: filepath.Join(dir, "server.pem"),
+        ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+        ClientCertFile: filepath.Join(dir, "client.pem"),
+        ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+    }
+
+    ca := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "Test CA"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    cakey := writeCertificate(ca, ca, nil, certs.CAFile, "")
+
+    server := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject:      pkix.Name{CommonName: "localhost"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        DNSNames:     []string{"localhost"},
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+    }
+    writeCertificate(server, ca, cakey, certs.ServerCertFile, certs.ServerKeyFile)
+
+    client := &x509.Certificate{
+        SerialNumber: big.NewInt(3),
+        Subject:      pkix.Name{CommonName: clientName},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }
+    writeCertificate(client, ca, cakey, certs.ClientCertFile, certs.ClientKeyFile)
+
+    return certs
+}
+
+// Signs template with parentkey, self signs it when parentkey is nil, and returns its key.
+func writeCertificate(template, parent *x509.Certificate, parentkey *ecdsa.PrivateKey, certfile, keyfile string) *ecdsa.PrivateKey {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    Ω(err).ShouldNot(HaveOccurred())
+    if parentkey == nil {
+        parentkey = key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentkey)
+    Ω(err).ShouldNot(HaveOccurred())
+    err = ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    Ω(err).ShouldNot(HaveOccurred())
+
+    if len(keyfile) > 0 {
+        keyder, err := x509.MarshalECPrivateKey(key)
+        Ω(err).ShouldNot(HaveOccurred())
+        err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+        Ω(err).ShouldNot(HaveOccurred())
+    }
+    return key
+}
@@ -2,6 +2,8 @@ package testnet
 
 import (
     "fmt"
+    "io"
+    "io/ioutil"
     "net/http"
     "net/http/httptest"
     "net/url"
@@ -17,6 +19,8 @@ type TestRequest struct {
     Header   http.Header
     Matcher  RequestMatcher
     Response TestResponse
+    //what the client has to write to a hijacked connection
+    Stdin    string
 }
 
 type RequestMatcher func(*http.Request)
@@ -36,7 +40,7 @@ type FakeDocker struct {
     URL        *url.URL
     ServerInfo brokerapi.ServiceAgent
     Containers map[string]string
-    persister  brokerapi.Persister
+    persister  brokerapi.Store
     errornum  int
 }
 
@@ -88,6 +92,12 @@ func (h *TestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         tester.Matcher(r)
     }
 
+    // the exec API takes the connection over, stdin arrives on it until the client half closes it
+    if r.Header.Get("Upgrade") == "tcp" && tester.Response.Status < 400 {
+        h.hijack(w, r, tester)
+        return
+    }
+
     // set response headers
     header := w.Header()
     for name, values := range tester.Response.Header {
@@ -99,7 +109,29 @@ func (h *TestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
     // write response
     w.WriteHeader(tester.Response.Status)
-    fmt.Fprintln(w, tester.Response.Body)
+    fmt.Fprint(w, tester.Response.Body)
+}
+
+func (h *TestHandler) hijack(w http.ResponseWriter, r *http.Request, tester TestRequest) {
+    io.Copy(ioutil.Discard, r.Body)
+    conn, rw, err := w.(http.Hijacker).Hijack()
+    if err != nil {
+        h.logError("Hijacking the connection failed: %s", err)
+        return
+    }
+    defer conn.Close()
+    fmt.Fprint(rw, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+    rw.Flush()
+
+    stdin, err := ioutil.ReadAll(rw)
+    if err != nil {
+        h.logError("Reading stdin failed: %s", err)
+    }
+    if string(stdin) != tester.Stdin {
+        h.logError("Stdin does not match.\nExpected: %s\nActual:   %s", tester.Stdin, stdin)
+    }
+    fmt.Fprint(rw, tester.Response.Body)
+    rw.Flush()
 }
 
 func NewTLSServer(requests []TestRequest) (*httptest.Server, *TestHandler) {
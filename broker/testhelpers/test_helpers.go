@@ -6,8 +6,10 @@ import (
 
     . "github.com/onsi/gomega"
 
+    "io/ioutil"
     "net/url"
     "net/http"
+    "os"
     "net/http/httptest"
     "strings"
     "strconv"
@@ -21,7 +23,7 @@ func NewTestRequest(request TestRequest) TestRequest {
     return request
 }
 
-func NewBrokerServiceWithMultipleRequests(serviceagent brokerapi.ServiceAgent, persister brokerapi.Persister, requests []TestRequest) (*dockerapi.DockerClient, brokerapi.ServiceAgent, *httptest.Server, *TestHandler) {
+func NewBrokerServiceWithMultipleRequests(serviceagent brokerapi.ServiceAgent, persister brokerapi.Store, requests []TestRequest) (*dockerapi.DockerClient, brokerapi.ServiceAgent, *httptest.Server, *TestHandler) {
     ts, handler := NewServer(requests)
     u, err := url.Parse(ts.URL)
     if err != nil {
@@ -36,10 +38,6 @@ func NewBrokerServiceWithMultipleRequests(serviceagent brokerapi.ServiceAgent, p
 }
 
 func BrokerConfiguration() dockerapi.BrokerConfiguration {
-    persister := NewPersister()
-    persister.Connect()
-    
-    
     id := []brokerapi.ImageDefinition {
         mysqlimg,ubuntuimg, 
     }
@@ -53,16 +51,20 @@ func BrokerConfiguration() dockerapi.BrokerConfiguration {
       
     cm := dockerapi.BrokerConfiguration {
         Services:     sd,
-        Persister:    persister,
+        Persister:    brokerapi.Persister{Driver: "memory", EncryptionKey: EncryptionKey},
+        Store:        store,
         ListenIP: "127.0.0.1",
         Port: 1234,
     }
 
-    persister.AddServiceConf(sd.User,sd.Password,sd.Catalog)
-    service_id := persister.GetServiceId(sd.Catalog)
-    for _,imgdef := range sd.Images {
-        dashurl,credentials,_ := cm.MarshalImageMaps(imgdef) 
-        persister.AddImageConf(service_id,imgdef.Name,imgdef.Plan,dashurl, credentials,imgdef.Numinstances,imgdef.Containername)
+    //brokers of earlier specs still serve from the same store, seed it once after every cleanup
+    if !store.HasServiceConf(sd.Catalog) {
+        store.AddServiceConf(sd.User,sd.Password,sd.Catalog)
+        service_id := store.GetServiceId(sd.Catalog)
+        for _,imgdef := range sd.Images {
+            dashurl,credentials,_ := cm.MarshalImageMaps(imgdef) 
+            store.AddImageConf(service_id,imgdef.Name,imgdef.Plan,dashurl, credentials,imgdef.Numinstances,imgdef.Containername)
+        }
     }
     
     return cm
@@ -74,7 +76,7 @@ func SimpleDispatcher() brokerapi.DispatcherInterface {
 
 }
 
-func NewBrokerService(serviceagent brokerapi.ServiceAgent, persister brokerapi.Persister, req TestRequest) (*dockerapi.DockerClient, brokerapi.ServiceAgent, *httptest.Server, *TestHandler) {
+func NewBrokerService(serviceagent brokerapi.ServiceAgent, persister brokerapi.Store, req TestRequest) (*dockerapi.DockerClient, brokerapi.ServiceAgent, *httptest.Server, *TestHandler) {
     requests := []TestRequest{req}
     return NewBrokerServiceWithMultipleRequests(serviceagent, persister,requests)
 }
@@ -91,17 +93,34 @@ func NewServiceAgent() brokerapi.ServiceAgent {
     }
 }
 
-func NewPersister() brokerapi.Persister {
+// Master keys of the stores of the tests, 32 bytes in base64 like the broker requires.
+const EncryptionKey = "ZmFrZUVuY3J5cHRpb25LZXkuLi4uLi4uLi4uLi4uLi4="
+const NewEncryptionKey = "bmV3RmFrZUVuY3J5cHRpb25LZXkuLi4uLi4uLi4uLi4="
+
+// All brokers of a test binary share this store, like they shared a database before.
+var store = brokerapi.NewMemoryStore(EncryptionKey)
+
+func NewStore() brokerapi.Store {
+    return store
+}
+
+// Returns a persister on a database file of its own, for the specs of the SQL persister.
+func NewSQLPersister() brokerapi.Persister {
+    file, err := ioutil.TempFile("", "broker_testdb")
+    Ω(err).ShouldNot(HaveOccurred())
+    file.Close()
     return brokerapi.Persister {
         Driver: "sqlite3",
-          Host: "localhost",
-          Port: 3306,
-          User: "docker",
-          Password: "docker",
-          Database: "broker_testdb",
+          Database: file.Name(),
+          EncryptionKey: EncryptionKey,
      }
 }
 
+func RemoveSQLPersister(persister brokerapi.Persister) {
+    persister.Close()
+    os.Remove(persister.Database)
+}
+
 func NewDockerServices() []brokerapi.Service {
     images := []brokerapi.ImageDefinition { mysqlimg,ubuntuimg }
     dockerServices := make([]brokerapi.Service, len(images))
@@ -111,6 +130,9 @@ func NewDockerServices() []brokerapi.Service {
         Name:        image.Name,
         Description: image.Name + " docker service",
         Bindable:    true,
+        PlanUpdateable: true,
+        InstancesRetrievable: true,
+        BindingsRetrievable: true,
         Tags:        []string{"docker"},
         Plans: []brokerapi.Plan{
             brokerapi.Plan{
@@ -155,19 +177,8 @@ var ubuntuimg = brokerapi.ImageDefinition {
             Plan: "100",
            }
            
-func SetupSQL(persister brokerapi.Persister) {
-
-}
-
-func CleanupSQL(persister brokerapi.Persister) {
-    persister.Connect()
-    persister.Db.Exec("delete from serviceagents")
-    persister.Db.Exec("delete from servicebindings")
-    persister.Db.Exec("delete from serviceinstances")
-    persister.Db.Exec("delete from brokerconfigurations")
-    persister.Db.Exec("delete from imageconfigurations")
-    persister.Db.Exec("delete from serviceconfigurations")
-    persister.Db.Exec("delete from brokercertificates")
+func CleanupStore() {
+    store.Clear()
 }
 
 var Exec_CommandResponse = map[string] map[string] interface{} {